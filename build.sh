@@ -11,7 +11,13 @@ fi
 # Go将禁用对因特尔指令集、C库、系统工具链的依赖，也就是禁用了 CGO。这时，Go只能使用纯Go代码，不能调用C语言库等外部资源。
 # 当CGO_ENABLED=1，进行编译时会将文件中引用libc的库（比如常用的net包），以动态链接的方式生成目标文件。
 # 当CGO_ENABLED=0，进行编译时则会把在目标文件中未定义的符号（外部函数）一起链接到可执行文件中。
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o sugar-agent_amd64 cmd/main.go
-GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -o sugar-agent_arm64 cmd/main.go
+# 版本信息通过-ldflags写入，可以通过VERSION环境变量指定版本号，默认使用git describe的结果
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+GO_VERSION=$(go env GOVERSION)
+LDFLAGS="-X main.version=$VERSION -X main.commit=$COMMIT -X main.goVersion=$GO_VERSION"
+echo "version: $VERSION, commit: $COMMIT"
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "$LDFLAGS" -o sugar-agent_amd64 ./cmd
+GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags "$LDFLAGS" -o sugar-agent_arm64 ./cmd
 echo "build done."
 ls -larth ./sugar-agent*
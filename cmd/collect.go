@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/sink"
+	"sugar-agent/pkg/utils"
+)
+
+// output formats of the collect command
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+// baseCollectors cpu, memory, disk and load are sampled by CollectSummary, value: prefix of their metric names
+var baseCollectors = map[string]string{
+	"cpu":    "cpu_",
+	"memory": "memory_",
+	"disk":   "disk_",
+	"load":   "load",
+}
+
+// collectCmd samples the collectors locally without RabbitMQ or sugar-server, for troubleshooting and testing collectors
+// ex: sugar-agent collect -interval 5s -count 60 -collectors cpu,mem,disk -out result.json
+func collectCmd(fs *flag.FlagSet, args []string) int {
+	interval := fs.Duration("interval", 5*time.Second, "Interval between samples")
+	count := fs.Int("count", 1, "Number of samples")
+	names := fs.String("collectors", "", "Comma separated collectors, ex: cpu,mem,disk,load,http_probes, empty means all")
+	out := fs.String("out", "", "File the result is written to, empty means stdout")
+	format := fs.String("format", "", "Output format: table, json or csv, default: by the extension of -out, table on stdout")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	err := registerCollectors()
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig
+	}
+	err = collect(*interval, *count, utils.SplitList(*names), *out, *format)
+	if err != nil {
+		log.Printf("[error] Failed to collect: %s", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// collect samples count times every interval and writes the samples in format to out
+// interval: interval between samples
+// count: number of samples
+// names: collector names, empty means all
+// out: output file, empty means stdout
+// format: table, json or csv, empty means by the extension of out
+// return: error
+func collect(interval time.Duration, count int, names []string, out string, format string) error {
+	if count < 1 || interval <= 0 {
+		return errors.New("count must be at least 1 and interval must be positive")
+	}
+	if format == "" {
+		format = formatTable
+		switch strings.ToLower(filepath.Ext(out)) {
+		case ".json":
+			format = formatJSON
+		case ".csv":
+			format = formatCSV
+		}
+	}
+	if format != formatTable && format != formatJSON && format != formatCSV {
+		return fmt.Errorf("unknown format %q, expect table, json or csv", format)
+	}
+	base, extraNames, err := selectCollectors(names)
+	if err != nil {
+		return err
+	}
+	extra, err := internal.NewCollectors(extraNames)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseCollectors(extra)
+
+	// CTRL+C stops sampling early, the samples taken so far are still written
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var onSample func(internal.DynamicDataSummary)
+	if format == formatTable && out == "" {
+		printTableHeader(base)
+		onSample = func(s internal.DynamicDataSummary) { printTableRow(base, s) }
+	}
+	perfData, err := internal.CollectPerfData(ctx, interval, uint64(count), extra, onSample)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	if onSample != nil {
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(perfData)
+	case formatCSV:
+		samples := make([]sink.Sample, 0, len(perfData.Data))
+		for _, s := range perfData.Data {
+			extraMetrics := s.Metrics
+			s.Metrics = nil
+			metrics := append(baseMetrics(base, internal.SummaryMetrics(s)), extraMetrics...)
+			samples = append(samples, sink.Sample{Time: s.Time(), Metrics: metrics})
+		}
+		deviceID := *deviceId
+		if deviceID == "" {
+			deviceID = perfData.Properties.HostInfo.Hostname
+		}
+		return sink.WriteCSV(w, samples, sink.Resource{DeviceID: deviceID})
+	}
+	printTableHeader(base)
+	for _, s := range perfData.Data {
+		printTableRow(base, s)
+	}
+	return nil
+}
+
+// selectCollectors splits collector names into base collectors and additional collectors, mem is short for memory
+// names: collector names, empty means all
+// return: base collectors, additional collectors, error
+func selectCollectors(names []string) (map[string]bool, []string, error) {
+	base := make(map[string]bool)
+	if len(names) == 0 {
+		for name := range baseCollectors {
+			base[name] = true
+		}
+		return base, internal.ExtraCollectors(), nil
+	}
+	var extra []string
+	available := internal.Collectors()
+	for _, name := range names {
+		if name == "mem" {
+			name = "memory"
+		}
+		if _, ok := baseCollectors[name]; ok {
+			base[name] = true
+			continue
+		}
+		found := false
+		for _, a := range available {
+			found = found || a == name
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("collector %s not available, available collectors: %s", name, strings.Join(available, ","))
+		}
+		extra = append(extra, name)
+	}
+	return base, extra, nil
+}
+
+// baseMetrics keeps the metrics of the selected base collectors
+func baseMetrics(base map[string]bool, metrics []internal.Metric) []internal.Metric {
+	var res []internal.Metric
+	for _, m := range metrics {
+		for name, prefix := range baseCollectors {
+			if base[name] && strings.HasPrefix(m.Name, prefix) {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// printTableHeader prints the header of the table of the selected base collectors
+func printTableHeader(base map[string]bool) {
+	line := fmt.Sprintf("%-19s", "TIME")
+	if base["cpu"] {
+		line += fmt.Sprintf("  %7s", "CPU%")
+	}
+	if base["memory"] {
+		line += fmt.Sprintf("  %7s  %9s", "MEM%", "MEM USED")
+	}
+	if base["disk"] {
+		line += fmt.Sprintf("  %7s  %9s", "DISK%", "DISK USED")
+	}
+	if base["load"] {
+		line += fmt.Sprintf("  %6s  %6s  %6s", "LOAD1", "LOAD5", "LOAD15")
+	}
+	fmt.Println(line)
+}
+
+// printTableRow prints a sample, metrics of additional collectors are printed below the row, one per line
+func printTableRow(base map[string]bool, s internal.DynamicDataSummary) {
+	line := fmt.Sprintf("%-19s", s.TimeStamp)
+	if base["cpu"] {
+		line += fmt.Sprintf("  %7.2f", s.CpuPercent)
+	}
+	if base["memory"] {
+		line += fmt.Sprintf("  %7.2f  %7.2fGB", s.MemInfo.UsedPercent, s.MemInfo.Used)
+	}
+	if base["disk"] {
+		line += fmt.Sprintf("  %7.2f  %7.2fGB", s.DiskInfo.UsedPercent, s.DiskInfo.Used)
+	}
+	if base["load"] {
+		line += fmt.Sprintf("  %6.2f  %6.2f  %6.2f", s.LoadInfo.Load1, s.LoadInfo.Load5, s.LoadInfo.Load15)
+	}
+	fmt.Println(line)
+	for _, m := range s.Metrics {
+		var pairs []string
+		for k, v := range m.Labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		name := m.Name
+		if len(pairs) > 0 {
+			name += "{" + strings.Join(pairs, ",") + "}"
+		}
+		fmt.Printf("    %s %g\n", name, m.Value)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// exit codes, distinct per failure class, documented in README
+const (
+	exitOK      = 0 // success
+	exitFailure = 1 // the command failed at runtime, ex: a collection error
+	// 2 is used by the Go runtime when the agent crashes with a panic
+	exitUsage        = 3 // unknown command or invalid flag syntax
+	exitMissingFlags = 4 // required flags are missing, see utils.ShowTips
+	exitConfig       = 5 // invalid configuration, ex: a bad flag value or an unreadable allowlist
+	exitBroker       = 6 // connecting or publishing to RabbitMQ failed
+	exitSelftest     = 7 // some collectors do not work on this host
+)
+
+// command a subcommand of the agent, it registers its own flags on fs, parses args and returns the exit code
+type command struct {
+	name        string
+	description string
+	run         func(fs *flag.FlagSet, args []string) int
+}
+
+var commands []command
+
+func init() {
+	// assigned in init, the run funcs refer to commands themselves
+	commands = []command{
+		{"run", "Consume tasks from RabbitMQ and execute them (default)", runCmd},
+		{"collect", "Collect performance data locally without RabbitMQ or sugar-server", collectCmd},
+		{"validate-config", "Check flags, allowlists, probe files and sinks without connecting anywhere", validateConfigCmd},
+		{"version", "Print version, commit and Go version", versionCmd},
+		{"selftest", "Run every collector once and report which work on this host", selftestCmd},
+		{"send-test-task", "Publish a sample task to the broker", sendTestTaskCmd},
+	}
+}
+
+// lookupCommand returns the command of a name
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// newFlagSet returns the flag set of a command, it has every agent flag, so they can be given to any command
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("sugar-agent "+name, flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// parseFlags parses the flags of a command, then applies the environment and the config file
+// fs: flag set of the command
+// args: arguments after the command name
+// return: exit code, false when the command must stop, ex: -h, an invalid flag or an invalid config file
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if code, ok := parseArgs(fs, args); !ok {
+		return code, false
+	}
+	err := loadConfig(fs)
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig, false
+	}
+	return exitOK, true
+}
+
+// parseArgs parses the command line only, for commands not depending on the configuration
+func parseArgs(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// printUsage prints the commands
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: sugar-agent [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'sugar-agent <command> -h' to show the flags of a command.\n")
+}
+
+func main() {
+	// no command means run, so the flags-only invocation of older versions keeps working
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		os.Exit(exitOK)
+	}
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		log.Printf("[error] Unknown command %q", name)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(newFlagSet(name), args))
+}
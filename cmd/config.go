@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"sugar-agent/pkg/config"
+	"sugar-agent/pkg/utils"
+)
+
+// envPrefix prefix of the environment variables overriding the config file, ex: SUGAR_AGENT_PASSWORD
+const envPrefix = "SUGAR_AGENT_"
+
+// defaultConfigPaths are tried in order when neither -config nor SUGAR_AGENT_CONFIG is set
+var defaultConfigPaths = []string{
+	"sugar-agent.yaml", "sugar-agent.yml", "sugar-agent.toml",
+	"/etc/sugar-agent/config.yaml", "/etc/sugar-agent/config.yml", "/etc/sugar-agent/config.toml",
+}
+
+// configSchema maps the keys of the config file to flags, every flag except -config has a key
+var configSchema = config.Schema{
+	"mq.host":                 "host",
+	"mq.port":                 "port",
+	"mq.user":                 "user",
+	"mq.password":             "password",
+	"mq.exchange_name":        "exchange-name",
+	"mq.exchange_type":        "exchange-type",
+	"mq.dead_letter_exchange": "dead-letter-exchange",
+	"mq.results_exchange":     "results-exchange",
+	"mq.presence_exchange":    "presence-exchange",
+	"mq.heartbeat_interval":   "heartbeat-interval",
+	"mq.queue.durable":        "queue-durable",
+	"mq.queue.exclusive":      "queue-exclusive",
+	"mq.queue.auto_delete":    "queue-auto-delete",
+	"mq.queue.type":           "queue-type",
+	"mq.queue.message_ttl":    "queue-message-ttl",
+	"mq.queue.max_length":     "queue-max-length",
+
+	"tls.enabled":              "tls",
+	"tls.ca_file":              "tls-ca-file",
+	"tls.cert_file":            "tls-cert-file",
+	"tls.key_file":             "tls-key-file",
+	"tls.server_name":          "tls-server-name",
+	"tls.insecure_skip_verify": "tls-insecure-skip-verify",
+
+	"device.id":     "device-id",
+	"device.groups": "groups",
+	"device.labels": "labels",
+
+	"tasks.workers":               "workers",
+	"tasks.type_limits":           "task-type-limits",
+	"tasks.max_attempts":          "max-attempts",
+	"tasks.journal_file":          "journal-file",
+	"tasks.result_transport":      "result-transport",
+	"tasks.allowed_hosts":         "allowed-hosts",
+	"tasks.verify.mode":           "verify-mode",
+	"tasks.verify.key_file":       "verify-key-file",
+	"tasks.verify.max_age":        "verify-max-age",
+	"tasks.command.allowlist":     "command-allowlist",
+	"tasks.command.user":          "command-user",
+	"tasks.command.allow_root":    "command-allow-root",
+	"tasks.command.workdir":       "command-workdir",
+	"tasks.command.max_output":    "command-max-output",
+	"tasks.command.max_timeout":   "command-max-timeout",
+	"tasks.log_collect.allowlist": "log-allowlist",
+	"tasks.log_collect.max_bytes": "log-max-bytes",
+
+	"collectors.log_patterns":   "log-patterns",
+	"collectors.http_probes":    "http-probes",
+	"collectors.tcp_probes":     "tcp-probes",
+	"collectors.dns_probes":     "dns-probes",
+	"collectors.dns_resolver":   "dns-resolver",
+	"collectors.scrape_targets": "scrape-targets",
+	"collectors.probe_timeout":  "probe-timeout",
+
+	"sinks.buffer":                  "sink-buffer",
+	"sinks.retries":                 "sink-retries",
+	"sinks.sample_interval":         "sample-interval",
+	"sinks.otlp.endpoint":           "otlp-endpoint",
+	"sinks.otlp.encoding":           "otlp-encoding",
+	"sinks.otlp.headers":            "otlp-headers",
+	"sinks.otlp.batch":              "otlp-batch",
+	"sinks.otlp.retries":            "otlp-retries",
+	"sinks.otlp.buffer":             "otlp-buffer",
+	"sinks.influx.url":              "influx-url",
+	"sinks.influx.version":          "influx-version",
+	"sinks.influx.database":         "influx-database",
+	"sinks.influx.retention_policy": "influx-retention-policy",
+	"sinks.influx.user":             "influx-user",
+	"sinks.influx.password":         "influx-password",
+	"sinks.influx.token":            "influx-token",
+	"sinks.influx.org":              "influx-org",
+	"sinks.influx.bucket":           "influx-bucket",
+	"sinks.influx.precision":        "influx-precision",
+	"sinks.influx.batch":            "influx-batch",
+	"sinks.influx.retries":          "influx-retries",
+	"sinks.influx.buffer":           "influx-buffer",
+	"sinks.graphite.address":        "graphite-address",
+	"sinks.graphite.prefix":         "graphite-prefix",
+	"sinks.graphite.tagged":         "graphite-tagged",
+	"sinks.graphite.batch":          "graphite-batch",
+	"sinks.graphite.retries":        "graphite-retries",
+	"sinks.graphite.buffer":         "graphite-buffer",
+	"sinks.file.dir":                "file-output-dir",
+	"sinks.file.content":            "file-output-content",
+	"sinks.file.format":             "file-output-format",
+	"sinks.file.compress":           "file-output-compress",
+	"sinks.file.max_bytes":          "file-output-max-bytes",
+	"sinks.file.max_age":            "file-output-max-age",
+	"sinks.file.retention":          "file-output-retention",
+	"sinks.file.max_files":          "file-output-max-files",
+	"sinks.file.buffer":             "file-output-buffer",
+	"sinks.server.retries":          "server-retries",
+
+	"metrics.listen": "metrics-listen",
+	"metrics.buffer": "metrics-buffer",
+
+	"logging.level": "log-level",
+	"logging.file":  "log-file",
+
+	"reload.watch_interval": "config-watch-interval",
+}
+
+// secretFlags may be read from a file: <key>_file in the config file, SUGAR_AGENT_<NAME>_FILE in the environment
+var secretFlags = map[string]bool{
+	"password":        true,
+	"influx-password": true,
+	"influx-token":    true,
+	"otlp-headers":    true,
+}
+
+var (
+	cmdlineFlags = make(map[string]bool) // flags given on the command line, they win over the environment and the config file
+	configFile   string                  // config file in use, empty when none
+)
+
+// loadConfig sets the agent flags not given on the command line from the environment and the config file,
+// then sets up logging; precedence: command line > environment > config file > defaults
+// fs: parsed flag set of the command
+// return: error
+func loadConfig(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+	values, sources, path, err := resolveSettings()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = flag.Set(name, values[name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", sources[name], err)
+		}
+	}
+	configFile = path
+	err = utils.SetupLogging(*logLevel, *logFile)
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		log.Printf("[x] Loaded config file [x] -> %s", path)
+	}
+	for _, name := range names {
+		log.Printf("[debug] -%s set from %s", name, sources[name])
+	}
+	return nil
+}
+
+// resolveSettings reads the environment and the config file
+// return: flag name -> value of the flags not given on the command line, flag name -> source, config file path, error
+func resolveSettings() (map[string]string, map[string]string, string, error) {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	env, err := config.FromEnv(envPrefix, names, secretFlags)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	path := *configPath
+	if !cmdlineFlags["config"] && env["config"] != "" {
+		path = env["config"]
+	}
+	if path == "" {
+		path = config.FindFile(defaultConfigPaths)
+	}
+	values := make(map[string]string)
+	sources := make(map[string]string)
+	if path != "" {
+		tree, err := config.Decode(path)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		file, err := config.Resolve(tree, configSchema, secretFlags)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("invalid config file %s:\n%w", path, err)
+		}
+		keys := make(map[string]string, len(configSchema))
+		for key, name := range configSchema {
+			keys[name] = key
+		}
+		for name, val := range file {
+			values[name], sources[name] = val, fmt.Sprintf("%s of %s", keys[name], path)
+		}
+	}
+	for name, val := range env {
+		values[name], sources[name] = val, config.EnvName(envPrefix, name)
+	}
+	delete(values, "config")
+	for name := range cmdlineFlags {
+		delete(values, name)
+	}
+	return values, sources, path, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetConfig restores every flag and the config state after a test loaded a config
+func resetConfig(t *testing.T) {
+	t.Helper()
+	previous := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		previous[f.Name] = f.Value.String()
+	})
+	t.Cleanup(func() {
+		for name, val := range previous {
+			_ = flag.Set(name, val)
+		}
+		cmdlineFlags = make(map[string]bool)
+		configFile = ""
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	resetConfig(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.yaml")
+	err := os.WriteFile(path, []byte(`
+mq:
+  host: file-host
+  port: 5671
+  exchange_name: file-exchange
+  user: file-user
+device:
+  groups: [db, cache]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", path)
+	t.Setenv(envPrefix+"PORT", "5000")
+	t.Setenv(envPrefix+"EXCHANGE_NAME", "env-exchange")
+
+	code, ok := parseFlags(newFlagSet("run"), []string{"-exchange-name", "cmdline-exchange"})
+	if !ok {
+		t.Fatalf("parseFlags() failed with exit code %d", code)
+	}
+	if configFile != path {
+		t.Errorf("config file = %q, want %q from %sCONFIG", configFile, path, envPrefix)
+	}
+	for name, want := range map[string]string{
+		"exchange-name": "cmdline-exchange", // command line > environment > config file
+		"port":          "5000",             // environment > config file
+		"host":          "file-host",        // config file > default
+		"user":          "file-user",
+		"groups":        "db,cache",
+		"queue-type":    flag.Lookup("queue-type").DefValue, // default
+	} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// a reload keeps the command line and picks up changes of the environment
+	t.Setenv(envPrefix+"EXCHANGE_NAME", "env-exchange-2")
+	t.Setenv(envPrefix+"HOST", "env-host")
+	changed, err := changedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := changed["exchange-name"]; ok {
+		t.Errorf("reload changed -exchange-name given on the command line")
+	}
+	if changed["host"] != "env-host" {
+		t.Errorf("reload -host = %q, want env-host", changed["host"])
+	}
+}
+
+func TestConfigCommandLinePath(t *testing.T) {
+	resetConfig(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"env.toml":     "[mq]\nhost = \"env-file-host\"\n",
+		"cmdline.toml": "[mq]\nhost = \"cmdline-file-host\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(envPrefix+"CONFIG", filepath.Join(dir, "env.toml"))
+
+	_, ok := parseFlags(newFlagSet("run"), []string{"-config", filepath.Join(dir, "cmdline.toml")})
+	if !ok {
+		t.Fatal("parseFlags() failed")
+	}
+	if *host != "cmdline-file-host" {
+		t.Errorf("-host = %q, want it from the config file given on the command line", *host)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown key", "mq:\n  hots: x\n", nil},
+		{"invalid value", "tasks:\n  workers: many\n", nil},
+		{"unknown environment variable", "", map[string]string{envPrefix + "HOTS": "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			path := filepath.Join(t.TempDir(), "agent.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(envPrefix+"CONFIG", path)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if code, ok := parseFlags(newFlagSet("run"), nil); ok || code != exitConfig {
+				t.Fatalf("parseFlags() = %d, %t, want exit code %d", code, ok, exitConfig)
+			}
+		})
+	}
+}
+
+func TestConfigSchemaCoversFlags(t *testing.T) {
+	keys := make(map[string]bool, len(configSchema))
+	for _, name := range configSchema {
+		if flag.Lookup(name) == nil {
+			t.Errorf("config key of unknown flag -%s", name)
+		}
+		keys[name] = true
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		// -test.* flags are registered by go test
+		if f.Name != "config" && !strings.HasPrefix(f.Name, "test.") && !keys[f.Name] {
+			t.Errorf("-%s has no config key", f.Name)
+		}
+	})
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 
+	"sugar-agent/internal"
+	"sugar-agent/pkg/auth"
+	"sugar-agent/pkg/labels"
+	"sugar-agent/pkg/sink"
 	"sugar-agent/pkg/task"
 	"sugar-agent/pkg/utils"
 )
@@ -22,173 +36,976 @@ var (
 	port           = flag.String("port", "", "MQ server port")
 	exchangeName   = flag.String("exchange-name", "", "MQ exchange name")
 	deviceId       = flag.String("device-id", "", "deviceId")
-)
+	verifyMode     = flag.String("verify-mode", auth.ModeNone, "Message signature verification mode: none, hmac or ed25519")
+	verifyKeyFile  = flag.String("verify-key-file", "", "HMAC shared key file or Ed25519 public key file")
+	verifyMaxAge   = flag.Duration("verify-max-age", 5*time.Minute, "Max age of a signed message, older messages are rejected")
+	allowedHosts   = flag.String("allowed-hosts", "", "Comma separated allowlist of base_url hosts, empty means allow all")
+	exchangeType   = flag.String("exchange-type", "fanout", "MQ exchange type: fanout, direct or topic")
+	groups         = flag.String("groups", "", "Comma separated device groups, used as routing keys group.<name> with direct/topic exchange")
+	deviceLabels   = flag.String("labels", "", "Comma separated device labels, ex: env=prod,role=db")
+	configPath     = flag.String("config", "", "YAML or TOML config file, default: the first existing of "+strings.Join(defaultConfigPaths, ", "))
 
-func init() {
-	flag.Parse()
-}
+	tlsEnabled    = flag.Bool("tls", false, "Connect to MQ server over TLS (amqps)")
+	tlsCAFile     = flag.String("tls-ca-file", "", "CA certificates file the MQ server certificate is verified with, empty means the system roots")
+	tlsCertFile   = flag.String("tls-cert-file", "", "Client certificate file, for MQ servers requiring client certificates")
+	tlsKeyFile    = flag.String("tls-key-file", "", "Private key file of the client certificate")
+	tlsServerName = flag.String("tls-server-name", "", "Name the MQ server certificate is verified against, default: -host")
+	tlsSkipVerify = flag.Bool("tls-insecure-skip-verify", false, "Do not verify the MQ server certificate, for testing only")
+	logLevel      = flag.String("log-level", utils.LevelInfo, "Log level: debug, info, warn or error")
+	logFile       = flag.String("log-file", "", "File logs are appended to, empty means stderr, it is reopened on SIGHUP")
+
+	configWatchInterval = flag.Duration("config-watch-interval", 0, "Check the config file for changes at this interval and reload it, 0 means it is only reloaded on SIGHUP")
+
+	queueDurable      = flag.Bool("queue-durable", true, "Declare a durable queue, so tasks survive broker restarts")
+	queueExclusive    = flag.Bool("queue-exclusive", false, "Declare an exclusive queue, it is deleted when the agent disconnects")
+	queueAutoDelete   = flag.Bool("queue-auto-delete", false, "Delete the queue when the last consumer unsubscribes")
+	queueType         = flag.String("queue-type", "classic", "MQ queue type: classic or quorum")
+	queueMessageTTL   = flag.Duration("queue-message-ttl", 0, "Drop tasks waiting in the queue longer than this, 0 means never")
+	queueMaxLength    = flag.Int("queue-max-length", 0, "Max number of tasks waiting in the queue, 0 means unlimited")
+	deadLetterExch    = flag.String("dead-letter-exchange", "", "Exchange rejected and expired tasks are sent to, empty means drop them")
+	journalFile       = flag.String("journal-file", "sugar-agent-journal.json", "File recording finished tasks, so redelivered tasks are not executed twice, empty means in memory only")
+	resultTransport   = flag.String("result-transport", transportHTTP, "How task status and results are reported: http (sugar-server API) or amqp (ReplyTo queue or results exchange)")
+	resultsExchange   = flag.String("results-exchange", "", "Exchange results are published to with routing key result.<device-id> when the task has no ReplyTo, required in amqp transport mode")
+	workers           = flag.Int("workers", 1, "Number of tasks executed concurrently, also the prefetch count")
+	taskTypeLimits    = flag.String("task-type-limits", "", "Comma separated max concurrent tasks per task type, ex: 0=1,1=4")
+	presenceExch      = flag.String("presence-exchange", "", "Exchange registration, heartbeat and offline messages are published to with routing key presence.<device-id>, empty means disabled")
+	heartbeatInterval = flag.Duration("heartbeat-interval", 30*time.Second, "Interval of heartbeat messages")
+	maxAttempts       = flag.Int("max-attempts", 3, "Max attempts to handle a message, after that it is sent to the dead letter exchange")
+
+	commandAllowlist  = flag.String("command-allowlist", "", "File of commands the command task may run (names, absolute paths or sha256:<hex>), empty means the command task is disabled")
+	commandUser       = flag.String("command-user", "", "Run commands as this unprivileged user, ex: nobody, the agent must run as root; empty means the agent's user")
+	commandAllowRoot  = flag.Bool("command-allow-root", false, "Allow running commands as root, the agent refuses to start otherwise when they would run as root")
+	commandWorkDir    = flag.String("command-workdir", filepath.Join(os.TempDir(), "sugar-agent"), "Base directory commands run in")
+	commandMaxOutput  = flag.Int("command-max-output", 64*1024, "Max bytes kept of command stdout and of stderr")
+	commandMaxTimeout = flag.Duration("command-max-timeout", 5*time.Minute, "Max run time of a command")
+
+	logAllowlist        = flag.String("log-allowlist", "", "Comma separated glob patterns of log files the log collection task may read, empty means the task is disabled")
+	logMaxBytes         = flag.Int("log-max-bytes", 10*1024*1024, "Max bytes collected per log file")
+	logPatterns         = flag.String("log-patterns", "", "File of log patterns counted during perf tasks, one \"<name> <file> <regex>\" per line")
+	httpProbes          = flag.String("http-probes", "", "File of http endpoints probed during perf tasks, one \"<name> <url> [body regex]\" per line")
+	tcpProbes           = flag.String("tcp-probes", "", "File of tcp ports probed during perf tasks, one \"<name> <host:port>\" per line")
+	dnsProbes           = flag.String("dns-probes", "", "File of dns names probed during perf tasks, one \"<name> <query> [A|AAAA|CNAME|MX|TXT]\" per line")
+	dnsResolver         = flag.String("dns-resolver", "", "Resolver host:port used by dns probes, empty means the system resolver")
+	scrapeTargets       = flag.String("scrape-targets", "", "File of local metrics endpoints scraped during perf tasks, one \"<name> <url> [selector...]\" per line")
+	probeTimeout        = flag.Duration("probe-timeout", 5*time.Second, "Timeout of one probe request")
+	otlpEndpoint        = flag.String("otlp-endpoint", "", "OTLP/HTTP metrics endpoint samples are exported to, ex: http://localhost:4318/v1/metrics, empty means disabled")
+	otlpEncoding        = flag.String("otlp-encoding", sink.EncodingProtobuf, "OTLP encoding: protobuf or json")
+	otlpHeaders         = flag.String("otlp-headers", "", "Comma separated http headers of OTLP requests, ex: Authorization=Bearer xxx")
+	otlpBatch           = flag.Int("otlp-batch", 1000, "Max data points per OTLP request")
+	otlpRetries         = flag.Int("otlp-retries", -1, "Max retries of a failed OTLP request, -1 means -sink-retries")
+	otlpBuffer          = flag.Int("otlp-buffer", -1, "Max batches buffered for OTLP, -1 means -sink-buffer")
+	influxURL           = flag.String("influx-url", "", "InfluxDB url samples are written to, ex: http://localhost:8086, empty means disabled")
+	influxVersion       = flag.String("influx-version", sink.InfluxV2, "InfluxDB write API version: 1 or 2")
+	influxDatabase      = flag.String("influx-database", "", "InfluxDB database, write API v1")
+	influxRP            = flag.String("influx-retention-policy", "", "InfluxDB retention policy, write API v1")
+	influxUser          = flag.String("influx-user", "", "InfluxDB username, write API v1")
+	influxPassword      = flag.String("influx-password", "", "InfluxDB password, write API v1")
+	influxToken         = flag.String("influx-token", "", "InfluxDB API token, write API v2")
+	influxOrg           = flag.String("influx-org", "", "InfluxDB organization, write API v2")
+	influxBucket        = flag.String("influx-bucket", "", "InfluxDB bucket, write API v2")
+	influxPrecision     = flag.String("influx-precision", "s", "InfluxDB timestamp precision: ns, us, ms or s")
+	influxBatch         = flag.Int("influx-batch", 5000, "Max lines per InfluxDB request")
+	influxRetries       = flag.Int("influx-retries", -1, "Max retries of a failed InfluxDB request, -1 means -sink-retries")
+	influxBuffer        = flag.Int("influx-buffer", -1, "Max batches buffered for InfluxDB, -1 means -sink-buffer")
+	graphiteAddress     = flag.String("graphite-address", "", "Graphite plaintext listener samples are written to, ex: localhost:2003, empty means disabled")
+	graphitePrefix      = flag.String("graphite-prefix", "sugar", "Graphite path prefix")
+	graphiteTagged      = flag.Bool("graphite-tagged", false, "Write Graphite tagged series instead of hierarchical paths")
+	graphiteBatch       = flag.Int("graphite-batch", 5000, "Max lines per Graphite write")
+	graphiteRetries     = flag.Int("graphite-retries", -1, "Max retries of a failed Graphite write, -1 means -sink-retries")
+	graphiteBuffer      = flag.Int("graphite-buffer", -1, "Max batches buffered for Graphite, -1 means -sink-buffer")
+	fileOutputDir       = flag.String("file-output-dir", "", "Directory samples and task results are written to, empty means disabled")
+	fileOutputContent   = flag.String("file-output-content", "samples,results", "What is written to files: samples, results or both, comma separated")
+	fileOutputFormat    = flag.String("file-output-format", sink.FormatJSONL, "File format: jsonl or csv")
+	fileOutputCompress  = flag.String("file-output-compress", sink.CompressNone, "File compression: none, gzip or zstd")
+	fileOutputMaxBytes  = flag.Int64("file-output-max-bytes", 100*1024*1024, "Start a new file after this many uncompressed bytes, 0 means never")
+	fileOutputMaxAge    = flag.Duration("file-output-max-age", 24*time.Hour, "Start a new file when the current one is older, 0 means never")
+	fileOutputRetention = flag.Duration("file-output-retention", 7*24*time.Hour, "Delete files older than this, 0 means keep them")
+	fileOutputMaxFiles  = flag.Int("file-output-max-files", 0, "Keep at most this many files of samples and of results, 0 means unlimited")
+	fileOutputBuffer    = flag.Int("file-output-buffer", -1, "Max batches buffered for the file output, -1 means -sink-buffer")
+	serverRetries       = flag.Int("server-retries", -1, "Max retries of reporting a task result to sugar-server, -1 means -sink-retries")
+	sinkBuffer          = flag.Int("sink-buffer", 100, "Default max batches buffered per sink, the oldest batch is dropped when the buffer is full")
+	sinkRetries         = flag.Int("sink-retries", 5, "Default max retries of a failed sink request")
+	sampleInterval      = flag.Duration("sample-interval", 0, "Interval of background samples written to the sinks, 0 means only perf task results are written")
+	metricsListen       = flag.String("metrics-listen", "", "Address the Prometheus /metrics endpoint listens on, ex: :9100, empty means disabled")
+	metricsBuffer       = flag.Int("metrics-buffer", -1, "Max batches buffered for the Prometheus exporter, -1 means -sink-buffer")
+
+	verifier    *auth.Verifier
+	labelsMu    sync.RWMutex
+	agentLabels labels.Labels // guarded by labelsMu, they change on config reload
+	journal     *task.Journal
+	limiter     *task.Limiter
+	queueName   string
+)
 
 // doWork do the work
+// ch: MQ channel
 // messages: message channel
 // return: none
-func doWork(messages <-chan amqp.Delivery) {
+func doWork(ch *amqp.Channel, messages <-chan amqp.Delivery) {
 	for d := range messages {
-		log.Printf("[x] Received a message [x] -> %s", d.Body)
-		// Unmarshal msg data
-		msg := make(map[string]interface{})
-		err := json.Unmarshal(d.Body, &msg)
-		utils.LogOnError(err, "Failed to unmarshal message")
-		deviceId := msg["metadata"].(map[string]interface{})["device_id"].(string)
-		if deviceId != deviceGlobalId {
-			log.Printf("[x] Device id not match [x] -> deviceId from message: %s, my deviceId: %s", deviceId, deviceGlobalId)
+		handleDelivery(ch, d)
+	}
+}
+
+// processMessage handles one task message, it may panic on a malformed message
+// ch: MQ channel
+// d: message
+// return: none
+func processMessage(ch *amqp.Channel, d amqp.Delivery) {
+	log.Printf("[x] Received a message [x] -> %s", d.Body)
+	err := verifyMessage(d)
+	if err != nil {
+		log.Printf("[x] Message verification failed [x] -> %s", err)
+		err = d.Reject(false)
+		utils.FailOnError(err, "Failed to reject message")
+		return
+	}
+	// Unmarshal msg data
+	msg := make(map[string]interface{})
+	err = json.Unmarshal(d.Body, &msg)
+	utils.FailOnError(err, "Failed to unmarshal message")
+	if ok, reason := isMyTask(taskRoutingKey(d), msg["metadata"].(map[string]interface{})); !ok {
+		log.Printf("[x] Task not for me [x] -> %s", reason)
+		err = d.Ack(false)
+		utils.FailOnError(err, "Failed to ack message")
+		log.Printf("Nothing to do, ack message and continue")
+	} else {
+		metadata := msg["metadata"].(map[string]interface{})
+		taskUUID := metadata["task_uuid"].(string)
+		if *resultTransport == transportHTTP {
+			baseUrl := metadata["base_url"].(string)
+			err = verifier.CheckBaseURL(baseUrl)
+			if err != nil {
+				log.Printf("[x] Refuse task %s [x] -> %s: %s", taskUUID, err, baseUrl)
+				err = d.Reject(false)
+				utils.FailOnError(err, "Failed to reject message")
+				return
+			}
+		}
+		if journal.IsDone(taskUUID) {
+			log.Printf("[x] Task %s already done [x] -> redelivered: %t, ack message and continue", taskUUID, d.Redelivered)
 			err = d.Ack(false)
 			utils.FailOnError(err, "Failed to ack message")
-			log.Printf("Nothing to do, ack message and continue")
-		} else {
-			baseUrl := msg["metadata"].(map[string]interface{})["base_url"].(string)
-			taskUUID := msg["metadata"].(map[string]interface{})["task_uuid"].(string)
-
-			// Login to get token
-			loginData := map[string]interface{}{
-				"username": msg["metadata"].(map[string]interface{})["username"],
-				"password": msg["metadata"].(map[string]interface{})["password"],
-			}
-			token, err := utils.UserLogin(baseUrl, loginData)
-			utils.LogOnError(err, "Failed to login")
+			return
+		}
+		if d.Redelivered {
+			log.Printf("[x] Task %s is redelivered [x] -> last state: %q, run it again", taskUUID, journal.State(taskUUID))
+		}
+		// a task type without a free slot goes back to the queue, so the worker and the prefetch stay
+		// available for the other task types
+		taskType := int(msg["task_type"].(float64))
+		if !limiter.TryAcquire(taskType) {
+			log.Printf("[x] No free slot of task type %d for task %s [x] -> put it back to the queue in %s", taskType, taskUUID, deferDelay)
+			deferMessage(ch, d)
+			return
+		}
+		defer limiter.Release(taskType)
+		defer trackTask(taskUUID, taskType)()
 
-			// update task status to RECEIVED
-			updateData := map[string]interface{}{
-				"task_status": 1, //RECEIVED
-			}
-			err = utils.UpdateTaskStatus(baseUrl, updateData, taskUUID, token)
-			utils.LogOnError(err, "Failed to update task status")
+		// check where the results go before running the task, it would be retried and run again otherwise
+		rep, err := newReporter(d, metadata, taskUUID)
+		if err != nil {
+			log.Printf("[x] Refuse task %s [x] -> %s", taskUUID, err)
+			err = d.Reject(false)
+			utils.FailOnError(err, "Failed to reject message")
+			return
+		}
+		if journal.State(taskUUID) == task.StateReporting {
+			// the task ran, only its result was not confirmed, ex: the message was requeued by finishTask
+			log.Printf("[x] Task %s already ran [x] -> report its result again", taskUUID)
+			r, again := unreportedResult(taskUUID, taskType, rep)
+			finishTask(d, r, again)
+			return
+		}
+		err = journal.Mark(taskUUID, task.StateStarted)
+		utils.LogOnError(err, "Failed to save task journal")
 
-			log.Printf("[x] Start task [x]")
+		// update task status to RECEIVED
+		updateData := map[string]interface{}{
+			"task_status": statusReceived,
+		}
+		err = rep.UpdateTaskStatus(updateData)
+		utils.LogOnError(err, "Failed to update task status")
 
-			// update task status to STARTED
-			updateData = map[string]interface{}{
-				"task_status": 2, //STARTED
-			}
-			err = utils.UpdateTaskStatus(baseUrl, updateData, taskUUID, token)
-			utils.LogOnError(err, "Failed to update task status")
-
-			bT := time.Now()
-			// 任务状态
-			taskStatus := 3 //SUCCESS
-			resultDesc := "everything is ok"
-			// 任务执行结果状态，true为成功，false为失败
-			resultStatus := true
-			data, err := task.StartTask(d.Body)
-			if err != nil {
-				taskStatus = 4 //FAILURE
-				resultDesc = err.Error()
-				resultStatus = false
-			}
-			log.Printf("[x] Task is done [x]")
-			log.Printf("[x] Total use time: %f s [x]", time.Since(bT).Seconds())
-
-			// update task status to SUCCESS or FAILURE
-			result := map[string]interface{}{
-				"status": resultStatus,
-				"data":   data,
-				"msg":    resultDesc,
-			}
-			updateData = map[string]interface{}{
-				"task_status": taskStatus,
-				"result":      result,
-			}
-			err = utils.UpdateTaskStatus(baseUrl, updateData, taskUUID, token)
-			utils.LogOnError(err, "Failed to update task status")
+		log.Printf("[x] Start task %s [x]", taskUUID)
 
-			err = d.Ack(false)
-			utils.FailOnError(err, "Failed to ack message")
+		// update task status to STARTED
+		updateData = map[string]interface{}{
+			"task_status": statusStarted,
+		}
+		err = rep.UpdateTaskStatus(updateData)
+		utils.LogOnError(err, "Failed to update task status")
+
+		bT := time.Now()
+		resultDesc := "everything is ok"
+		// 任务执行结果状态，true为成功，false为失败
+		resultStatus := true
+		ctx := context.Background()
+		if u, ok := rep.(task.Uploader); ok {
+			ctx = task.WithUploader(ctx, u)
 		}
+		data, err := task.StartTask(ctx, d.Body)
+		if err != nil {
+			resultDesc = err.Error()
+			resultStatus = false
+		}
+		if perfData, ok := data.(*internal.PerfData); ok {
+			outputs.Write(sink.FromPerfData(perfData))
+		}
+		log.Printf("[x] Task %s is done [x]", taskUUID)
+		log.Printf("[x] Total use time: %f s [x]", time.Since(bT).Seconds())
+
+		finishTask(d, sink.Result{
+			TaskUUID: taskUUID,
+			TaskType: taskType,
+			Success:  resultStatus,
+			Message:  resultDesc,
+			Data:     data,
+			Time:     time.Now(),
+			Reporter: rep,
+		}, false)
 	}
 }
 
-// startConsuming connect to MQ server
-// user: MQ username
-// password: MQ user password
-// host: MQ server host
-// port: MQ server port
-// exchangeName: MQ exchange name
+// unreported results of tasks which ran but whose result was not confirmed, by task uuid
+var (
+	unreportedMu sync.Mutex
+	unreported   = make(map[string]sink.Result)
+)
+
+// finishTask reports the result of a task which ran and acks its message,
+// in amqp transport mode the message is acked only after the broker confirmed the result, otherwise it is requeued
+// and its redelivery reports the result again without running the task
+// d: task message
+// r: result
+// again: the result was reported to the other sinks before, only the server is waited for
 // return: none
-func startConsuming() {
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%s/", *user, *password, *host, *port))
-	utils.FailOnError(err, "Failed to connect to RabbitMQ")
+func finishTask(d amqp.Delivery, r sink.Result, again bool) {
+	err := journal.Mark(r.TaskUUID, task.StateReporting)
+	utils.LogOnError(err, "Failed to save task journal")
+	// update task status to SUCCESS or FAILURE through the server sink, the other result sinks get it too
+	if again {
+		err = outputs.ReportSync(r)
+	} else {
+		err = outputs.Report(r)
+	}
+	if err != nil && *resultTransport == transportAMQP {
+		log.Printf("[x] Failed to publish result of task %s [x] -> %s, requeue the message to report it again", r.TaskUUID, err)
+		unreportedMu.Lock()
+		unreported[r.TaskUUID] = r
+		unreportedMu.Unlock()
+		// the redelivered message passes the replay check once more
+		verifier.Retrying(d.Headers)
+		err = d.Nack(false, true)
+		utils.LogOnError(err, "Failed to requeue message")
+		return
+	}
+	utils.LogOnError(err, "Failed to update task status")
+	unreportedMu.Lock()
+	delete(unreported, r.TaskUUID)
+	unreportedMu.Unlock()
+	err = journal.Mark(r.TaskUUID, task.StateDone)
+	utils.LogOnError(err, "Failed to save task journal")
+
+	err = d.Ack(false)
+	utils.FailOnError(err, "Failed to ack message")
+}
+
+// unreportedResult returns the result of a task which ran but whose result was not confirmed, a failure when the
+// result was lost by a restart of the agent, the task is not run again as it may not be idempotent
+// taskUUID: task uuid
+// taskType: task type
+// rep: reporter of the redelivered message
+// return: Result, whether the other sinks got it already
+func unreportedResult(taskUUID string, taskType int, rep reporter) (sink.Result, bool) {
+	unreportedMu.Lock()
+	defer unreportedMu.Unlock()
+	if r, ok := unreported[taskUUID]; ok {
+		r.Reporter = rep
+		return r, true
+	}
+	return sink.Result{
+		TaskUUID: taskUUID,
+		TaskType: taskType,
+		Success:  false,
+		Message:  "the task ran but its result was lost by a restart of the agent",
+		Time:     time.Now(),
+		Reporter: rep,
+	}, false
+}
+
+// isMyTask checks whether the task targets this device
+// a task targets this device when its device_id (if set) equals mine and its selector (if set) matches my labels,
+// at least one of them must be set unless the task was routed by a key the queue is bound with (direct/topic exchange),
+// ex: a broadcast to all or group.<name> needs neither
+// routingKey: routing key the task was published with
+// metadata: task metadata
+// return: matched, reason when not matched
+func isMyTask(routingKey string, metadata map[string]interface{}) (bool, string) {
+	deviceId, _ := metadata["device_id"].(string)
+	selector, _ := metadata["selector"].(string)
+	if deviceId == "" && selector == "" && !routedToMe(routingKey) {
+		return false, fmt.Sprintf("neither device_id nor selector is set, routing key: %q", routingKey)
+	}
+	if deviceId != "" && deviceId != deviceGlobalId {
+		return false, fmt.Sprintf("deviceId from message: %s, my deviceId: %s", deviceId, deviceGlobalId)
+	}
+	if selector != "" {
+		sel, err := labels.ParseSelector(selector)
+		if err != nil {
+			return false, err.Error()
+		}
+		if l := currentLabels(); !sel.Matches(l) {
+			return false, fmt.Sprintf("selector %q not match my labels %q", selector, l)
+		}
+	}
+	return true, ""
+}
+
+// routedToMe returns whether a routing key alone targets this device: device.<id>, group.<name> of my groups or all,
+// a fanout exchange delivers every task to every device whatever the key
+// routingKey: routing key the task was published with
+// return: bool
+func routedToMe(routingKey string) bool {
+	if *exchangeType == "fanout" {
+		return false
+	}
+	for _, key := range bindingKeys() {
+		if key == routingKey {
+			return true
+		}
+	}
+	return false
+}
+
+// registerCommandTask registers the command task type with the allowlist from flags
+// checkOnly: only check the options, so the work dir is not created
+// return: error
+func registerCommandTask(checkOnly bool) error {
+	allowlist, err := task.LoadAllowlist(*commandAllowlist)
+	if err != nil {
+		return fmt.Errorf("load command allowlist failed: %w", err)
+	}
+	handler, err := task.NewCommandHandler(task.CommandOptions{
+		Allowlist:  allowlist,
+		User:       *commandUser,
+		AllowRoot:  *commandAllowRoot,
+		WorkDir:    *commandWorkDir,
+		MaxOutput:  *commandMaxOutput,
+		MaxTimeout: *commandMaxTimeout,
+		CheckOnly:  checkOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("create command task handler failed: %w", err)
+	}
+	task.Register(task.TaskTypeCommand, handler)
+	return nil
+}
+
+// registerCollectors registers the additional collectors configured by flags, replacing the registered ones
+// return: error
+func registerCollectors() error {
+	factories, err := collectorFactories()
+	if err != nil {
+		return err
+	}
+	internal.ReplaceCollectors(factories)
+	return nil
+}
+
+// collectorFactories loads the files of the additional collectors configured by flags
+// return: collector name -> factory, error
+func collectorFactories() (map[string]internal.CollectorFactory, error) {
+	factories := make(map[string]internal.CollectorFactory)
+	if *logPatterns != "" {
+		patterns, err := internal.LoadLogPatterns(*logPatterns)
+		if err != nil {
+			return nil, fmt.Errorf("load log patterns failed: %w", err)
+		}
+		factories["log_patterns"] = internal.NewLogPatternFactory(patterns)
+	}
+	if *httpProbes != "" {
+		probes, err := internal.LoadHTTPProbes(*httpProbes)
+		if err != nil {
+			return nil, fmt.Errorf("load http probes failed: %w", err)
+		}
+		factories["http_probes"] = internal.NewHTTPProbeFactory(probes, *probeTimeout)
+	}
+	if *tcpProbes != "" {
+		probes, err := internal.LoadTCPProbes(*tcpProbes)
+		if err != nil {
+			return nil, fmt.Errorf("load tcp probes failed: %w", err)
+		}
+		factories["tcp_probes"] = internal.NewTCPProbeFactory(probes, *probeTimeout)
+	}
+	if *dnsProbes != "" {
+		probes, err := internal.LoadDNSProbes(*dnsProbes)
+		if err != nil {
+			return nil, fmt.Errorf("load dns probes failed: %w", err)
+		}
+		factories["dns_probes"] = internal.NewDNSProbeFactory(probes, *dnsResolver, *probeTimeout)
+	}
+	if *scrapeTargets != "" {
+		targets, err := internal.LoadScrapeTargets(*scrapeTargets)
+		if err != nil {
+			return nil, fmt.Errorf("load scrape targets failed: %w", err)
+		}
+		factories["scrape"] = internal.NewScrapeFactory(targets, *probeTimeout)
+	}
+	return factories, nil
+}
+
+// bindingKeys returns the routing keys the queue is bound with
+// fanout exchange ignores routing keys, so the queue is bound once with an empty key;
+// direct/topic exchange binds device.<id>, group.<name> for every group and all
+// return: routing keys
+func bindingKeys() []string {
+	if *exchangeType == "fanout" {
+		return []string{""}
+	}
+	keys := []string{"device." + deviceGlobalId}
+	for _, g := range utils.SplitList(*groups) {
+		keys = append(keys, "group."+g)
+	}
+	return append(keys, "all")
+}
+
+// queueArgs returns the optional arguments of the queue
+// return: amqp.Table
+func queueArgs() amqp.Table {
+	args := amqp.Table{}
+	// classic is the default type, leave it out to stay compatible with queues declared before
+	if *queueType != "classic" {
+		args["x-queue-type"] = *queueType
+	}
+	if *queueMessageTTL > 0 {
+		args["x-message-ttl"] = queueMessageTTL.Milliseconds()
+	}
+	if *queueMaxLength > 0 {
+		args["x-max-length"] = int64(*queueMaxLength)
+	}
+	if *deadLetterExch != "" {
+		args["x-dead-letter-exchange"] = *deadLetterExch
+	}
+	return args
+}
+
+// checkFlags checks the combination of flags
+// return: error
+func checkFlags() error {
+	if *exchangeType != "fanout" && *exchangeType != "direct" && *exchangeType != "topic" {
+		return fmt.Errorf("unknown exchange type: %s", *exchangeType)
+	}
+	switch *queueType {
+	case "classic":
+	case "quorum":
+		// quorum queues are always durable and can not be exclusive or auto-deleted
+		if !*queueDurable || *queueExclusive || *queueAutoDelete {
+			return fmt.Errorf("quorum queue must be durable, non-exclusive and non-auto-delete")
+		}
+	default:
+		return fmt.Errorf("unknown queue type: %s", *queueType)
+	}
+	if *resultTransport != transportHTTP && *resultTransport != transportAMQP {
+		return fmt.Errorf("unknown result transport: %s", *resultTransport)
+	}
+	if *resultTransport == transportAMQP && *resultsExchange == "" {
+		// results of tasks without ReplyTo could not be published, the task would run again on every retry
+		return fmt.Errorf("-results-exchange is required with amqp result transport")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if *presenceExch != "" && *heartbeatInterval <= 0 {
+		return fmt.Errorf("heartbeat interval must be positive")
+	}
+	if *maxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	if *queueMaxLength < 0 || *queueMessageTTL < 0 {
+		return fmt.Errorf("queue max length and message ttl must not be negative")
+	}
+	if *sampleInterval < 0 || *sinkRetries < 0 {
+		return fmt.Errorf("sample interval and sink retries must not be negative")
+	}
+	if *sinkBuffer < 1 {
+		return fmt.Errorf("sink buffer must be at least 1")
+	}
+	for name, n := range map[string]int{"otlp-retries": *otlpRetries, "influx-retries": *influxRetries, "graphite-retries": *graphiteRetries, "server-retries": *serverRetries} {
+		if n < -1 {
+			return fmt.Errorf("-%s must be -1 or at least 0", name)
+		}
+	}
+	for name, n := range map[string]int{"otlp-buffer": *otlpBuffer, "influx-buffer": *influxBuffer, "graphite-buffer": *graphiteBuffer, "file-output-buffer": *fileOutputBuffer, "metrics-buffer": *metricsBuffer} {
+		if n < 1 && n != -1 {
+			return fmt.Errorf("-%s must be -1 or at least 1", name)
+		}
+	}
+	if !*tlsEnabled && (*tlsCAFile != "" || *tlsCertFile != "" || *tlsKeyFile != "" || *tlsServerName != "" || *tlsSkipVerify) {
+		return fmt.Errorf("tls options are set but tls is not enabled")
+	}
+	if *tlsEnabled {
+		_, err := tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumerTag tag of the task consumer, used to cancel it before reconnecting
+const consumerTag = "sugar-agent"
+
+// startConsuming consumes tasks until SIGINT/SIGTERM, SIGHUP reloads the config file, so does a change of the
+// config file when -config-watch-interval is set; changed connection parameters are applied by reconnecting
+// return: error when connecting to MQ server failed
+func startConsuming() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	changes := make(chan struct{}, 1)
+	if *configWatchInterval > 0 {
+		go watchConfigFile(configFile, *configWatchInterval, changes)
+	}
+	// connection parameters before the last reload, restored when the new ones do not work
+	var previous map[string]string
+	for {
+		pending, err := consume(signals, changes)
+		if err != nil && previous != nil {
+			log.Printf("[error] Failed to consume with the reloaded connection parameters: %s [error] -> restore the previous ones", err)
+			applySettings(previous)
+			previous = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pending == nil {
+			outputs.Close(sinkDrainTimeout)
+			return nil
+		}
+		previous = applySettings(pending)
+		err = checkFlags()
+		if err != nil {
+			log.Printf("[error] Config reload rejected: %s [error] -> reconnect with the previous connection parameters", err)
+			applySettings(previous)
+			previous = nil
+		}
+	}
+}
+
+// consume connects to MQ server and consumes tasks until SIGINT/SIGTERM, or until a reload changes connection parameters
+// signals: SIGINT, SIGTERM and SIGHUP
+// changes: the config file changed
+// return: changed connection parameters, nil on SIGINT/SIGTERM; error when connecting to MQ server failed
+func consume(signals <-chan os.Signal, changes <-chan struct{}) (map[string]string, error) {
+	conn, err := dialAMQP()
+	if err != nil {
+		return nil, err
+	}
 	defer func(conn *amqp.Connection) {
 		err := conn.Close()
-		utils.FailOnError(err, "Failed to close connection")
+		utils.LogOnError(err, "Failed to close connection")
 	}(conn)
 
 	ch, err := conn.Channel()
-	utils.FailOnError(err, "Failed to open a channel")
+	if err != nil {
+		return nil, fmt.Errorf("open a channel failed: %w", err)
+	}
 	defer func(ch *amqp.Channel) {
 		err := ch.Close()
-		utils.FailOnError(err, "Failed to close channel")
+		utils.LogOnError(err, "Failed to close channel")
 	}(ch)
 
 	err = ch.ExchangeDeclare(
 		*exchangeName, // name
-		"fanout",      // type
+		*exchangeType, // type
 		true,          // durable
 		false,         // auto-deleted
 		false,         // internal
 		false,         // no-wait
 		nil,           // arguments
 	)
-	utils.FailOnError(err, "Failed to declare an exchange")
+	if err != nil {
+		return nil, fmt.Errorf("declare an exchange failed: %w", err)
+	}
 
 	q, err := ch.QueueDeclare(
 		fmt.Sprintf("collect_device_%s_perf_data_queue", deviceGlobalId), // name
-		false, // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
+		*queueDurable,    // durable
+		*queueAutoDelete, // delete when unused
+		*queueExclusive,  // exclusive
+		false,            // no-wait
+		queueArgs(),      // arguments
 	)
-	utils.FailOnError(err, "Failed to declare a queue")
+	if err != nil {
+		return nil, fmt.Errorf("declare a queue failed: %w", err)
+	}
+	queueName = q.Name
 
-	// set prefetchCount to 1: only one message will be sent to a worker at a time
+	if *deadLetterExch != "" {
+		err = checkExchangeExists(conn, *deadLetterExch, "dead letter exchange does not exist")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *presenceExch != "" {
+		err = checkExchangeExists(conn, *presenceExch, "presence exchange does not exist")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *resultTransport == transportAMQP {
+		err = openResultChannel(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// set prefetchCount to workers: each worker handles one message at a time
 	// set prefetchSize to 0: no effect
 	// set global to false: the QoS settings apply to the current channel only
-	err = ch.Qos(1, 0, false)
-	utils.FailOnError(err, "Failed to set QoS")
-
-	log.Printf("Binding queue %s to exchange %s", q.Name, *exchangeName)
-	err = ch.QueueBind(
-		q.Name,        // queue name
-		"",            // routing key
-		*exchangeName, // exchange
-		false,
-		nil)
-	utils.FailOnError(err, "Failed to bind a queue")
+	err = ch.Qos(*workers, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("set QoS failed: %w", err)
+	}
+
+	keys := bindingKeys()
+	for _, key := range keys {
+		log.Printf("Binding queue %s to exchange %s with routing key %q", q.Name, *exchangeName, key)
+		err = ch.QueueBind(
+			q.Name,        // queue name
+			key,           // routing key
+			*exchangeName, // exchange
+			false,
+			nil)
+		if err != nil {
+			return nil, fmt.Errorf("bind a queue failed: %w", err)
+		}
+	}
+	unbindStale(conn, q.Name, keys)
+
+	// before consuming, a failure reconnects without interrupting tasks
+	if *presenceExch != "" {
+		err = startPresence(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	messages, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto ack
-		false,  // exclusive
-		false,  // no local
-		false,  // no wait
-		nil,    // args
+		q.Name,      // queue
+		consumerTag, // consumer
+		false,       // auto ack
+		false,       // exclusive
+		false,       // no local
+		false,       // no wait
+		nil,         // args
 	)
-	utils.FailOnError(err, "Failed to register a consumer")
+	if err != nil {
+		stopPresence("register a consumer failed")
+		return nil, fmt.Errorf("register a consumer failed: %w", err)
+	}
 
-	var forever chan struct{}
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doWork(ch, messages)
+		}()
+	}
+
+	for _, t := range task.Supported() {
+		log.Printf("Supported task type %d: %s v%s", t.Type, t.Name, t.Version)
+	}
 
-	go doWork(messages)
+	log.Printf("[******] Started consumer with %d workers [******] -> Waiting for messages. To exit press CTRL+C", *workers)
+	for {
+		reason, stop := nextReload(signals, changes, nil)
+		if stop {
+			return nil, nil
+		}
+		pending := reloadConfig(reason)
+		if len(pending) == 0 {
+			continue
+		}
+		// the prefetched tasks are still delivered to the workers, the channel is closed once they are done
+		log.Printf("[******] Connection parameters changed [******] -> Reconnect after %d running tasks finished", len(currentTasks()))
+		err = ch.Cancel(consumerTag, false)
+		utils.LogOnError(err, "Failed to cancel consumer")
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			// deferred tasks are published on the channel too, the broker would redeliver their originals
+			pendingDefers.Wait()
+			close(done)
+		}()
+		// the running tasks may take hours, keep handling signals and reloads meanwhile
+		for {
+			reason, stop := nextReload(signals, changes, done)
+			if stop {
+				return nil, nil
+			}
+			if reason == "" {
+				stopPresence("reconnecting to apply new connection parameters")
+				return pending, nil
+			}
+			for k, v := range reloadConfig(reason) {
+				pending[k] = v
+			}
+		}
+	}
+}
 
-	log.Printf("[******] Started consumer [******] -> Waiting for messages. To exit press CTRL+C")
-	<-forever
+// nextReload waits for a reload of the config, a stop signal or done
+// signals: received signals, SIGHUP reloads the config and any other signal stops the agent
+// changes: changes of the config file
+// done: closed when the caller stops waiting, nil to wait for a reload or a stop signal only
+// return: reason of the reload, empty when done is closed; whether the agent goes offline
+func nextReload(signals <-chan os.Signal, changes <-chan struct{}, done <-chan struct{}) (string, bool) {
+	select {
+	case s := <-signals:
+		if s != syscall.SIGHUP {
+			log.Printf("[******] Received signal %s [******] -> Going offline, unacked tasks are requeued by the broker", s)
+			stopPresence("received signal " + s.String())
+			return "", true
+		}
+		return "received signal " + s.String(), false
+	case <-changes:
+		return "config file changed", false
+	case <-done:
+		return "", false
+	}
 }
 
-func main() {
-	// Usage: go run main.go guest guest localhost 5672 device_exchange collect_device_perf_data_queue device_perf_data
-	if strings.TrimSpace(*user) != "" && strings.TrimSpace(*password) != "" && strings.TrimSpace(*host) != "" && strings.TrimSpace(*port) != "" && strings.TrimSpace(*exchangeName) != "" && strings.TrimSpace(*deviceId) != "" {
-		deviceGlobalId = *deviceId
-		startConsuming()
-	} else {
+// binding exchange and routing keys the queue was bound with by the previous connection
+var boundExchange, boundKeys = "", []string(nil)
+
+// unbindStale removes the bindings of the previous connection that a reload dropped, ex: a removed group,
+// so the durable queue no longer receives their tasks
+// conn: MQ connection
+// queue: queue name
+// keys: routing keys the queue is bound with now
+// return: none
+func unbindStale(conn *amqp.Connection, queue string, keys []string) {
+	current := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		current[key] = true
+	}
+	var stale []string
+	for _, key := range boundKeys {
+		if boundExchange != *exchangeName || !current[key] {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) > 0 {
+		// a separate channel, unbinding from an exchange that was deleted meanwhile closes it
+		ch, err := conn.Channel()
+		utils.LogOnError(err, "Failed to open a channel")
+		for _, key := range stale {
+			if err != nil {
+				break
+			}
+			log.Printf("Unbinding queue %s from exchange %s with routing key %q", queue, boundExchange, key)
+			err = ch.QueueUnbind(queue, key, boundExchange, nil)
+			utils.LogOnError(err, "Failed to unbind a queue")
+		}
+		if err == nil {
+			_ = ch.Close()
+		}
+	}
+	boundExchange, boundKeys = *exchangeName, keys
+}
+
+// amqpURL returns the url of MQ server from flags, user and password are escaped
+func amqpURL() string {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(*user, *password),
+		Host:   net.JoinHostPort(*host, *port),
+		Path:   "/",
+	}
+	if *tlsEnabled {
+		u.Scheme = "amqps"
+	}
+	return u.String()
+}
+
+// dialAMQP connects to MQ server, over TLS when -tls is set
+// return: connection, error
+func dialAMQP() (*amqp.Connection, error) {
+	if !*tlsEnabled {
+		return amqp.Dial(amqpURL())
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return amqp.DialTLS(amqpURL(), cfg)
+}
+
+// tlsConfig returns the TLS config of the MQ connection from flags
+// return: tls.Config, error
+func tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         *tlsServerName,
+		InsecureSkipVerify: *tlsSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = *host
+	}
+	if *tlsCAFile != "" {
+		pem, err := os.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca file failed: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls ca file %s", *tlsCAFile)
+		}
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, fmt.Errorf("tls cert file and tls key file must be set together")
+	}
+	if *tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client certificate failed: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// missingFlags returns the names of the required flags that are not set
+// names: flag names
+// return: missing flag names
+func missingFlags(names ...string) []string {
+	var missing []string
+	for _, name := range names {
+		if strings.TrimSpace(flag.Lookup(name).Value.String()) == "" {
+			missing = append(missing, "-"+name)
+		}
+	}
+	return missing
+}
+
+// currentLabels returns the device labels
+func currentLabels() labels.Labels {
+	labelsMu.RLock()
+	defer labelsMu.RUnlock()
+	return agentLabels
+}
+
+// setLabels replaces the device labels
+func setLabels(l labels.Labels) {
+	labelsMu.Lock()
+	agentLabels = l
+	labelsMu.Unlock()
+}
+
+// requiredFlags flags the run command can not do without
+var requiredFlags = []string{"user", "password", "host", "port", "exchange-name", "device-id"}
+
+// setupAgent checks the flags and registers the task types and collectors they configure
+// checkOnly: only check the options of the command task, so nothing is written to the file system
+// return: error
+func setupAgent(checkOnly bool) error {
+	deviceGlobalId = *deviceId
+	err := checkFlags()
+	if err != nil {
+		return err
+	}
+	if *commandAllowlist != "" {
+		err = registerCommandTask(checkOnly)
+		if err != nil {
+			return err
+		}
+	}
+	if *logAllowlist != "" {
+		handler, err := task.NewLogCollectHandler(task.LogCollectOptions{
+			Allowlist: utils.SplitList(*logAllowlist),
+			MaxBytes:  *logMaxBytes,
+		})
+		if err != nil {
+			return fmt.Errorf("create log collection task handler failed: %w", err)
+		}
+		task.Register(task.TaskTypeLogCollect, handler)
+	}
+	err = registerCollectors()
+	if err != nil {
+		return err
+	}
+	limits, err := task.ParseLimits(*taskTypeLimits)
+	if err != nil {
+		return fmt.Errorf("parse task type limits failed: %w", err)
+	}
+	limiter = task.NewLimiter(limits)
+	l, err := labels.Parse(*deviceLabels)
+	if err != nil {
+		return fmt.Errorf("parse labels failed: %w", err)
+	}
+	setLabels(l)
+	verifier, err = auth.NewVerifier(*verifyMode, *verifyKeyFile, *verifyMaxAge, utils.SplitList(*allowedHosts))
+	if err != nil {
+		return fmt.Errorf("create message verifier failed: %w", err)
+	}
+	return nil
+}
+
+// runCmd consumes tasks from MQ server and executes them until SIGINT/SIGTERM
+func runCmd(fs *flag.FlagSet, args []string) int {
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		// flags before the command name, ex: sugar-agent -http-probes probes.txt collect
+		cmd, ok := lookupCommand(fs.Arg(0))
+		if !ok {
+			log.Printf("[error] Unknown command %q", fs.Arg(0))
+			printUsage()
+			return exitUsage
+		}
+		return cmd.run(newFlagSet(cmd.name), fs.Args()[1:])
+	}
+	if len(missingFlags(requiredFlags...)) > 0 {
 		utils.ShowTips()
 	}
+	err := setupAgent(false)
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig
+	}
+	journal, err = task.OpenJournal(*journalFile)
+	if err != nil {
+		log.Printf("[error] Failed to open task journal: %s", err)
+		return exitConfig
+	}
+	// the exporter is one of the sinks
+	if *metricsListen != "" {
+		err = startMetricsExporter(*metricsListen)
+		if err != nil {
+			log.Printf("[error] Failed to start metrics exporter: %s", err)
+			return exitConfig
+		}
+	}
+	err = openSinks()
+	if err != nil {
+		log.Printf("[error] Failed to open output sinks: %s", err)
+		return exitConfig
+	}
+	if *sampleInterval > 0 && outputs.SampleSinks() > 0 {
+		err = startSampling(*sampleInterval)
+		if err != nil {
+			log.Printf("[error] Failed to start background sampling: %s", err)
+			return exitConfig
+		}
+	}
+	err = startConsuming()
+	if err != nil {
+		log.Printf("[error] Failed to connect to RabbitMQ: %s", err)
+		return exitBroker
+	}
+	return exitOK
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"sugar-agent/pkg/labels"
+	"sugar-agent/pkg/sink"
+)
+
+// setFlag sets a flag for the duration of a test
+func setFlag(t *testing.T, p *string, val string) {
+	t.Helper()
+	old := *p
+	*p = val
+	t.Cleanup(func() { *p = old })
+}
+
+func TestIsMyTask(t *testing.T) {
+	deviceGlobalId = "6"
+	l, err := labels.Parse("env=prod,role=db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLabels(l)
+	setFlag(t, groups, "db,cache")
+	tests := []struct {
+		name         string
+		exchangeType string
+		routingKey   string
+		metadata     map[string]interface{}
+		want         bool
+	}{
+		{"device key", "direct", "device.6", map[string]interface{}{}, true},
+		{"group key", "direct", "group.db", map[string]interface{}{}, true},
+		{"group key of topic exchange", "topic", "group.cache", map[string]interface{}{}, true},
+		{"all key", "direct", "all", map[string]interface{}{}, true},
+		{"other device key", "direct", "device.7", map[string]interface{}{}, false},
+		{"unbound group key", "direct", "group.web", map[string]interface{}{}, false},
+		{"retried copy key", "direct", "collect_device_6_perf_data_queue", map[string]interface{}{}, false},
+		{"fanout without target", "fanout", "", map[string]interface{}{}, false},
+		{"fanout ignores key", "fanout", "all", map[string]interface{}{}, false},
+		{"fanout device id", "fanout", "", map[string]interface{}{"device_id": "6"}, true},
+		{"fanout other device id", "fanout", "", map[string]interface{}{"device_id": "7"}, false},
+		{"fanout selector", "fanout", "", map[string]interface{}{"selector": "role in (db,cache)"}, true},
+		{"all key other device id", "direct", "all", map[string]interface{}{"device_id": "7"}, false},
+		{"group key matching selector", "direct", "group.db", map[string]interface{}{"selector": "env=prod"}, true},
+		{"group key not matching selector", "direct", "group.db", map[string]interface{}{"selector": "env=dev"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, exchangeType, tt.exchangeType)
+			got, reason := isMyTask(tt.routingKey, tt.metadata)
+			if got != tt.want {
+				t.Fatalf("isMyTask(%q, %v) = %t (%s), want %t", tt.routingKey, tt.metadata, got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnreportedResult(t *testing.T) {
+	rep := &amqpReporter{correlationId: "1"}
+	// lost by a restart, reported as a failure instead of running the task again
+	r, again := unreportedResult("1", 3, rep)
+	if again || r.Success || r.TaskType != 3 || r.Reporter != rep {
+		t.Fatalf("unreportedResult() of an unknown task = %+v, %t", r, again)
+	}
+	unreportedMu.Lock()
+	unreported["1"] = sink.Result{TaskUUID: "1", TaskType: 3, Success: true, Data: "data"}
+	unreportedMu.Unlock()
+	t.Cleanup(func() {
+		unreportedMu.Lock()
+		delete(unreported, "1")
+		unreportedMu.Unlock()
+	})
+	r, again = unreportedResult("1", 3, rep)
+	if !again || !r.Success || r.Data != "data" || r.Reporter != rep {
+		t.Fatalf("unreportedResult() of a requeued task = %+v, %t", r, again)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/exporter"
+)
+
+// metricsExporter the Prometheus exporter, nil when -metrics-listen is not set
+var metricsExporter *exporter.Exporter
+
+// startMetricsExporter serves the collector metrics for Prometheus scraping in background
+// addr: listen address, ex: :9100
+// return: error
+func startMetricsExporter(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	collectors, err := internal.NewCollectors(internal.ExtraCollectors())
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	e := exporter.New(exporterLabels(), collectors, agentMetrics)
+	metricsExporter = e
+	go func() {
+		err := e.Serve(ln)
+		e.Close()
+		log.Printf("[x] Metrics exporter stopped [x] -> %s", err)
+	}()
+	return nil
+}
+
+// updateMetricsExporter applies reloaded labels and collectors to the exporter
+// return: error
+func updateMetricsExporter() error {
+	if metricsExporter == nil {
+		return nil
+	}
+	collectors, err := internal.NewCollectors(internal.ExtraCollectors())
+	if err != nil {
+		return err
+	}
+	metricsExporter.Update(exporterLabels(), collectors)
+	return nil
+}
+
+// exporterLabels returns the labels added to every exported series: device_id and the device labels
+func exporterLabels() map[string]string {
+	common := map[string]string{"device_id": deviceGlobalId}
+	for k, v := range currentLabels() {
+		common[k] = v
+	}
+	return common
+}
+
+// agentMetrics returns metrics of the agent itself
+// return: metrics
+func agentMetrics() []internal.Metric {
+	metrics := []internal.Metric{
+		{Name: "agent_uptime_seconds", Type: internal.MetricGauge, Unit: "seconds", Help: "Seconds since the agent started", Value: time.Since(agentStartedAt).Seconds()},
+		{Name: "agent_running_tasks", Type: internal.MetricGauge, Help: "Number of tasks currently being executed", Value: float64(len(currentTasks()))},
+		{Name: "agent_poisoned_messages_total", Type: internal.MetricCounter, Help: "Messages sent to the dead letter exchange or dropped after max attempts", Value: float64(poisonedCount())},
+	}
+	return append(metrics, sinkMetrics()...)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/pkg/auth"
+	"sugar-agent/pkg/utils"
+)
+
+// message headers used for retries and dead-lettering
+const (
+	headerAttempts = "x-sugar-attempts" // attempts already made, set on retried copies of a message
+	headerError    = "x-sugar-error"    // reason a message was dead-lettered
+	headerDeviceId = "x-sugar-device-id"
+	// routing key of the original message, retried copies are published to the queue through the default exchange
+	headerRoutingKey = "x-sugar-routing-key"
+	headerDeferred   = "x-sugar-deferred" // set on copies of tasks put back to the queue for a free slot of their type
+)
+
+// deferDelay how long a task waits before it is put back to the queue when its task type has no free slot
+const deferDelay = time.Second
+
+// poisonedMessages counts messages sent to the dead letter exchange (or dropped) after max attempts
+var poisonedMessages uint64
+
+// pendingDefers counts deferred tasks not put back to the queue yet, the channel is closed only after they are
+var pendingDefers sync.WaitGroup
+
+// poisonedCount returns the number of poisoned messages
+func poisonedCount() uint64 {
+	return atomic.LoadUint64(&poisonedMessages)
+}
+
+// handleDelivery handles one message, a panic is recovered and the message is retried or dead-lettered
+// ch: MQ channel
+// d: message
+// return: none
+func handleDelivery(ch *amqp.Channel, d amqp.Delivery) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlePoisonMessage(ch, d, fmt.Sprint(r))
+		}
+	}()
+	processMessage(ch, d)
+}
+
+// handlePoisonMessage retries a message which failed to be handled, or dead-letters it after max attempts
+// ch: MQ channel
+// d: message
+// reason: why the message failed
+// return: none
+func handlePoisonMessage(ch *amqp.Channel, d amqp.Delivery, reason string) {
+	attempts := deliveryAttempts(d)
+	log.Printf("[x] Failed to handle message [x] -> attempt %d/%d: %s", attempts, *maxAttempts, reason)
+	if attempts < *maxAttempts {
+		// let the retried copy pass the replay check once, a replay of the original message is still rejected
+		verifier.Retrying(d.Headers)
+		retryMessage(ch, d, attempts)
+		return
+	}
+	total := atomic.AddUint64(&poisonedMessages, 1)
+	log.Printf("[x] Poisoned message [x] -> total poisoned: %d, body: %s", total, d.Body)
+	deadLetterMessage(ch, d, reason, attempts)
+}
+
+// deliveryAttempts returns the attempt number of the current delivery, starting at 1
+// quorum queues count deliveries in x-delivery-count, classic queues rely on the header set by retryMessage
+// d: message
+// return: attempt number
+func deliveryAttempts(d amqp.Delivery) int {
+	if n, err := utils.HeaderToInt64(d.Headers["x-delivery-count"]); err == nil {
+		return int(n) + 1
+	}
+	if n, err := utils.HeaderToInt64(d.Headers[headerAttempts]); err == nil {
+		return int(n) + 1
+	}
+	return 1
+}
+
+// retryMessage puts a message back to the queue
+// ch: MQ channel
+// d: message
+// attempts: attempts already made
+// return: none
+func retryMessage(ch *amqp.Channel, d amqp.Delivery, attempts int) {
+	if *queueType == "quorum" {
+		// the broker increases x-delivery-count itself
+		err := d.Nack(false, true)
+		utils.LogOnError(err, "Failed to requeue message")
+		return
+	}
+	// classic queues have no delivery count, publish a copy with the attempts header and ack the original
+	msg := copyMessage(d)
+	msg.Headers[headerAttempts] = int64(attempts)
+	msg.Headers[headerRoutingKey] = taskRoutingKey(d)
+	err := ch.Publish("", queueName, false, false, msg)
+	if err != nil {
+		utils.LogOnError(err, "Failed to republish message")
+		err = d.Nack(false, true)
+		utils.LogOnError(err, "Failed to requeue message")
+		return
+	}
+	err = d.Ack(false)
+	utils.LogOnError(err, "Failed to ack message")
+}
+
+// deferMessage puts a task back to the queue after deferDelay, when its task type has no free slot, the worker is
+// free meanwhile; the copy keeps the attempts of the original, so deferring does not count as a failed attempt
+// ch: MQ channel
+// d: message
+// return: none
+func deferMessage(ch *amqp.Channel, d amqp.Delivery) {
+	// let the copy pass the replay check once, it keeps the signed timestamp and is not checked for its age
+	verifier.Retrying(d.Headers)
+	pendingDefers.Add(1)
+	time.AfterFunc(deferDelay, func() {
+		defer pendingDefers.Done()
+		msg := copyMessage(d)
+		msg.Headers[headerAttempts] = int64(deliveryAttempts(d) - 1)
+		msg.Headers[headerRoutingKey] = taskRoutingKey(d)
+		msg.Headers[headerDeferred] = true
+		// x-delivery-count of quorum queues starts over with the copy, the attempts header is used then
+		delete(msg.Headers, "x-delivery-count")
+		err := ch.Publish("", queueName, false, false, msg)
+		if err != nil {
+			// the broker requeues the unacked task when the channel is closed
+			utils.LogOnError(err, "Failed to put task back to the queue")
+			err = d.Nack(false, true)
+			utils.LogOnError(err, "Failed to requeue message")
+			return
+		}
+		err = d.Ack(false)
+		utils.LogOnError(err, "Failed to ack message")
+	})
+}
+
+// isRetriedCopy returns whether a message is a copy the agent put back to the queue, retried or deferred
+// d: message
+// return: bool
+func isRetriedCopy(d amqp.Delivery) bool {
+	_, deferred := d.Headers[headerDeferred]
+	return deliveryAttempts(d) > 1 || deferred
+}
+
+// verifyMessage verifies the signature of a task message, retried and deferred copies pass the replay check once
+// per retry of the agent; so does an original the broker redelivered, because its copy was never published when
+// the channel closed in between, without a pending retry it is checked like any other message
+// d: message
+// return: error
+func verifyMessage(d amqp.Delivery) error {
+	verify := verifier.Verify
+	if isRetriedCopy(d) || d.Redelivered {
+		// its nonce was seen by the first attempt
+		verify = verifier.VerifyRetry
+	}
+	return verify(d.Body, d.Headers, auth.Properties{
+		RoutingKey:    taskRoutingKey(d),
+		ReplyTo:       d.ReplyTo,
+		CorrelationId: d.CorrelationId,
+	})
+}
+
+// deadLetterMessage publishes a copy of the message with the error to the dead letter exchange and acks the original,
+// the message is dropped if no dead letter exchange is configured
+// ch: MQ channel
+// d: message
+// reason: why the message failed
+// attempts: attempts already made
+// return: none
+func deadLetterMessage(ch *amqp.Channel, d amqp.Delivery, reason string, attempts int) {
+	if *deadLetterExch == "" {
+		log.Printf("[x] No dead letter exchange configured [x] -> drop message")
+		err := d.Reject(false)
+		utils.LogOnError(err, "Failed to reject message")
+		return
+	}
+	msg := copyMessage(d)
+	msg.Headers[headerError] = reason
+	msg.Headers[headerAttempts] = int64(attempts)
+	msg.Headers[headerDeviceId] = deviceGlobalId
+	err := ch.Publish(*deadLetterExch, taskRoutingKey(d), false, false, msg)
+	if err != nil {
+		utils.LogOnError(err, "Failed to publish message to dead letter exchange")
+		// the queue is declared with the same dead letter exchange, the broker forwards it without the error header
+		err = d.Nack(false, false)
+		utils.LogOnError(err, "Failed to nack message")
+		return
+	}
+	err = d.Ack(false)
+	utils.LogOnError(err, "Failed to ack message")
+}
+
+// taskRoutingKey returns the routing key a task was published with, also for the retried copies of classic queues
+// d: message
+// return: routing key
+func taskRoutingKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[headerRoutingKey].(string); ok && d.Exchange == "" {
+		return key
+	}
+	return d.RoutingKey
+}
+
+// copyMessage copies a delivery into a publishing
+func copyMessage(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// checkExchangeExists makes sure an exchange exists,
+// publishing to a missing exchange would close the channel
+// conn: MQ connection
+// name: exchange name
+// msg: error message
+// return: error
+func checkExchangeExists(conn *amqp.Connection, name string, msg string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open a channel failed: %w", err)
+	}
+	// a passive declare only checks existence, the kind is ignored by the broker
+	err = ch.ExchangeDeclarePassive(name, "fanout", true, false, false, false, nil)
+	if err != nil {
+		// the failed declare closed the channel
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	err = ch.Close()
+	utils.LogOnError(err, "Failed to close channel")
+	return nil
+}
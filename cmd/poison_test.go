@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/pkg/auth"
+)
+
+func TestVerifyRedeliveredAfterDefer(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "hmac.key")
+	if err := os.WriteFile(keyFile, []byte("shared-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := auth.NewSigner(auth.ModeHMAC, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := verifier
+	verifier, err = auth.NewVerifier(auth.ModeHMAC, keyFile, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { verifier = old })
+
+	body := []byte(`{"task_type":0,"metadata":{"task_uuid":"1"}}`)
+	headers, err := signer.Sign(body, auth.Properties{RoutingKey: "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := amqp.Delivery{Body: body, Headers: amqp.Table(headers), RoutingKey: "all"}
+	if err := verifyMessage(d); err != nil {
+		t.Fatalf("verifyMessage() error = %v", err)
+	}
+	// no free slot, the task is deferred, then the channel closes before the copy is published
+	verifier.Retrying(d.Headers)
+	redelivered := d
+	redelivered.Redelivered = true
+	if err := verifyMessage(redelivered); err != nil {
+		t.Fatalf("verifyMessage() of the redelivered original error = %v", err)
+	}
+	// the retry was used up by the redelivered original, the copy published meanwhile is a replay
+	copied := d
+	copied.Headers = amqp.Table{headerDeferred: true}
+	for k, v := range d.Headers {
+		copied.Headers[k] = v
+	}
+	if err := verifyMessage(copied); !errors.Is(err, auth.ErrReplay) {
+		t.Fatalf("verifyMessage() of the deferred copy error = %v, want %v", err, auth.ErrReplay)
+	}
+	if err := verifyMessage(redelivered); !errors.Is(err, auth.ErrReplay) {
+		t.Fatalf("verifyMessage() of a second redelivery error = %v, want %v", err, auth.ErrReplay)
+	}
+	if err := verifyMessage(d); !errors.Is(err, auth.ErrReplay) {
+		t.Fatalf("verifyMessage() of a replay error = %v, want %v", err, auth.ErrReplay)
+	}
+}
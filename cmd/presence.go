@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/task"
+	"sugar-agent/pkg/utils"
+)
+
+// presence message types
+const (
+	presenceRegister  = "register"
+	presenceHeartbeat = "heartbeat"
+	presenceOffline   = "offline"
+)
+
+var (
+	agentStartedAt = time.Now()
+	presenceCh     *amqp.Channel
+	presenceStop   chan struct{} // closed to stop the heartbeats
+	presenceDone   chan struct{} // closed when the heartbeats stopped
+
+	runningMu    sync.Mutex
+	runningTasks = make(map[string]runningTask) // task uuid -> running task
+)
+
+// runningTask a task currently being executed
+type runningTask struct {
+	TaskUUID  string    `json:"taskUuid"`
+	TaskType  int       `json:"taskType"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// trackTask records a task as running until the returned func is called
+// taskUUID: task uuid
+// taskType: task type
+// return: func to untrack the task
+func trackTask(taskUUID string, taskType int) func() {
+	runningMu.Lock()
+	runningTasks[taskUUID] = runningTask{TaskUUID: taskUUID, TaskType: taskType, StartedAt: time.Now()}
+	runningMu.Unlock()
+	return func() {
+		runningMu.Lock()
+		delete(runningTasks, taskUUID)
+		runningMu.Unlock()
+	}
+}
+
+// currentTasks returns the running tasks sorted by start time
+func currentTasks() []runningTask {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	tasks := make([]runningTask, 0, len(runningTasks))
+	for _, t := range runningTasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].StartedAt.Before(tasks[j].StartedAt) })
+	return tasks
+}
+
+// startPresence publishes the registration message and starts sending heartbeats,
+// the caller checks the presence exchange exists
+// conn: MQ connection
+// return: error, the caller reconnects
+func startPresence(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open a presence channel failed: %w", err)
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		_ = ch.Close()
+		return fmt.Errorf("put presence channel into confirm mode failed: %w", err)
+	}
+	presenceCh = ch
+
+	err = publishRegistration()
+	utils.LogOnError(err, "Failed to publish registration")
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	presenceStop, presenceDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(*heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			err := publishPresence(presenceHeartbeat, map[string]interface{}{
+				"uptime":           int64(time.Since(agentStartedAt).Seconds()),
+				"currentTasks":     currentTasks(),
+				"poisonedMessages": poisonedCount(),
+				"sinks":            outputs.Stats(),
+			})
+			utils.LogOnError(err, "Failed to publish heartbeat")
+		}
+	}()
+	return nil
+}
+
+// publishRegistration publishes the registration message, again when a reload changed labels or collectors
+// return: error
+func publishRegistration() error {
+	if presenceCh == nil {
+		return nil
+	}
+	properties, err := internal.GetProperties()
+	utils.LogOnError(err, "Failed to get host properties")
+	return publishPresence(presenceRegister, map[string]interface{}{
+		"properties": properties,
+		"taskTypes":  task.Supported(),
+		"collectors": internal.Collectors(),
+		"labels":     currentLabels(),
+		"groups":     utils.SplitList(*groups),
+	})
+}
+
+// stopPresence stops the heartbeats and publishes the offline message
+// reason: why the agent goes offline
+// return: none
+func stopPresence(reason string) {
+	if presenceCh == nil {
+		return
+	}
+	close(presenceStop)
+	<-presenceDone
+	err := publishPresence(presenceOffline, map[string]interface{}{
+		"reason":       reason,
+		"uptime":       int64(time.Since(agentStartedAt).Seconds()),
+		"currentTasks": currentTasks(),
+	})
+	utils.LogOnError(err, "Failed to publish offline message")
+	presenceCh = nil
+}
+
+// publishPresence publishes a presence message with routing key presence.<device-id> and waits for the confirm
+// msgType: register, heartbeat or offline
+// data: message specific fields
+// return: error
+func publishPresence(msgType string, data map[string]interface{}) error {
+	body := map[string]interface{}{
+		"type":      msgType,
+		"deviceId":  deviceGlobalId,
+		"version":   version,
+		"timestamp": time.Now().Unix(),
+	}
+	for k, v := range data {
+		body[k] = v
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	msg := amqp.Publishing{
+		ContentType: "application/json",
+		Type:        msgType,
+		Timestamp:   time.Now(),
+		Body:        b,
+	}
+	if msgType == presenceHeartbeat {
+		// a heartbeat is useless once the next one is due
+		msg.Expiration = strconv.FormatInt(heartbeatInterval.Milliseconds(), 10)
+	} else {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	confirm, err := presenceCh.PublishWithDeferredConfirmWithContext(ctx, *presenceExch, "presence."+deviceGlobalId, false, false, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("presence message nacked by broker")
+	}
+	if msgType != presenceHeartbeat {
+		log.Printf("Published %s message to %s", msgType, *presenceExch)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/labels"
+	"sugar-agent/pkg/sink"
+	"sugar-agent/pkg/task"
+	"sugar-agent/pkg/utils"
+)
+
+// how a changed flag is applied on reload, flags of no group need a restart, ex: -device-id, -journal-file,
+// and the queue and exchange arguments, RabbitMQ refuses to declare an existing queue or exchange with other ones
+const (
+	reloadConnection = "connection" // by reconnecting to MQ server once the running tasks finished
+	reloadCollectors = "collectors"
+	reloadSinks      = "sinks"
+	reloadLabels     = "labels"
+	reloadLogging    = "logging"
+	reloadLimits     = "limits"
+)
+
+// reloadGroups maps the flags applied on reload to their group
+var reloadGroups = map[string]string{}
+
+func init() {
+	for group, names := range map[string][]string{
+		reloadConnection: {
+			"host", "port", "user", "password", "tls", "tls-ca-file", "tls-cert-file", "tls-key-file", "tls-server-name",
+			"tls-insecure-skip-verify", "exchange-name", "groups", "results-exchange", "presence-exchange",
+			"heartbeat-interval", "workers", "result-transport", "max-attempts",
+		},
+		reloadCollectors: {"log-patterns", "http-probes", "tcp-probes", "dns-probes", "dns-resolver", "scrape-targets", "probe-timeout"},
+		reloadSinks: {
+			"otlp-endpoint", "otlp-encoding", "otlp-headers", "otlp-batch",
+			"influx-url", "influx-version", "influx-database", "influx-retention-policy", "influx-user", "influx-password",
+			"influx-token", "influx-org", "influx-bucket", "influx-precision", "influx-batch",
+			"graphite-address", "graphite-prefix", "graphite-tagged", "graphite-batch",
+			"file-output-dir", "file-output-content", "file-output-format", "file-output-compress", "file-output-max-bytes",
+			"file-output-max-age", "file-output-retention", "file-output-max-files",
+			"otlp-retries", "otlp-buffer", "influx-retries", "influx-buffer", "graphite-retries", "graphite-buffer",
+			"file-output-buffer", "server-retries", "metrics-buffer", "sink-buffer", "sink-retries", "sample-interval",
+		},
+		reloadLabels:  {"labels"},
+		reloadLogging: {"log-level", "log-file"},
+		reloadLimits:  {"task-type-limits"},
+	} {
+		for _, name := range names {
+			reloadGroups[name] = group
+		}
+	}
+}
+
+// reloadConfig reads the environment and the config file again and applies the changes, collectors, sinks, labels,
+// logging and task type limits are applied at once; an invalid config is rejected as a whole and the previous one keeps running
+// reason: why the config is reloaded, ex: received signal hangup
+// return: changed connection parameters, applied by the caller after it stopped consuming, nil when none changed
+func reloadConfig(reason string) map[string]string {
+	log.Printf("[x] Reloading config [x] -> %s", reason)
+	changed, err := changedSettings()
+	if err != nil {
+		log.Printf("[error] Config reload rejected, keep running with the previous config: %s", err)
+		return nil
+	}
+	live := make(map[string]string)
+	pending := make(map[string]string)
+	groups := make(map[string]bool)
+	for name, val := range changed {
+		switch group := reloadGroups[name]; group {
+		case "":
+		case reloadConnection:
+			pending[name] = val
+		default:
+			live[name] = val
+			groups[group] = true
+		}
+	}
+	previous := make(map[string]string, len(changed))
+	for name := range changed {
+		previous[name] = flag.Lookup(name).Value.String()
+	}
+	err = applyLive(live, groups)
+	if err != nil {
+		log.Printf("[error] Config reload rejected, keep running with the previous config: %s", err)
+		return nil
+	}
+	if len(changed) == 0 {
+		log.Printf("[x] Config unchanged [x]")
+	}
+	logChanges(previous, changed)
+	return pending
+}
+
+// changedSettings resolves the value every flag should have and compares it with the current one
+// return: flag name -> new value of the changed flags, error
+func changedSettings() (map[string]string, error) {
+	values, _, path, err := resolveSettings()
+	if err != nil {
+		return nil, err
+	}
+	if configFile != "" && path != configFile {
+		// ex: the default config file was removed, falling back to the defaults would drop the whole configuration
+		return nil, fmt.Errorf("config file %s is gone", configFile)
+	}
+	changed := make(map[string]string)
+	var errs []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || cmdlineFlags[f.Name] {
+			return
+		}
+		val, ok := values[f.Name]
+		if !ok {
+			val = f.DefValue
+		}
+		val, err := normalizeValue(f, val)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %s", f.Name, err))
+			return
+		}
+		if val != f.Value.String() {
+			changed[f.Name] = val
+		}
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	for _, name := range requiredFlags {
+		if val, ok := changed[name]; ok && strings.TrimSpace(val) == "" {
+			return nil, fmt.Errorf("-%s is required", name)
+		}
+	}
+	return changed, nil
+}
+
+// normalizeValue parses a value the way its flag does, so equal values compare equal, ex: 5m and 5m0s
+// f: flag
+// val: value
+// return: value as printed by the flag, error
+func normalizeValue(f *flag.Flag, val string) (string, error) {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return val, nil
+	}
+	switch getter.Get().(type) {
+	case bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return "", fmt.Errorf("invalid boolean %q", val)
+		}
+		return strconv.FormatBool(b), nil
+	case int, int64:
+		n, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid integer %q", val)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return "", fmt.Errorf("invalid duration %q", val)
+		}
+		return d.String(), nil
+	}
+	return val, nil
+}
+
+// applySettings sets flags
+// values: flag name -> value
+// return: flag name -> previous value, to restore them
+func applySettings(values map[string]string) map[string]string {
+	previous := make(map[string]string, len(values))
+	for name, val := range values {
+		f := flag.Lookup(name)
+		previous[name] = f.Value.String()
+		// the values were normalized by the flag itself, they can not fail
+		err := f.Value.Set(val)
+		utils.LogOnError(err, "Failed to set -"+name)
+	}
+	return previous
+}
+
+// applyLive applies changed collectors, sinks, labels, logging and task type limits, nothing is applied when one of them fails
+// live: flag name -> new value
+// groups: groups of the changed flags
+// return: error
+func applyLive(live map[string]string, groups map[string]bool) (err error) {
+	previous := applySettings(live)
+	var sinks []sink.Spec
+	defer func() {
+		if err != nil {
+			applySettings(previous)
+			closeSinks(sinks)
+		}
+	}()
+	err = checkFlags()
+	if err != nil {
+		return err
+	}
+	var factories map[string]internal.CollectorFactory
+	if groups[reloadCollectors] {
+		factories, err = collectorFactories()
+		if err != nil {
+			return err
+		}
+		// creating the collectors opens the log files of log patterns
+		for name, factory := range factories {
+			c, err := factory()
+			if err != nil {
+				return fmt.Errorf("create collector %s failed: %w", name, err)
+			}
+			_ = c.Close()
+		}
+	}
+	l := currentLabels()
+	if groups[reloadLabels] {
+		l, err = labels.Parse(*deviceLabels)
+		if err != nil {
+			return fmt.Errorf("parse labels failed: %w", err)
+		}
+	}
+	var limits map[int]int
+	if groups[reloadLimits] {
+		limits, err = task.ParseLimits(*taskTypeLimits)
+		if err != nil {
+			return fmt.Errorf("parse task type limits failed: %w", err)
+		}
+	}
+	if groups[reloadSinks] || groups[reloadLabels] {
+		// the labels are part of what the sinks write
+		sinks, err = createSinks(l, false)
+		if err != nil {
+			return err
+		}
+	}
+	if groups[reloadLogging] || *logFile != "" {
+		// an unchanged log file is reopened too, so it can be rotated like: mv agent.log agent.log.1 && kill -HUP
+		err = utils.SetupLogging(*logLevel, *logFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if factories != nil {
+		internal.ReplaceCollectors(factories)
+	}
+	if groups[reloadLabels] {
+		setLabels(l)
+	}
+	if limits != nil {
+		limiter.SetLimits(limits)
+	}
+	if sinks != nil || groups[reloadSinks] {
+		outputs.Replace(sinks, sinkWriteTimeout, sinkDrainTimeout)
+		useSinks(sinks)
+	}
+	if groups[reloadCollectors] || groups[reloadSinks] || groups[reloadLabels] {
+		utils.LogOnError(restartSampling(), "Failed to restart background sampling")
+	}
+	if groups[reloadCollectors] || groups[reloadLabels] {
+		utils.LogOnError(updateMetricsExporter(), "Failed to update metrics exporter")
+		utils.LogOnError(publishRegistration(), "Failed to publish registration")
+	}
+	return nil
+}
+
+// logChanges logs what changed and how it is applied, values of secrets are not logged
+// previous: flag name -> value before the reload
+// changed: flag name -> new value
+// return: none
+func logChanges(previous, changed map[string]string) {
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		diff := fmt.Sprintf("%q -> %q", previous[name], changed[name])
+		if secretFlags[name] {
+			diff = "changed"
+		}
+		switch reloadGroups[name] {
+		case "":
+			log.Printf("[warn] Config changed -> -%s: %s, restart the agent to apply it", name, diff)
+		case reloadConnection:
+			log.Printf("[x] Config changed [x] -> -%s: %s, applied after reconnecting", name, diff)
+		default:
+			log.Printf("[x] Config changed [x] -> -%s: %s, applied", name, diff)
+		}
+	}
+}
+
+// watchConfigFile polls the config file and signals when its modification time or size changed
+// path: config file
+// interval: poll interval
+// changes: signaled on change, it is not blocked on
+// return: none
+func watchConfigFile(path string, interval time.Duration, changes chan<- struct{}) {
+	if path == "" {
+		log.Printf("[warn] No config file to watch, it is only reloaded on SIGHUP")
+		return
+	}
+	type stamp struct {
+		modTime time.Time
+		size    int64
+	}
+	current := func() stamp {
+		info, err := os.Stat(path)
+		if err != nil {
+			return stamp{}
+		}
+		return stamp{info.ModTime(), info.Size()}
+	}
+	last := current()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		st := current()
+		if st == last {
+			continue
+		}
+		last = st
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
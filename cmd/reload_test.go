@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReloadGroups(t *testing.T) {
+	for name := range reloadGroups {
+		if flag.Lookup(name) == nil {
+			t.Errorf("reload group of unknown flag -%s", name)
+		}
+	}
+	// RabbitMQ refuses to declare an existing queue or exchange with other arguments
+	for _, name := range []string{
+		"exchange-type", "queue-durable", "queue-exclusive", "queue-auto-delete", "queue-type",
+		"queue-message-ttl", "queue-max-length", "dead-letter-exchange",
+	} {
+		if group := reloadGroups[name]; group != "" {
+			t.Errorf("-%s is applied on reload by %s, want restart only", name, group)
+		}
+	}
+}
+
+func TestNextReload(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	signals <- syscall.SIGHUP
+	if reason, stop := nextReload(signals, changes, done); reason != "received signal hangup" || stop {
+		t.Fatalf("SIGHUP: nextReload() = %q, %t", reason, stop)
+	}
+	changes <- struct{}{}
+	if reason, stop := nextReload(signals, changes, done); reason != "config file changed" || stop {
+		t.Fatalf("file change: nextReload() = %q, %t", reason, stop)
+	}
+	// a stop signal is handled while waiting for the running tasks
+	signals <- syscall.SIGTERM
+	if _, stop := nextReload(signals, changes, done); !stop {
+		t.Fatal("SIGTERM: nextReload() did not stop")
+	}
+	close(done)
+	if reason, stop := nextReload(signals, changes, done); reason != "" || stop {
+		t.Fatalf("done: nextReload() = %q, %t", reason, stop)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/pkg/sink"
+	"sugar-agent/pkg/utils"
+)
+
+// result transport modes
+const (
+	transportHTTP = "http"
+	transportAMQP = "amqp"
+)
+
+// task status reported to sugar-server
+const (
+	statusReceived = 1
+	statusStarted  = 2
+	statusSuccess  = 3
+	statusFailure  = 4
+)
+
+// confirmTimeout how long to wait for the broker to confirm a result message
+const confirmTimeout = 30 * time.Second
+
+// resultCh channel in confirm mode used to publish results in amqp transport mode
+var resultCh *amqp.Channel
+
+// reporter reports task status transitions and results back to sugar-server
+type reporter interface {
+	// UpdateTaskStatus sends updateData (task_status and optional result) of the task
+	UpdateTaskStatus(updateData map[string]interface{}) error
+}
+
+// httpReporter reports through the sugar-server http API
+type httpReporter struct {
+	baseUrl   string
+	taskUUID  string
+	loginData map[string]interface{}
+
+	mu    sync.Mutex
+	token string
+}
+
+// amqpReporter publishes to the ReplyTo queue of the task message, or to the results exchange
+type amqpReporter struct {
+	exchange      string
+	routingKey    string
+	correlationId string
+}
+
+// newReporter creates the reporter of a task according to the result transport mode
+// d: task message
+// metadata: task metadata
+// taskUUID: task uuid
+// return: reporter, error when results have nowhere to go
+func newReporter(d amqp.Delivery, metadata map[string]interface{}, taskUUID string) (reporter, error) {
+	if *resultTransport == transportAMQP {
+		r := &amqpReporter{correlationId: taskUUID}
+		if *resultsExchange != "" {
+			r.exchange, r.routingKey = *resultsExchange, "result."+deviceGlobalId
+		}
+		if d.ReplyTo != "" {
+			// RPC style: publish to the reply queue through the default exchange
+			r.exchange, r.routingKey = "", d.ReplyTo
+		}
+		if r.exchange == "" && r.routingKey == "" {
+			return nil, errors.New("neither ReplyTo nor results exchange is set")
+		}
+		return r, nil
+	}
+	r := &httpReporter{
+		baseUrl:  metadata["base_url"].(string),
+		taskUUID: taskUUID,
+		loginData: map[string]interface{}{
+			"username": metadata["username"],
+			"password": metadata["password"],
+		},
+	}
+	// Login to get token, a failed login is tried again by the next request
+	_, err := r.login()
+	utils.LogOnError(err, "Failed to login")
+	return r, nil
+}
+
+// login returns the token of the reporter, logging in when there is none yet
+func (r *httpReporter) login() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.token != "" {
+		return r.token, nil
+	}
+	token, err := utils.UserLogin(r.baseUrl, r.loginData)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	r.token = token
+	return token, nil
+}
+
+// UpdateTaskStatus update task status through the http API
+func (r *httpReporter) UpdateTaskStatus(updateData map[string]interface{}) error {
+	token, err := r.login()
+	if err != nil {
+		return err
+	}
+	return utils.UpdateTaskStatus(r.baseUrl, updateData, r.taskUUID, token)
+}
+
+// Upload upload a task attachment through the http API, the content type is derived from the file name by the server
+func (r *httpReporter) Upload(name string, contentType string, data []byte) error {
+	token, err := r.login()
+	if err != nil {
+		return err
+	}
+	return utils.UploadTaskAttachment(r.baseUrl, r.taskUUID, token, name, data)
+}
+
+// UpdateTaskStatus publish task status and wait for the broker to confirm it
+func (r *amqpReporter) UpdateTaskStatus(updateData map[string]interface{}) error {
+	body := map[string]interface{}{
+		"task_uuid": r.correlationId,
+		"device_id": deviceGlobalId,
+	}
+	for k, v := range updateData {
+		body[k] = v
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	confirm, err := resultCh.PublishWithDeferredConfirmWithContext(ctx, r.exchange, r.routingKey, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: r.correlationId,
+		Type:          "task_status",
+		Timestamp:     time.Now(),
+		Body:          b,
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for confirm failed: %w", err)
+	}
+	if !acked {
+		return errors.New("result message nacked by broker")
+	}
+	return nil
+}
+
+// serverSink reports task results to sugar-server through the reporter of the task, the task waits for it
+type serverSink struct {
+	maxRetries int
+}
+
+func (s *serverSink) Name() string {
+	return "server"
+}
+
+// Write is never called, a sink the tasks wait for takes no samples
+func (s *serverSink) Write(ctx context.Context, samples []sink.Sample) error {
+	return nil
+}
+
+func (s *serverSink) Close() error {
+	return nil
+}
+
+// ReportResult updates the task status to SUCCESS or FAILURE with the result
+func (s *serverSink) ReportResult(ctx context.Context, r sink.Result) error {
+	if r.Reporter == nil {
+		return errors.New("the result has no reporter")
+	}
+	taskStatus := statusSuccess
+	if !r.Success {
+		taskStatus = statusFailure
+	}
+	updateData := map[string]interface{}{
+		"task_status": taskStatus,
+		"result": map[string]interface{}{
+			"status": r.Success,
+			"data":   r.Data,
+			"msg":    r.Message,
+		},
+	}
+	return sink.Retry(ctx, s.maxRetries, func() error {
+		return r.Reporter.UpdateTaskStatus(updateData)
+	})
+}
+
+// openResultChannel opens the channel used to publish results in confirm mode
+// conn: MQ connection
+// return: error
+func openResultChannel(conn *amqp.Connection) error {
+	if *resultsExchange != "" {
+		err := checkExchangeExists(conn, *resultsExchange, "results exchange does not exist")
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	resultCh, err = conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open a result channel failed: %w", err)
+	}
+	err = resultCh.Confirm(false)
+	if err != nil {
+		return fmt.Errorf("put result channel into confirm mode failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/pkg/sink"
+)
+
+func TestServerSinkRetriesHTTPFailures(t *testing.T) {
+	var logins, updates int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/system/users/login/":
+			// the first login fails, the status update logs in again
+			if atomic.AddInt32(&logins, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				_, _ = w.Write([]byte("<html>502 Bad Gateway</html>"))
+				return
+			}
+			_, _ = w.Write([]byte(`{"code":20000,"message":"登录成功","data":{"access":"token"}}`))
+		case "/api/v1/task-results/1/":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+			}
+			if atomic.AddInt32(&updates, 1) == 1 {
+				_, _ = w.Write([]byte(`{"message":"no code"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"code":20000,"message":"success"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	setFlag(t, resultTransport, transportHTTP)
+	rep, err := newReporter(amqp.Delivery{}, map[string]interface{}{
+		"base_url": srv.URL,
+		"username": "u",
+		"password": "p",
+	}, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &serverSink{maxRetries: 3}
+	err = s.ReportResult(context.Background(), sink.Result{TaskUUID: "1", Success: true, Reporter: rep})
+	if err != nil {
+		t.Fatalf("ReportResult() error = %v", err)
+	}
+	if logins != 2 || updates != 2 {
+		t.Fatalf("logins = %d, updates = %d, want 2 and 2", logins, updates)
+	}
+}
+
+func TestServerSinkGivesUp(t *testing.T) {
+	// sugar-server is down
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	setFlag(t, resultTransport, transportHTTP)
+	rep, err := newReporter(amqp.Delivery{}, map[string]interface{}{"base_url": srv.URL}, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &serverSink{maxRetries: 0}
+	if err := s.ReportResult(context.Background(), sink.Result{TaskUUID: "1", Reporter: rep}); err == nil {
+		t.Fatal("ReportResult() to a closed server succeeded")
+	}
+}
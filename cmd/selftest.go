@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"sugar-agent/internal"
+)
+
+// selftestCmd runs every collector once and reports which work on this host and which fail with reasons
+func selftestCmd(fs *flag.FlagSet, args []string) int {
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	err := registerCollectors()
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig
+	}
+	failed := 0
+	fmt.Printf("%-14s %-6s %-9s %s\n", "COLLECTOR", "STATUS", "DURATION", "DETAIL")
+	for _, c := range internal.CheckCollectors(context.Background()) {
+		status := "OK"
+		if !c.OK {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-14s %-6s %-9s %s\n", c.Name, status, c.Duration.Round(1e6), c.Detail)
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d collectors failed\n", failed)
+		return exitSelftest
+	}
+	fmt.Printf("\nAll collectors work\n")
+	return exitOK
+}
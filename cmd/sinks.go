@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/labels"
+	"sugar-agent/pkg/sink"
+	"sugar-agent/pkg/utils"
+)
+
+const (
+	// sinkWriteTimeout max time of delivering one batch to a sink, retries included
+	sinkWriteTimeout = 2 * time.Minute
+	// sinkDrainTimeout max time of delivering the buffered batches on shutdown
+	sinkDrainTimeout = 10 * time.Second
+)
+
+// outputs fans perf task samples, background samples and task results out to the sinks
+var outputs = sink.NewFanout()
+
+// stopSampling stops the background sampling, nil when it is not running
+var stopSampling func()
+
+// fileOutput the file sink in use, nil without one; a reload keeps it when its options did not change, so no second
+// sink rotates and cleans up files in the same directory while the old one drains
+var fileOutput *sink.FileSink
+
+// openSinks creates the output sinks configured by flags and adds them to outputs
+// return: error
+func openSinks() error {
+	sinks, err := createSinks(currentLabels(), false)
+	if err != nil {
+		return err
+	}
+	for _, s := range sinks {
+		outputs.Add(s, sinkWriteTimeout)
+	}
+	useSinks(sinks)
+	return nil
+}
+
+// useSinks records the file sink of sinks once they were added to outputs
+func useSinks(sinks []sink.Spec) {
+	fileOutput = nil
+	for _, s := range sinks {
+		if f, ok := s.Sink.(*sink.FileSink); ok {
+			fileOutput = f
+		}
+	}
+}
+
+// closeSinks closes sinks which are not used, the file sink in use is kept open
+func closeSinks(sinks []sink.Spec) {
+	for _, s := range sinks {
+		if f, ok := s.Sink.(*sink.FileSink); ok && f == fileOutput {
+			continue
+		}
+		_ = s.Sink.Close()
+	}
+}
+
+// sinkSetting returns the retries or buffer size of a sink, -1 means the default of all sinks
+// v: value of the sink
+// def: default of all sinks
+// return: value
+func sinkSetting(v int, def int) int {
+	if v < 0 {
+		return def
+	}
+	return v
+}
+
+// createSinks creates the output sinks configured by flags, a failure closes the sinks created so far,
+// sugar-server always gets the task results, the Prometheus exporter gets the background samples
+// l: device labels, added to what the sinks write
+// checkOnly: only check the options of the file sink, so nothing is written to the file system
+// return: sinks with their buffer sizes, error
+func createSinks(l labels.Labels, checkOnly bool) (sinks []sink.Spec, err error) {
+	defer func() {
+		if err != nil {
+			closeSinks(sinks)
+			sinks = nil
+		}
+	}()
+	properties, err := internal.GetProperties()
+	if err != nil {
+		return nil, err
+	}
+	res := sink.Resource{DeviceID: deviceGlobalId, Labels: l, Host: properties.HostInfo, Version: version}
+	// results are reported by the task itself, the buffer is not used
+	sinks = append(sinks, sink.Spec{Sink: &serverSink{maxRetries: sinkSetting(*serverRetries, *sinkRetries)}})
+	if *otlpEndpoint != "" {
+		headers, err := parseHeaders(*otlpHeaders)
+		if err != nil {
+			return sinks, err
+		}
+		s, err := sink.NewOTLP(sink.OTLPOptions{
+			Endpoint:   *otlpEndpoint,
+			Encoding:   *otlpEncoding,
+			Headers:    headers,
+			MaxBatch:   *otlpBatch,
+			MaxRetries: sinkSetting(*otlpRetries, *sinkRetries),
+		}, res)
+		if err != nil {
+			return sinks, err
+		}
+		sinks = append(sinks, sink.Spec{Sink: s, Buffer: sinkSetting(*otlpBuffer, *sinkBuffer)})
+	}
+	if *influxURL != "" {
+		s, err := sink.NewInflux(sink.InfluxOptions{
+			URL:             *influxURL,
+			Version:         *influxVersion,
+			Database:        *influxDatabase,
+			RetentionPolicy: *influxRP,
+			Username:        *influxUser,
+			Password:        *influxPassword,
+			Token:           *influxToken,
+			Org:             *influxOrg,
+			Bucket:          *influxBucket,
+			Precision:       *influxPrecision,
+			MaxBatch:        *influxBatch,
+			MaxRetries:      sinkSetting(*influxRetries, *sinkRetries),
+		}, res)
+		if err != nil {
+			return sinks, err
+		}
+		sinks = append(sinks, sink.Spec{Sink: s, Buffer: sinkSetting(*influxBuffer, *sinkBuffer)})
+	}
+	if *graphiteAddress != "" {
+		s, err := sink.NewGraphite(sink.GraphiteOptions{
+			Address:    *graphiteAddress,
+			Prefix:     *graphitePrefix,
+			Tagged:     *graphiteTagged,
+			MaxBatch:   *graphiteBatch,
+			MaxRetries: sinkSetting(*graphiteRetries, *sinkRetries),
+		}, res)
+		if err != nil {
+			return sinks, err
+		}
+		sinks = append(sinks, sink.Spec{Sink: s, Buffer: sinkSetting(*graphiteBuffer, *sinkBuffer)})
+	}
+	if *fileOutputDir != "" {
+		opts := sink.FileOptions{
+			Dir:       *fileOutputDir,
+			Format:    *fileOutputFormat,
+			Compress:  *fileOutputCompress,
+			MaxBytes:  *fileOutputMaxBytes,
+			MaxAge:    *fileOutputMaxAge,
+			Retention: *fileOutputRetention,
+			MaxFiles:  *fileOutputMaxFiles,
+		}
+		for _, content := range utils.SplitList(*fileOutputContent) {
+			switch content {
+			case "samples":
+				opts.Samples = true
+			case "results":
+				opts.Results = true
+			default:
+				return sinks, fmt.Errorf("unknown file output content %q, expect samples or results", content)
+			}
+		}
+		if checkOnly {
+			err = opts.Check()
+			if err != nil {
+				return sinks, err
+			}
+		} else if fileOutput != nil && fileOutput.Reusable(opts, res) {
+			sinks = append(sinks, sink.Spec{Sink: fileOutput, Buffer: sinkSetting(*fileOutputBuffer, *sinkBuffer)})
+		} else {
+			s, err := sink.NewFile(opts, res)
+			if err != nil {
+				return sinks, err
+			}
+			sinks = append(sinks, sink.Spec{Sink: s, Buffer: sinkSetting(*fileOutputBuffer, *sinkBuffer)})
+		}
+	}
+	if metricsExporter != nil && *sampleInterval > 0 {
+		// without background samples the exporter collects on every scrape
+		sinks = append(sinks, sink.Spec{Sink: metricsExporter.NewSink(), Buffer: sinkSetting(*metricsBuffer, *sinkBuffer)})
+	}
+	return sinks, nil
+}
+
+// startSampling samples the collectors every interval and writes the samples to the sinks in background
+// interval: sample interval
+// return: error
+func startSampling(interval time.Duration) error {
+	collectors, err := internal.NewCollectors(internal.ExtraCollectors())
+	if err != nil {
+		return err
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer internal.CloseCollectors(collectors)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			summary, err := internal.CollectSummary(context.Background(), collectors)
+			if err != nil {
+				utils.LogOnError(err, "Failed to collect sample")
+				continue
+			}
+			outputs.Write([]sink.Sample{sink.FromSummary(*summary)})
+		}
+	}()
+	stopSampling = func() {
+		close(stop)
+		<-done
+	}
+	log.Printf("[******] Sampling every %s to %d sinks [******]", interval, outputs.SampleSinks())
+	return nil
+}
+
+// restartSampling stops the background sampling and starts it again with the current collectors, sinks and interval
+// return: error
+func restartSampling() error {
+	if stopSampling != nil {
+		stopSampling()
+		stopSampling = nil
+	}
+	if *sampleInterval > 0 && outputs.SampleSinks() > 0 {
+		return startSampling(*sampleInterval)
+	}
+	return nil
+}
+
+// sinkMetrics returns the delivery counters of the sinks as metrics
+// return: metrics
+func sinkMetrics() []internal.Metric {
+	var metrics []internal.Metric
+	for _, st := range outputs.Stats() {
+		l := map[string]string{"sink": st.Sink}
+		metrics = append(metrics,
+			internal.Metric{Name: "sink_delivered_total", Type: internal.MetricCounter, Help: "Samples and results written to the sink", Labels: l, Value: float64(st.Delivered)},
+			internal.Metric{Name: "sink_failed_total", Type: internal.MetricCounter, Help: "Samples and results the sink failed to write after retries", Labels: l, Value: float64(st.Failed)},
+			internal.Metric{Name: "sink_dropped_total", Type: internal.MetricCounter, Help: "Samples and results dropped because the sink buffer was full", Labels: l, Value: float64(st.Dropped)},
+			internal.Metric{Name: "sink_queued_batches", Type: internal.MetricGauge, Help: "Batches waiting in the sink buffer", Labels: l, Value: float64(st.Queued)},
+		)
+	}
+	return metrics
+}
+
+// sinkNames returns the names of the sinks configured by flags
+func sinkNames() []string {
+	var names []string
+	for _, configured := range []struct {
+		name string
+		on   bool
+	}{
+		{"server", true},
+		{"otlp", *otlpEndpoint != ""},
+		{"influxdb", *influxURL != ""},
+		{"graphite", *graphiteAddress != ""},
+		{"file", *fileOutputDir != ""},
+		{"prometheus", *metricsListen != "" && *sampleInterval > 0},
+	} {
+		if configured.on {
+			names = append(names, configured.name)
+		}
+	}
+	return names
+}
+
+// parseHeaders parses comma separated http headers, ex: Authorization=Bearer xxx,X-Scope-OrgID=1
+// str: headers
+// return: headers, error
+func parseHeaders(str string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range utils.SplitList(str) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid header %q, expect <name>=<value>", item)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
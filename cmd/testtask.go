@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"sugar-agent/pkg/auth"
+)
+
+// sendTestTaskCmd publishes a sample task to the broker, to check the exchange, routing and an agent end to end
+// ex: sugar-agent send-test-task -user guest -password guest -host localhost -port 5672 -exchange-name task_exchange -target-device 6
+func sendTestTaskCmd(fs *flag.FlagSet, args []string) int {
+	taskType := fs.Int("task-type", 0, "Task type of the sample task")
+	taskConfig := fs.String("task-config", `{"intervals": 1, "count": 3}`, "Task config of the sample task in JSON")
+	target := fs.String("target-device", "", "Device id the task targets, default: -device-id")
+	selector := fs.String("selector", "", "Label selector of the task, ex: env=prod,role in (db)")
+	baseURL := fs.String("base-url", "http://localhost:8000", "sugar-server base url the agent reports to in http transport mode")
+	taskUser := fs.String("task-username", "", "sugar-server username the agent logs in with in http transport mode")
+	taskPassword := fs.String("task-password", "", "sugar-server password the agent logs in with in http transport mode")
+	routingKey := fs.String("routing-key", "", "Routing key, default: device.<target> with direct/topic exchange, all without a target")
+	signMode := fs.String("sign-mode", auth.ModeNone, "Sign the task: none, hmac or ed25519")
+	signKeyFile := fs.String("sign-key-file", "", "HMAC shared key file or Ed25519 private key file")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if missing := missingFlags("user", "password", "host", "port", "exchange-name"); len(missing) > 0 {
+		log.Printf("[error] Missing required flags: %s", strings.Join(missing, ", "))
+		return exitMissingFlags
+	}
+	if *target == "" {
+		*target = *deviceId
+	}
+	if *target == "" && *selector == "" && (*routingKey == "" || *exchangeType == "fanout") {
+		log.Printf("[error] Invalid configuration: the task needs -target-device, -device-id, -selector or -routing-key with a direct/topic exchange")
+		return exitConfig
+	}
+	config := map[string]interface{}{}
+	err := json.Unmarshal([]byte(*taskConfig), &config)
+	if err != nil {
+		log.Printf("[error] Invalid configuration: invalid task config: %s", err)
+		return exitConfig
+	}
+	signer, err := auth.NewSigner(*signMode, *signKeyFile)
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig
+	}
+	key := *routingKey
+	if key == "" && *exchangeType != "fanout" {
+		key = "all"
+		if *target != "" {
+			key = "device." + *target
+		}
+	}
+
+	taskUUID, err := newUUID()
+	if err != nil {
+		log.Printf("[error] Failed to generate task uuid: %s", err)
+		return exitFailure
+	}
+	metadata := map[string]interface{}{
+		"base_url":    *baseURL,
+		"task_uuid":   taskUUID,
+		"username":    *taskUser,
+		"password":    *taskPassword,
+		"task_config": config,
+	}
+	if *target != "" {
+		metadata["device_id"] = *target
+	}
+	if *selector != "" {
+		metadata["selector"] = *selector
+	}
+	body, err := json.Marshal(map[string]interface{}{"task_type": *taskType, "metadata": metadata})
+	if err != nil {
+		log.Printf("[error] Failed to marshal task: %s", err)
+		return exitFailure
+	}
+	headers, err := signer.Sign(body, auth.Properties{RoutingKey: key})
+	if err != nil {
+		log.Printf("[error] Failed to sign task: %s", err)
+		return exitFailure
+	}
+	err = publishTestTask(key, body, headers)
+	if err != nil {
+		log.Printf("[error] Failed to publish task: %s", err)
+		return exitBroker
+	}
+	fmt.Printf("Published task %s to exchange %s with routing key %q\n%s\n", taskUUID, *exchangeName, key, body)
+	return exitOK
+}
+
+// publishTestTask publishes a task message and waits for the confirm of the broker
+// key: routing key
+// body: task message
+// headers: message headers, ex: the signature
+// return: error
+func publishTestTask(key string, body []byte, headers map[string]interface{}) error {
+	conn, err := dialAMQP()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	// fail fast with a clear error instead of a closed channel when the exchange does not exist
+	err = ch.ExchangeDeclarePassive(*exchangeName, *exchangeType, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, *exchangeName, key, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Headers:      headers,
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("task message nacked by broker")
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
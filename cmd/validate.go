@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/task"
+)
+
+// validateConfigCmd checks the flags and every file they refer to without connecting anywhere
+func validateConfigCmd(fs *flag.FlagSet, args []string) int {
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if missing := missingFlags(requiredFlags...); len(missing) > 0 {
+		log.Printf("[error] Missing required flags: %s", strings.Join(missing, ", "))
+		return exitMissingFlags
+	}
+	err := validateConfig()
+	if err != nil {
+		log.Printf("[error] Invalid configuration: %s", err)
+		return exitConfig
+	}
+	fmt.Println("Configuration is valid")
+	if configFile != "" {
+		fmt.Printf("config file: %s\n", configFile)
+	}
+	for _, t := range task.Supported() {
+		fmt.Printf("task type %d: %s v%s\n", t.Type, t.Name, t.Version)
+	}
+	fmt.Printf("collectors: %s\n", strings.Join(internal.Collectors(), ","))
+	fmt.Printf("sinks: %s\n", strings.Join(sinkNames(), ","))
+	return exitOK
+}
+
+// validateConfig sets up the agent like run does, creates every collector once and checks the sinks
+// return: error
+func validateConfig() error {
+	err := setupAgent(true)
+	if err != nil {
+		return err
+	}
+	// creating the collectors opens the log files of log patterns
+	cs, err := internal.NewCollectors(internal.ExtraCollectors())
+	if err != nil {
+		return err
+	}
+	internal.CloseCollectors(cs)
+	if *metricsListen != "" {
+		_, _, err = net.SplitHostPort(*metricsListen)
+		if err != nil {
+			return fmt.Errorf("invalid metrics listen address: %w", err)
+		}
+	}
+	sinks, err := createSinks(currentLabels(), true)
+	if err != nil {
+		return err
+	}
+	for _, s := range sinks {
+		_ = s.Sink.Close()
+	}
+	return nil
+}
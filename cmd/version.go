@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+)
+
+// build information, injected by build.sh through -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	goVersion = ""
+)
+
+// versionCmd prints the build information
+func versionCmd(fs *flag.FlagSet, args []string) int {
+	if code, ok := parseArgs(fs, args); !ok {
+		return code
+	}
+	gv := goVersion
+	if gv == "" {
+		gv = runtime.Version()
+	}
+	fmt.Printf("sugar-agent %s\ncommit: %s\ngo: %s\nplatform: %s/%s\n", version, commit, gv, runtime.GOOS, runtime.GOARCH)
+	return exitOK
+}
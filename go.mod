@@ -3,8 +3,11 @@ module sugar-agent
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/klauspost/compress v1.16.7
 	github.com/rabbitmq/amqp091-go v1.7.0
 	github.com/shirou/gopsutil/v3 v3.23.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
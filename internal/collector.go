@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// metric types
+const (
+	MetricGauge   = "gauge"
+	MetricCounter = "counter" // monotonic total since the collector started
+	MetricDelta   = "delta"   // count during the last interval, exporters may sum it up into a counter
+)
+
+// Metric is one sample of an additional series, gathered by a Collector alongside cpu, memory, disk and load
+type Metric struct {
+	Name   string            `json:"name"`             // ex: log_pattern_matches
+	Type   string            `json:"type"`             // gauge, counter or delta
+	Unit   string            `json:"unit,omitempty"`   // ex: seconds, bytes
+	Help   string            `json:"help,omitempty"`   // description of the series
+	Labels map[string]string `json:"labels,omitempty"` // ex: {"pattern": "errors"}
+	Value  float64           `json:"value"`
+}
+
+// Collector gathers additional series on the schedule of StartGetPerfDataTask
+type Collector interface {
+	// Collect returns the metrics of the interval since the previous call
+	Collect(ctx context.Context) ([]Metric, error)
+	// Close releases resources held by the collector, ex: open files
+	Close() error
+}
+
+// CollectorFactory creates a collector for one perf task, each task gets its own collector state
+type CollectorFactory func() (Collector, error)
+
+var (
+	collectorsMu sync.RWMutex
+	collectors   = make(map[string]CollectorFactory)
+)
+
+// RegisterCollector registers an additional collector, it panics if the name is registered twice
+// name: collector name, ex: log_patterns
+// factory: CollectorFactory
+// return: none
+func RegisterCollector(name string, factory CollectorFactory) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if _, ok := collectors[name]; ok {
+		panic(fmt.Sprintf("collector %s registered twice", name))
+	}
+	collectors[name] = factory
+}
+
+// ReplaceCollectors replaces all registered additional collectors at once, ex: after a config reload,
+// collectors created before keep working until they are closed
+// factories: collector name -> factory
+// return: none
+func ReplaceCollectors(factories map[string]CollectorFactory) {
+	next := make(map[string]CollectorFactory, len(factories))
+	for name, factory := range factories {
+		next[name] = factory
+	}
+	collectorsMu.Lock()
+	collectors = next
+	collectorsMu.Unlock()
+}
+
+// ExtraCollectors returns the names of the registered additional collectors, sorted
+func ExtraCollectors() []string {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCollectors creates the named additional collectors
+// names: collector names
+// return: collectors, error
+func NewCollectors(names []string) ([]Collector, error) {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	var res []Collector
+	for _, name := range names {
+		factory, ok := collectors[name]
+		if !ok {
+			CloseCollectors(res)
+			return nil, fmt.Errorf("collector %s not available", name)
+		}
+		c, err := factory()
+		if err != nil {
+			CloseCollectors(res)
+			return nil, fmt.Errorf("create collector %s failed: %w", name, err)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// CloseCollectors closes collectors
+func CloseCollectors(cs []Collector) {
+	for _, c := range cs {
+		_ = c.Close()
+	}
+}
+
+// Collectors returns the names of all collectors: cpu, memory, disk, load and the registered additional collectors
+func Collectors() []string {
+	return append([]string{"cpu", "memory", "disk", "load"}, ExtraCollectors()...)
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxProbeBody bytes of the response body kept for the body regex, the rest is only counted
+const maxProbeBody = 1024 * 1024
+
+// HTTPProbe requests an URL on every interval
+type HTTPProbe struct {
+	Name  string         // series name, ex: api_health
+	URL   string         // ex: https://example.com/health
+	Match *regexp.Regexp // optional body regex
+}
+
+// LoadHTTPProbes reads http probes from a file, one probe per line: "<name> <url> [body regex]",
+// the regex is the rest of the line, empty lines and lines starting with # are ignored
+// path: probe file path
+// return: probes, error
+func LoadHTTPProbes(path string) ([]HTTPProbe, error) {
+	var probes []HTTPProbe
+	err := readConfigLines(path, 2, func(fields []string, rest string) error {
+		u, err := url.Parse(fields[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid url of http probe %s", fields[0])
+		}
+		p := HTTPProbe{Name: fields[0], URL: fields[1]}
+		if rest != "" {
+			p.Match, err = regexp.Compile(rest)
+			if err != nil {
+				return fmt.Errorf("invalid regex of http probe %s: %w", fields[0], err)
+			}
+		}
+		probes = append(probes, p)
+		return nil
+	})
+	return probes, err
+}
+
+// NewHTTPProbeFactory returns a factory of collectors probing http endpoints
+// probes: http probes
+// timeout: timeout of one request
+// return: CollectorFactory
+func NewHTTPProbeFactory(probes []HTTPProbe, timeout time.Duration) CollectorFactory {
+	return func() (Collector, error) {
+		return &httpProbeCollector{probes: probes, timeout: timeout}, nil
+	}
+}
+
+// httpProbeCollector requests every probe once per interval
+type httpProbeCollector struct {
+	probes  []HTTPProbe
+	timeout time.Duration
+}
+
+func (c *httpProbeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	var metrics []Metric
+	for _, p := range c.probes {
+		metrics = append(metrics, c.probe(ctx, p)...)
+	}
+	return metrics, nil
+}
+
+func (c *httpProbeCollector) Close() error {
+	return nil
+}
+
+// probe requests one URL, a failed request is reported by http_probe_success=0, the error is logged
+func (c *httpProbeCollector) probe(ctx context.Context, p HTTPProbe) []Metric {
+	labels := map[string]string{"probe": p.Name, "url": p.URL}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var start, dnsStart, dnsDone, connStart, connDone, tlsStart, tlsDone, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { connStart = time.Now() },
+		ConnectDone:          func(string, string, error) { connDone = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, p.URL, nil)
+	if err != nil {
+		return probeFailure("http_probe", labels, err)
+	}
+	req.Header.Set("User-Agent", "sugar-agent")
+	// a new connection per probe, so connect and tls timings are measured every time
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}}
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return probeFailure("http_probe", labels, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	size := int64(len(body))
+	if err == nil {
+		var n int64
+		n, err = io.Copy(io.Discard, resp.Body)
+		size += n
+	}
+	if err != nil {
+		return probeFailure("http_probe", labels, err)
+	}
+	total := time.Since(start)
+
+	metrics := []Metric{
+		probeMetric("http_probe_success", MetricGauge, "", "Whether the probe succeeded", labels, 1),
+		probeMetric("http_probe_status_code", MetricGauge, "", "HTTP status code of the response", labels, float64(resp.StatusCode)),
+		probeMetric("http_probe_response_size_bytes", MetricGauge, "bytes", "Size of the response body", labels, float64(size)),
+	}
+	phases := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"dns", dnsStart, dnsDone},
+		{"connect", connStart, connDone},
+		{"tls", tlsStart, tlsDone},
+		{"first_byte", start, firstByte},
+	}
+	for _, ph := range phases {
+		if ph.start.IsZero() || ph.end.IsZero() {
+			// ex: no dns lookup for an ip address, no tls for http
+			continue
+		}
+		metrics = append(metrics, probeMetric("http_probe_duration_seconds", MetricGauge, "seconds", "Duration of the request phase",
+			withLabel(labels, "phase", ph.name), ph.end.Sub(ph.start).Seconds()))
+	}
+	metrics = append(metrics, probeMetric("http_probe_duration_seconds", MetricGauge, "seconds", "Duration of the request phase",
+		withLabel(labels, "phase", "total"), total.Seconds()))
+	if p.Match != nil {
+		matched := 0.0
+		if p.Match.Match(body) {
+			matched = 1
+		}
+		metrics = append(metrics, probeMetric("http_probe_body_match", MetricGauge, "", "Whether the response body matches the regex", labels, matched))
+	}
+	return metrics
+}
+
+// reasons of failed probes, a small fixed set, the error itself holds addresses and timings and is only logged
+const (
+	reasonTimeout  = "timeout"
+	reasonRefused  = "refused"
+	reasonNXDomain = "nxdomain"
+	reasonDNS      = "dns"
+	reasonTLS      = "tls"
+	reasonStatus   = "status"
+	reasonOther    = "other"
+)
+
+// errUnexpectedStatus a response with a status the probe does not accept
+var errUnexpectedStatus = errors.New("unexpected status")
+
+// probeFailure logs the error and returns the <prefix>_success=0 metric with the labels of the succeeding probe,
+// followed by <prefix>_failure_reason=1 with the reason label
+func probeFailure(prefix string, labels map[string]string, err error) []Metric {
+	log.Printf("[warn] Probe failed -> %s %v: %s", prefix, labels, err)
+	return []Metric{
+		probeMetric(prefix+"_success", MetricGauge, "", "Whether the probe succeeded", labels, 0),
+		probeMetric(prefix+"_failure_reason", MetricGauge, "", "Reason of the failed probe", withLabel(labels, "reason", failureReason(err)), 1),
+	}
+}
+
+// failureReason classifies the error of a probe
+// ex: timeout, refused, nxdomain, dns, tls, status or other
+func failureReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var tlsErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return reasonTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsNotFound {
+			return reasonNXDomain
+		}
+		return reasonDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonRefused
+	case errors.As(err, &tlsErr) || errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr):
+		return reasonTLS
+	case errors.Is(err, errUnexpectedStatus):
+		return reasonStatus
+	}
+	return reasonOther
+}
+
+func probeMetric(name string, typ string, unit string, help string, labels map[string]string, value float64) Metric {
+	return Metric{Name: name, Type: typ, Unit: unit, Help: help, Labels: labels, Value: value}
+}
+
+// withLabel returns a copy of labels with key set to value
+func withLabel(labels map[string]string, key string, value string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[key] = value
+	return res
+}
+
+// readConfigLines reads a whitespace separated config file, empty lines and lines starting with # are ignored
+// path: file path
+// minFields: min number of fields of a line
+// fn: called with the first minFields fields and the rest of the line
+// return: error
+func readConfigLines(path string, minFields int, fn func(fields []string, rest string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < minFields {
+			return fmt.Errorf("%s:%d: expect at least %d fields", path, lineNo, minFields)
+		}
+		rest := line
+		for _, field := range fields[:minFields] {
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, field))
+		}
+		err = fn(fields[:minFields], rest)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
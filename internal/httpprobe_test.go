@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// findMetric returns the first metric with the name and, when phase is set, the phase label
+func findMetric(metrics []Metric, name string, phase string) (Metric, bool) {
+	for _, m := range metrics {
+		if m.Name == name && (phase == "" || m.Labels["phase"] == phase) {
+			return m, true
+		}
+	}
+	return Metric{}, false
+}
+
+func TestHTTPProbe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("status: healthy"))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		match      string
+		statusCode float64
+		size       float64
+		bodyMatch  float64 // -1 when no regex is set
+	}{
+		{"ok with matching body", "/health", "healthy", 200, float64(len("status: healthy")), 1},
+		{"ok with body not matching", "/health", "^down", 200, float64(len("status: healthy")), 0},
+		{"not found", "/missing", "", 404, float64(len("gone\n")), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := HTTPProbe{Name: "api", URL: srv.URL + tt.path}
+			if tt.match != "" {
+				p.Match = regexp.MustCompile(tt.match)
+			}
+			c := &httpProbeCollector{probes: []HTTPProbe{p}, timeout: time.Second}
+			metrics, err := c.Collect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]float64{
+				"http_probe_success":             1,
+				"http_probe_status_code":         tt.statusCode,
+				"http_probe_response_size_bytes": tt.size,
+			}
+			if tt.bodyMatch >= 0 {
+				want["http_probe_body_match"] = tt.bodyMatch
+			}
+			for name, val := range want {
+				m, ok := findMetric(metrics, name, "")
+				if !ok {
+					t.Fatalf("metric %s missing in %+v", name, metrics)
+				}
+				if m.Value != val {
+					t.Errorf("%s = %v, want %v", name, m.Value, val)
+				}
+				if m.Labels["probe"] != "api" || m.Labels["url"] != p.URL {
+					t.Errorf("%s labels = %v", name, m.Labels)
+				}
+			}
+			if _, ok := findMetric(metrics, "http_probe_body_match", ""); ok != (tt.bodyMatch >= 0) {
+				t.Errorf("http_probe_body_match present = %t, want %t", ok, tt.bodyMatch >= 0)
+			}
+			for _, phase := range []string{"connect", "first_byte", "total"} {
+				if _, ok := findMetric(metrics, "http_probe_duration_seconds", phase); !ok {
+					t.Errorf("duration of phase %s missing", phase)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPProbeFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		reason string
+	}{
+		{"timeout", srv.URL, reasonTimeout},
+		{"connection refused", closed.URL, reasonRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &httpProbeCollector{probes: []HTTPProbe{{Name: "api", URL: tt.url}}, timeout: 100 * time.Millisecond}
+			metrics, err := c.Collect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != 2 {
+				t.Fatalf("metrics = %+v, want http_probe_success and http_probe_failure_reason", metrics)
+			}
+			m := metrics[0]
+			if m.Name != "http_probe_success" || m.Value != 0 {
+				t.Fatalf("metric = %+v, want http_probe_success 0", m)
+			}
+			// the same series as a succeeding probe, the error is only logged
+			if want := map[string]string{"probe": "api", "url": tt.url}; !reflect.DeepEqual(m.Labels, want) {
+				t.Fatalf("labels = %v, want %v", m.Labels, want)
+			}
+			m = metrics[1]
+			want := map[string]string{"probe": "api", "url": tt.url, "reason": tt.reason}
+			if m.Name != "http_probe_failure_reason" || m.Value != 1 || !reflect.DeepEqual(m.Labels, want) {
+				t.Fatalf("metric = %+v, want http_probe_failure_reason 1 with labels %v", m, want)
+			}
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"deadline", fmt.Errorf("get: %w", context.DeadlineExceeded), reasonTimeout},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, reasonTimeout},
+		{"nxdomain", &net.DNSError{Err: "no such host", IsNotFound: true}, reasonNXDomain},
+		{"servfail", &net.DNSError{Err: "server misbehaving"}, reasonDNS},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, reasonRefused},
+		{"unknown authority", &url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, reasonTLS},
+		{"hostname", x509.HostnameError{Host: "example.com", Certificate: &x509.Certificate{}}, reasonTLS},
+		{"status", fmt.Errorf("%w 503 Service Unavailable", errUnexpectedStatus), reasonStatus},
+		{"other", errors.New("exposition larger than 1 bytes"), reasonOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Fatalf("failureReason(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+const (
+	dmiDir       = "/sys/class/dmi/id"
+	dmiTableFile = "/sys/firmware/dmi/tables/DMI"
+	dpkgStatus   = "/var/lib/dpkg/status"
+)
+
+type DMIInfo struct {
+	SysVendor      string `json:"sysVendor"`      // ex: Dell Inc.
+	ProductName    string `json:"productName"`    // ex: PowerEdge R740
+	ProductVersion string `json:"productVersion"` // product version
+	ProductSerial  string `json:"productSerial"`  // serial number, readable by root only
+	ProductUUID    string `json:"productUuid"`    // system uuid, readable by root only
+	BoardVendor    string `json:"boardVendor"`    // mainboard vendor
+	BoardName      string `json:"boardName"`      // mainboard name
+	BiosVendor     string `json:"biosVendor"`     // bios vendor
+	BiosVersion    string `json:"biosVersion"`    // bios version
+	BiosDate       string `json:"biosDate"`       // bios release date
+}
+
+type MemoryInventory struct {
+	Total     float64 `json:"total"`     // memory size seen by the OS in GB
+	DimmTotal float64 `json:"dimmTotal"` // total size of installed DIMMs in GB, 0 if unknown (needs root)
+	DimmCount int     `json:"dimmCount"` // number of installed DIMMs
+}
+
+type BlockDevice struct {
+	Name       string  `json:"name"`       // ex: sda, nvme0n1
+	Model      string  `json:"model"`      // device model
+	Vendor     string  `json:"vendor"`     // device vendor
+	Serial     string  `json:"serial"`     // serial number if available
+	Size       float64 `json:"size"`       // size in GB
+	Rotational bool    `json:"rotational"` // true for spinning disks
+	Removable  bool    `json:"removable"`  // true for removable media
+}
+
+type NetInterface struct {
+	Name  string   `json:"name"`  // ex: eth0
+	MAC   string   `json:"mac"`   // hardware address
+	MTU   int      `json:"mtu"`   // maximum transmission unit
+	Speed int      `json:"speed"` // link speed in Mb/s, -1 if unknown or link down
+	Flags []string `json:"flags"` // ex: up, broadcast, multicast
+	Addrs []string `json:"addrs"` // ip addresses in CIDR notation
+}
+
+type Filesystem struct {
+	Device      string   `json:"device"`      // ex: /dev/sda1
+	Mountpoint  string   `json:"mountpoint"`  // ex: /
+	Fstype      string   `json:"fstype"`      // ex: ext4
+	Opts        []string `json:"opts"`        // mount options
+	Total       float64  `json:"total"`       // total size in GB
+	UsedPercent float64  `json:"usedPercent"` // used size in percent
+}
+
+type Timezone struct {
+	Name   string `json:"name"`   // ex: Asia/Shanghai, falls back to the abbreviation
+	Offset int    `json:"offset"` // offset from UTC in seconds
+}
+
+type Virtualization struct {
+	System    string `json:"system"`    // ex: kvm, vmware, docker, empty on bare metal
+	Role      string `json:"role"`      // guest or host
+	Container string `json:"container"` // container runtime if the agent runs in a container
+}
+
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+}
+
+type Inventory struct {
+	HostInfo       HostInfo        `json:"hostInfo"`
+	CpuInfo        CpuInfo         `json:"cpuInfo"`
+	DMI            DMIInfo         `json:"dmi"`
+	Memory         MemoryInventory `json:"memory"`
+	BlockDevices   []BlockDevice   `json:"blockDevices"`
+	NetInterfaces  []NetInterface  `json:"netInterfaces"`
+	Filesystems    []Filesystem    `json:"filesystems"`
+	KernelCmdline  string          `json:"kernelCmdline"`
+	Timezone       Timezone        `json:"timezone"`
+	Virtualization Virtualization  `json:"virtualization"`
+	PackageManager string          `json:"packageManager"` // dpkg or rpm, empty if none found
+	Packages       []Package       `json:"packages"`
+	Warnings       []string        `json:"warnings"` // parts of the inventory which could not be collected
+}
+
+// GetInventory returns a static inventory snapshot of the host
+// ctx: context
+// withPackages: include the installed package list
+// return: Inventory
+func GetInventory(ctx context.Context, withPackages bool) (*Inventory, error) {
+	properties, err := GetProperties()
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{
+		HostInfo: properties.HostInfo,
+		CpuInfo:  properties.CpuInfo,
+		DMI:      getDMIInfo(),
+	}
+	warn := func(part string, err error) {
+		if err != nil {
+			inv.Warnings = append(inv.Warnings, fmt.Sprintf("%s: %s", part, err))
+		}
+	}
+
+	inv.Memory, err = getMemoryInventory()
+	warn("memory", err)
+	inv.BlockDevices, err = getBlockDevices()
+	warn("block devices", err)
+	inv.NetInterfaces, err = getNetInterfaces(ctx)
+	warn("net interfaces", err)
+	inv.Filesystems, err = getFilesystems(ctx)
+	warn("filesystems", err)
+	inv.KernelCmdline = readSysFile("/proc/cmdline")
+	inv.Timezone = getTimezone()
+	inv.Virtualization, err = getVirtualization(ctx)
+	warn("virtualization", err)
+	if withPackages {
+		inv.PackageManager, inv.Packages, err = getPackages(ctx)
+		warn("packages", err)
+	}
+	return inv, ctx.Err()
+}
+
+// getDMIInfo reads DMI data from sysfs, unreadable entries are left empty
+func getDMIInfo() DMIInfo {
+	read := func(name string) string {
+		return readSysFile(filepath.Join(dmiDir, name))
+	}
+	return DMIInfo{
+		SysVendor:      read("sys_vendor"),
+		ProductName:    read("product_name"),
+		ProductVersion: read("product_version"),
+		ProductSerial:  read("product_serial"),
+		ProductUUID:    read("product_uuid"),
+		BoardVendor:    read("board_vendor"),
+		BoardName:      read("board_name"),
+		BiosVendor:     read("bios_vendor"),
+		BiosVersion:    read("bios_version"),
+		BiosDate:       read("bios_date"),
+	}
+}
+
+// getMemoryInventory returns the memory size seen by the OS and the installed DIMMs
+func getMemoryInventory() (MemoryInventory, error) {
+	var m MemoryInventory
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return m, err
+	}
+	m.Total = humanizeGB(float64(vm.Total))
+	dimmBytes, count, err := getDimmTotal()
+	if err != nil {
+		return m, err
+	}
+	m.DimmTotal = humanizeGB(float64(dimmBytes))
+	m.DimmCount = count
+	return m, nil
+}
+
+// getDimmTotal sums the size of "Memory Device" (type 17) structures in the SMBIOS table
+// return: total bytes, number of installed DIMMs, error
+func getDimmTotal() (uint64, int, error) {
+	table, err := os.ReadFile(dmiTableFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total uint64
+	count := 0
+	for i := 0; i+4 <= len(table); {
+		typ, length := table[i], int(table[i+1])
+		if length < 4 || i+length > len(table) {
+			break
+		}
+		if typ == 17 && length >= 0x0E {
+			size := binary.LittleEndian.Uint16(table[i+0x0C:])
+			switch {
+			case size == 0 || size == 0xFFFF:
+				// no module installed or size unknown
+			case size == 0x7FFF && length >= 0x20:
+				total += uint64(binary.LittleEndian.Uint32(table[i+0x1C:])&0x7FFFFFFF) << 20
+				count++
+			case size&0x8000 != 0:
+				total += uint64(size&0x7FFF) << 10
+				count++
+			default:
+				total += uint64(size) << 20
+				count++
+			}
+		}
+		if typ == 127 {
+			// end of table
+			break
+		}
+		// skip the formatted area and the string set, which ends with two zero bytes
+		j := i + length
+		for j+1 < len(table) && (table[j] != 0 || table[j+1] != 0) {
+			j++
+		}
+		i = j + 2
+	}
+	return total, count, nil
+}
+
+// getBlockDevices lists disks from /sys/block, skipping loop, ram, zram and device-mapper devices
+func getBlockDevices() ([]BlockDevice, error) {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	var devices []BlockDevice
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") ||
+			strings.HasPrefix(name, "dm-") {
+			continue
+		}
+		dir := filepath.Join("/sys/block", name)
+		sectors, _ := strconv.ParseUint(readSysFile(filepath.Join(dir, "size")), 10, 64)
+		serial := readSysFile(filepath.Join(dir, "device", "serial"))
+		if serial == "" {
+			serial, _ = disk.SerialNumber("/dev/" + name)
+		}
+		devices = append(devices, BlockDevice{
+			Name:   name,
+			Model:  readSysFile(filepath.Join(dir, "device", "model")),
+			Vendor: readSysFile(filepath.Join(dir, "device", "vendor")),
+			Serial: serial,
+			// sysfs always counts 512 bytes sectors
+			Size:       humanizeGB(float64(sectors * 512)),
+			Rotational: readSysFile(filepath.Join(dir, "queue", "rotational")) == "1",
+			Removable:  readSysFile(filepath.Join(dir, "removable")) == "1",
+		})
+	}
+	return devices, nil
+}
+
+// getNetInterfaces lists network interfaces with their link speed
+func getNetInterfaces(ctx context.Context) ([]NetInterface, error) {
+	ifaces, err := net.InterfacesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []NetInterface
+	for _, iface := range ifaces {
+		speed, err := strconv.Atoi(readSysFile(filepath.Join("/sys/class/net", iface.Name, "speed")))
+		if err != nil {
+			speed = -1
+		}
+		addrs := make([]string, 0, len(iface.Addrs))
+		for _, a := range iface.Addrs {
+			addrs = append(addrs, a.Addr)
+		}
+		res = append(res, NetInterface{
+			Name:  iface.Name,
+			MAC:   iface.HardwareAddr,
+			MTU:   iface.MTU,
+			Speed: speed,
+			Flags: iface.Flags,
+			Addrs: addrs,
+		})
+	}
+	return res, nil
+}
+
+// getFilesystems lists mounted physical filesystems
+func getFilesystems(ctx context.Context) ([]Filesystem, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var res []Filesystem
+	for _, p := range partitions {
+		fs := Filesystem{
+			Device:     p.Device,
+			Mountpoint: p.Mountpoint,
+			Fstype:     p.Fstype,
+			Opts:       p.Opts,
+		}
+		if usage, err := disk.UsageWithContext(ctx, p.Mountpoint); err == nil {
+			fs.Total = humanizeGB(float64(usage.Total))
+			fs.UsedPercent = humanizePercent(usage.UsedPercent)
+		}
+		res = append(res, fs)
+	}
+	return res, nil
+}
+
+// getTimezone returns the local timezone name and offset
+func getTimezone() Timezone {
+	abbr, offset := time.Now().Zone()
+	name := readSysFile("/etc/timezone")
+	if name == "" {
+		// /etc/localtime -> /usr/share/zoneinfo/Asia/Shanghai
+		if target, err := os.Readlink("/etc/localtime"); err == nil {
+			if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+				name = target[i+len("zoneinfo/"):]
+			}
+		}
+	}
+	if name == "" {
+		name = abbr
+	}
+	return Timezone{Name: name, Offset: offset}
+}
+
+// getVirtualization detects the hypervisor and whether the agent runs in a container
+func getVirtualization(ctx context.Context) (Virtualization, error) {
+	var v Virtualization
+	system, role, err := host.VirtualizationWithContext(ctx)
+	if err != nil {
+		return v, err
+	}
+	v.System, v.Role = system, role
+	v.Container = detectContainer()
+	return v, nil
+}
+
+// detectContainer returns the container runtime the agent runs in, empty if none
+func detectContainer() string {
+	if c := os.Getenv("container"); c != "" {
+		// set by systemd-nspawn, podman and lxc
+		return c
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	cgroup := readSysFile("/proc/1/cgroup")
+	for _, runtime := range []string{"kubepods", "docker", "containerd", "lxc"} {
+		if strings.Contains(cgroup, runtime) {
+			return runtime
+		}
+	}
+	return ""
+}
+
+// getPackages lists installed packages from the dpkg status database or the rpm database
+// return: package manager, packages, error
+func getPackages(ctx context.Context) (string, []Package, error) {
+	if _, err := os.Stat(dpkgStatus); err == nil {
+		pkgs, err := getDpkgPackages()
+		return "dpkg", pkgs, err
+	}
+	if _, err := exec.LookPath("rpm"); err == nil {
+		pkgs, err := getRpmPackages(ctx)
+		return "rpm", pkgs, err
+	}
+	return "", nil, nil
+}
+
+// getDpkgPackages parses /var/lib/dpkg/status
+func getDpkgPackages() ([]Package, error) {
+	f, err := os.Open(dpkgStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pkgs []Package
+	var cur Package
+	installed := false
+	flush := func() {
+		if installed && cur.Name != "" {
+			pkgs = append(pkgs, cur)
+		}
+		cur, installed = Package{}, false
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, val, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Package":
+			cur.Name = val
+		case "Version":
+			cur.Version = val
+		case "Architecture":
+			cur.Arch = val
+		case "Status":
+			installed = strings.HasSuffix(val, " installed")
+		}
+	}
+	flush()
+	return pkgs, scanner.Err()
+}
+
+// getRpmPackages queries the rpm database, its format (BerkeleyDB or sqlite) is only readable through rpm itself
+func getRpmPackages(ctx context.Context) ([]Package, error) {
+	out, err := exec.CommandContext(ctx, "rpm", "-qa", "--queryformat", "%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\n").Output()
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: fields[0], Version: fields[1], Arch: fields[2]})
+	}
+	return pkgs, nil
+}
+
+// readSysFile reads a small text file and trims it, returns empty string on error
+func readSysFile(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
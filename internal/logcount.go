@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// LogPattern counts lines of a log file matching a regex
+type LogPattern struct {
+	Name  string         // series name, ex: nginx_5xx
+	File  string         // log file path
+	Regex *regexp.Regexp // pattern to count
+}
+
+// LoadLogPatterns reads log patterns from a file, one pattern per line: "<name> <file> <regex>",
+// the regex is the rest of the line, empty lines and lines starting with # are ignored
+// path: pattern file path
+// return: patterns, error
+func LoadLogPatterns(path string) ([]LogPattern, error) {
+	var patterns []LogPattern
+	names := make(map[string]bool)
+	err := readConfigLines(path, 2, func(fields []string, rest string) error {
+		re, err := regexp.Compile(rest)
+		if err != nil || rest == "" {
+			return fmt.Errorf("invalid regex of log pattern %s", fields[0])
+		}
+		// matches are counted by name, two patterns of a name would be merged into one series
+		if names[fields[0]] {
+			return fmt.Errorf("duplicate log pattern %s", fields[0])
+		}
+		names[fields[0]] = true
+		patterns = append(patterns, LogPattern{Name: fields[0], File: fields[1], Regex: re})
+		return nil
+	})
+	return patterns, err
+}
+
+// NewLogPatternFactory returns a factory of collectors counting log pattern matches
+// patterns: log patterns
+// return: CollectorFactory
+func NewLogPatternFactory(patterns []LogPattern) CollectorFactory {
+	return func() (Collector, error) {
+		c := &logPatternCollector{tails: make(map[string]*logTail)}
+		for _, p := range patterns {
+			if _, ok := c.tails[p.File]; ok {
+				continue
+			}
+			// start at the end of the file, lines written before the task are not counted
+			t, err := newLogTail(p.File)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.tails[p.File] = t
+		}
+		c.patterns = patterns
+		return c, nil
+	}
+}
+
+// logPatternCollector tails log files and counts matching lines per interval
+type logPatternCollector struct {
+	patterns []LogPattern
+	tails    map[string]*logTail // file -> tail
+}
+
+func (c *logPatternCollector) Collect(ctx context.Context) ([]Metric, error) {
+	counts := make(map[string]uint64) // pattern name -> matches
+	var errs []string
+	for file, t := range c.tails {
+		err := t.readNew(func(line []byte) {
+			for _, p := range c.patterns {
+				if p.File == file && p.Regex.Match(line) {
+					counts[p.Name]++
+				}
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", file, err))
+		}
+	}
+	metrics := make([]Metric, 0, len(c.patterns))
+	for _, p := range c.patterns {
+		metrics = append(metrics, Metric{
+			Name:   "log_pattern_matches",
+			Type:   MetricDelta,
+			Help:   "Lines of the log file matching the pattern during the last interval",
+			Labels: map[string]string{"pattern": p.Name, "file": p.File},
+			Value:  float64(counts[p.Name]),
+		})
+	}
+	if len(errs) > 0 {
+		return metrics, errors.New(strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+func (c *logPatternCollector) Close() error {
+	for _, t := range c.tails {
+		t.close()
+	}
+	return nil
+}
+
+// maxTailLine bytes kept of a line, the rest of a longer line is dropped, so a file without line breaks
+// does not grow the incomplete last line without bound
+const maxTailLine = 64 * 1024
+
+// logTail follows a log file across rotation (inode change) and truncation
+type logTail struct {
+	path   string
+	file   *os.File
+	offset int64
+	info   os.FileInfo
+	rest   []byte // incomplete last line, at most maxTailLine bytes
+}
+
+// newLogTail opens a log file positioned at its end, a missing file is opened once it appears
+func newLogTail(path string) (*logTail, error) {
+	t := &logTail{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.file, t.info, t.offset = f, info, info.Size()
+	return t, nil
+}
+
+// readNew calls fn for every complete line written since the previous call
+func (t *logTail) readNew(fn func(line []byte)) error {
+	info, err := os.Stat(t.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if t.file != nil && (info == nil || !os.SameFile(info, t.info)) {
+		// rotated: drain what was written to the old file before switching
+		err = t.drain(fn)
+		t.close()
+		if err != nil {
+			return err
+		}
+	}
+	if info == nil {
+		return nil
+	}
+	if t.file == nil {
+		// a new file after rotation is read from its start
+		t.file, err = os.Open(t.path)
+		if err != nil {
+			return err
+		}
+		t.info, t.offset = info, 0
+	}
+	if info.Size() < t.offset {
+		// truncated in place (copytruncate)
+		t.offset, t.rest = 0, nil
+	}
+	return t.drain(fn)
+}
+
+// drain reads the file from the current offset to its end
+func (t *logTail) drain(fn func(line []byte)) error {
+	_, err := t.file.Seek(t.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(t.file, maxTailLine)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		t.offset += int64(len(chunk))
+		if room := maxTailLine - len(t.rest); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			t.rest = append(t.rest, chunk...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(bytes.TrimSuffix(t.rest, []byte("\n")))
+		t.rest = t.rest[:0]
+	}
+}
+
+func (t *logTail) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.info, t.rest = nil, nil, nil
+}
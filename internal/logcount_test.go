@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLoadLogPatternsRejectsDuplicates(t *testing.T) {
+	path := writeTestFile(t, "errors /var/log/a.log ERROR\nerrors /var/log/b.log ERROR\n")
+	if _, err := LoadLogPatterns(path); err == nil || !strings.Contains(err.Error(), "duplicate log pattern errors") {
+		t.Fatalf("LoadLogPatterns() error = %v, want duplicate", err)
+	}
+	patterns, err := LoadLogPatterns(writeTestFile(t, "a_errors /var/log/a.log ERROR\nb_errors /var/log/b.log ERROR\n"))
+	if err != nil || len(patterns) != 2 {
+		t.Fatalf("LoadLogPatterns() = %+v, %v", patterns, err)
+	}
+}
+
+func TestLogPatternLongLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("before the task ERROR\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	collect := func(c Collector) float64 {
+		t.Helper()
+		metrics, err := c.Collect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metrics[0].Value
+	}
+	c, err := NewLogPatternFactory([]LogPattern{{Name: "errors", File: path, Regex: regexp.MustCompile("ERROR")}})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// a line without line break is kept up to maxTailLine bytes while it grows
+	for i := 0; i < 4; i++ {
+		if _, err := f.WriteString("ERROR " + strings.Repeat("x", maxTailLine)); err != nil {
+			t.Fatal(err)
+		}
+		if n := collect(c); n != 0 {
+			t.Fatalf("matches of an incomplete line = %v", n)
+		}
+		if l := len(c.(*logPatternCollector).tails[path].rest); l > maxTailLine {
+			t.Fatalf("incomplete line holds %d bytes, want at most %d", l, maxTailLine)
+		}
+	}
+	if _, err := f.WriteString(" end\nok\nERROR again\n"); err != nil {
+		t.Fatal(err)
+	}
+	if n := collect(c); n != 2 {
+		t.Fatalf("matches = %v, want 2", n)
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// log timestamp layouts tried by ParseLogTime, matched against the start of a line
+var logTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"02/Jan/2006:15:04:05 -0700", // nginx/apache access log, after "["
+	time.Stamp,                   // syslog: Jan _2 15:04:05
+}
+
+// OpenLog opens a log file, gzip compressed files (*.gz) are decompressed transparently
+// path: log file path
+// return: io.ReadCloser, error
+func OpenLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// IsRotationSuffix returns whether suffix is appended by log rotation: .N or -YYYYMMDD (logrotate dateext, also
+// with the hour), optionally followed by .gz
+// ex: .1, .2.gz, -20230311, -2023031115.gz, not .key or -secrets
+func IsRotationSuffix(suffix string) bool {
+	suffix = strings.TrimSuffix(suffix, ".gz")
+	if len(suffix) < 2 || !isDigits(suffix[1:]) {
+		return false
+	}
+	switch suffix[0] {
+	case '.':
+		return true
+	case '-':
+		return len(suffix) == 9 || len(suffix) == 11
+	}
+	return false
+}
+
+// isDigits returns whether s consists of ASCII digits only
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// RotatedFiles returns the rotated versions of a log file, oldest first, symlinks are skipped
+// ex: app.log.2.gz, app.log.1, app.log-20230311 for app.log
+// path: log file path
+// return: rotated file paths
+func RotatedFiles(path string) []string {
+	var files []string
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			if IsRotationSuffix(m[len(path):]) {
+				files = append(files, m)
+			}
+		}
+	}
+	type rotated struct {
+		path    string
+		modTime time.Time
+	}
+	var res []rotated
+	for _, f := range files {
+		// Lstat, a link like app.log.1 -> /etc/shadow is not a rotated log
+		info, err := os.Lstat(f)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		res = append(res, rotated{f, info.ModTime()})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].modTime.Before(res[j].modTime) })
+	paths := make([]string, 0, len(res))
+	for _, r := range res {
+		paths = append(paths, r.path)
+	}
+	return paths
+}
+
+// ParseLogTime parses the timestamp at the start of a log line
+// line: log line
+// now: used to complete timestamps without a year (syslog)
+// return: timestamp, ok
+func ParseLogTime(line string, now time.Time) (time.Time, bool) {
+	line = strings.TrimLeft(line, "[")
+	// access logs have the timestamp after the client address: 1.2.3.4 - - [02/Jan/2006:15:04:05 -0700]
+	if i := strings.Index(line, " ["); i >= 0 && i < 64 {
+		if t, err := time.Parse(logTimeLayouts[5], prefix(line[i+2:], len(logTimeLayouts[5]))); err == nil {
+			return t, true
+		}
+	}
+	for _, layout := range logTimeLayouts {
+		n := len(layout)
+		if layout == time.RFC3339Nano {
+			// fraction and zone have a variable length
+			n = strings.IndexByte(line, ' ')
+			if n < 0 {
+				n = len(line)
+			}
+		}
+		t, err := time.ParseInLocation(layout, prefix(line, n), time.Local)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				// a December line read in January
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func prefix(s string, n int) string {
+	if len(s) < n {
+		return s
+	}
+	return s[:n]
+}
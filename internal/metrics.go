@@ -0,0 +1,77 @@
+package internal
+
+import "time"
+
+// bytesPerGB the sizes of DynamicDataSummary are in GB, see humanizeGB
+const bytesPerGB = 1024 * 1024 * 1024
+
+// memoryBytes the memory sizes in bytes
+type memoryBytes struct {
+	total, available, used, free, cached float64
+}
+
+// diskBytes the disk sizes in bytes
+type diskBytes struct {
+	total, free, used float64
+}
+
+// bytes returns the exact sizes of the sample, or the rounded GB values converted back when the sample was decoded
+// from JSON
+func (m MemoryInfo) bytes() memoryBytes {
+	if m.stat != nil {
+		return memoryBytes{float64(m.stat.Total), float64(m.stat.Available), float64(m.stat.Used), float64(m.stat.Free),
+			float64(m.stat.Cached)}
+	}
+	return memoryBytes{m.Total * bytesPerGB, m.Available * bytesPerGB, m.Used * bytesPerGB, m.Free * bytesPerGB,
+		m.Cached * bytesPerGB}
+}
+
+// bytes returns the exact sizes of the sample, or the rounded GB values converted back when the sample was decoded
+// from JSON
+func (d DiskInfo) bytes() diskBytes {
+	if d.usage != nil {
+		return diskBytes{float64(d.usage.Total), float64(d.usage.Free), float64(d.usage.Used)}
+	}
+	return diskBytes{d.Total * bytesPerGB, d.Free * bytesPerGB, d.Used * bytesPerGB}
+}
+
+// summaryTimeLayout layout of DynamicDataSummary.TimeStamp
+const summaryTimeLayout = "2006-01-02 15:04:05"
+
+// SummaryMetrics converts a sample of cpu, memory, disk and load into metrics, followed by the additional metrics,
+// sizes are in bytes
+// s: DynamicDataSummary
+// return: metrics
+func SummaryMetrics(s DynamicDataSummary) []Metric {
+	gauge := func(name string, unit string, help string, value float64) Metric {
+		return Metric{Name: name, Type: MetricGauge, Unit: unit, Help: help, Value: value}
+	}
+	mem, disk := s.MemInfo.bytes(), s.DiskInfo.bytes()
+	metrics := []Metric{
+		gauge("cpu_usage_percent", "percent", "CPU usage of all cores", s.CpuPercent),
+		gauge("memory_total_bytes", "bytes", "Total memory", mem.total),
+		gauge("memory_available_bytes", "bytes", "Memory available for new processes", mem.available),
+		gauge("memory_used_bytes", "bytes", "Used memory", mem.used),
+		gauge("memory_free_bytes", "bytes", "Free memory", mem.free),
+		gauge("memory_cached_bytes", "bytes", "Memory used by the page cache", mem.cached),
+		gauge("memory_used_percent", "percent", "Used memory in percent", s.MemInfo.UsedPercent),
+		gauge("disk_total_bytes", "bytes", "Total size of the root filesystem", disk.total),
+		gauge("disk_free_bytes", "bytes", "Free size of the root filesystem", disk.free),
+		gauge("disk_used_bytes", "bytes", "Used size of the root filesystem", disk.used),
+		gauge("disk_used_percent", "percent", "Used size of the root filesystem in percent", s.DiskInfo.UsedPercent),
+		gauge("load1", "", "1 minute load average", s.LoadInfo.Load1),
+		gauge("load5", "", "5 minute load average", s.LoadInfo.Load5),
+		gauge("load15", "", "15 minute load average", s.LoadInfo.Load15),
+	}
+	return append(metrics, s.Metrics...)
+}
+
+// Time returns the time the sample was taken, TimeStamp is in local time
+// return: time.Time
+func (s DynamicDataSummary) Time() time.Time {
+	t, err := time.ParseInLocation(summaryTimeLayout, s.TimeStamp, time.Local)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
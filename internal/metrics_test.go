@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+func metricValues(metrics []Metric) map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	return values
+}
+
+func TestSummaryMetricsBytes(t *testing.T) {
+	stat := &mem.VirtualMemoryStat{Total: 8_000_000_123, Available: 5_000_000_456, Used: 3_000_000_789, Free: 1_234_567, Cached: 987_654_321}
+	usage := &disk.UsageStat{Total: 500_000_000_001, Free: 200_000_000_002, Used: 300_000_000_003}
+	s := DynamicDataSummary{
+		MemInfo:  MemoryInfo{Total: humanizeGB(float64(stat.Total)), stat: stat},
+		DiskInfo: DiskInfo{Total: humanizeGB(float64(usage.Total)), usage: usage},
+	}
+	values := metricValues(SummaryMetrics(s))
+	// the exact sizes, not the GB values rounded to 2 decimals
+	want := map[string]uint64{
+		"memory_total_bytes": stat.Total, "memory_available_bytes": stat.Available, "memory_used_bytes": stat.Used,
+		"memory_free_bytes": stat.Free, "memory_cached_bytes": stat.Cached,
+		"disk_total_bytes": usage.Total, "disk_free_bytes": usage.Free, "disk_used_bytes": usage.Used,
+	}
+	for name, val := range want {
+		if values[name] != float64(val) {
+			t.Errorf("%s = %v, want %d", name, values[name], val)
+		}
+	}
+
+	// a sample decoded from the perf data only has the GB values
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DynamicDataSummary
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	values = metricValues(SummaryMetrics(decoded))
+	if got, want := values["memory_total_bytes"], s.MemInfo.Total*bytesPerGB; got != want {
+		t.Errorf("decoded memory_total_bytes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TCPProbe connects to an address on every interval
+type TCPProbe struct {
+	Name    string // series name, ex: mysql
+	Address string // host:port
+}
+
+// DNSProbe resolves a name on every interval
+type DNSProbe struct {
+	Name   string // series name, ex: api_domain
+	Query  string // name to resolve
+	Record string // A, AAAA, CNAME, MX or TXT
+}
+
+// LoadTCPProbes reads tcp probes from a file, one probe per line: "<name> <host:port>"
+// path: probe file path
+// return: probes, error
+func LoadTCPProbes(path string) ([]TCPProbe, error) {
+	var probes []TCPProbe
+	err := readConfigLines(path, 2, func(fields []string, rest string) error {
+		if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+			return fmt.Errorf("invalid address of tcp probe %s: %w", fields[0], err)
+		}
+		probes = append(probes, TCPProbe{Name: fields[0], Address: fields[1]})
+		return nil
+	})
+	return probes, err
+}
+
+// LoadDNSProbes reads dns probes from a file, one probe per line: "<name> <query> [record type]", record type defaults to A
+// path: probe file path
+// return: probes, error
+func LoadDNSProbes(path string) ([]DNSProbe, error) {
+	var probes []DNSProbe
+	err := readConfigLines(path, 2, func(fields []string, rest string) error {
+		record := strings.ToUpper(rest)
+		if record == "" {
+			record = "A"
+		}
+		switch record {
+		case "A", "AAAA", "CNAME", "MX", "TXT":
+		default:
+			return fmt.Errorf("unsupported record type %s of dns probe %s", rest, fields[0])
+		}
+		probes = append(probes, DNSProbe{Name: fields[0], Query: fields[1], Record: record})
+		return nil
+	})
+	return probes, err
+}
+
+// NewTCPProbeFactory returns a factory of collectors probing tcp ports
+// probes: tcp probes
+// timeout: connect timeout
+// return: CollectorFactory
+func NewTCPProbeFactory(probes []TCPProbe, timeout time.Duration) CollectorFactory {
+	return func() (Collector, error) {
+		return &tcpProbeCollector{probes: probes, timeout: timeout}, nil
+	}
+}
+
+// NewDNSProbeFactory returns a factory of collectors probing dns resolution
+// probes: dns probes
+// resolver: resolver address host:port, empty means the system resolver
+// timeout: lookup timeout
+// return: CollectorFactory
+func NewDNSProbeFactory(probes []DNSProbe, resolver string, timeout time.Duration) CollectorFactory {
+	return func() (Collector, error) {
+		c := &dnsProbeCollector{probes: probes, resolverName: "system", timeout: timeout, resolver: net.DefaultResolver,
+			last: make(map[string]string)}
+		if resolver != "" {
+			if _, _, err := net.SplitHostPort(resolver); err != nil {
+				return nil, fmt.Errorf("invalid dns resolver: %w", err)
+			}
+			c.resolverName = resolver
+			c.resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, resolver)
+				},
+			}
+		}
+		return c, nil
+	}
+}
+
+// tcpProbeCollector connects to every address once per interval
+type tcpProbeCollector struct {
+	probes  []TCPProbe
+	timeout time.Duration
+}
+
+func (c *tcpProbeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	var metrics []Metric
+	for _, p := range c.probes {
+		labels := map[string]string{"probe": p.Name, "address": p.Address}
+		d := net.Dialer{Timeout: c.timeout}
+		start := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", p.Address)
+		if err != nil {
+			metrics = append(metrics, probeFailure("tcp_probe", labels, err)...)
+			continue
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+		metrics = append(metrics,
+			probeMetric("tcp_probe_success", MetricGauge, "", "Whether the probe succeeded", labels, 1),
+			probeMetric("tcp_probe_connect_seconds", MetricGauge, "seconds", "Duration of the tcp connect", labels, elapsed.Seconds()),
+		)
+	}
+	return metrics, nil
+}
+
+func (c *tcpProbeCollector) Close() error {
+	return nil
+}
+
+// dnsProbeCollector resolves every query once per interval
+type dnsProbeCollector struct {
+	probes       []DNSProbe
+	resolver     *net.Resolver
+	resolverName string
+	timeout      time.Duration
+	last         map[string]string // probe name -> answers of the previous lookup
+}
+
+func (c *dnsProbeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	var metrics []Metric
+	for _, p := range c.probes {
+		labels := map[string]string{"probe": p.Name, "query": p.Query, "record": p.Record, "resolver": c.resolverName}
+		start := time.Now()
+		answers, err := c.lookup(ctx, p)
+		if err != nil {
+			metrics = append(metrics, probeFailure("dns_probe", labels, err)...)
+			continue
+		}
+		elapsed := time.Since(start)
+		// the answers are no label, round-robin and CDN records change on every lookup
+		sort.Strings(answers)
+		joined := strings.Join(answers, "\n")
+		changed := 0.0
+		if prev, ok := c.last[p.Name]; ok && prev != joined {
+			changed = 1
+		}
+		c.last[p.Name] = joined
+		metrics = append(metrics,
+			probeMetric("dns_probe_success", MetricGauge, "", "Whether the probe succeeded", labels, 1),
+			probeMetric("dns_probe_lookup_seconds", MetricGauge, "seconds", "Duration of the dns lookup", labels, elapsed.Seconds()),
+			probeMetric("dns_probe_answers", MetricGauge, "", "Number of answers", labels, float64(len(answers))),
+			probeMetric("dns_probe_answers_changed", MetricGauge, "", "Whether the answers differ from the previous successful lookup",
+				labels, changed),
+		)
+	}
+	return metrics, nil
+}
+
+func (c *dnsProbeCollector) Close() error {
+	return nil
+}
+
+// lookup resolves one query with the record type of the probe
+func (c *dnsProbeCollector) lookup(ctx context.Context, p DNSProbe) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	switch p.Record {
+	case "A", "AAAA":
+		network := "ip4"
+		if p.Record == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := c.resolver.LookupIP(ctx, network, p.Query)
+		if err != nil {
+			return nil, err
+		}
+		answers := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+		return answers, nil
+	case "CNAME":
+		cname, err := c.resolver.LookupCNAME(ctx, p.Query)
+		if err != nil {
+			return nil, err
+		}
+		return []string{cname}, nil
+	case "MX":
+		mxs, err := c.resolver.LookupMX(ctx, p.Query)
+		if err != nil {
+			return nil, err
+		}
+		answers := make([]string, 0, len(mxs))
+		for _, mx := range mxs {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+		return answers, nil
+	case "TXT":
+		return c.resolver.LookupTXT(ctx, p.Query)
+	}
+	return nil, fmt.Errorf("unsupported record type %s", p.Record)
+}
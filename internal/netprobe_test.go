@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTCPProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	probes := []TCPProbe{{Name: "open", Address: ln.Addr().String()}, {Name: "closed", Address: closed.Addr().String()}}
+	c, err := NewTCPProbeFactory(probes, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	success := make(map[string]float64)
+	for _, m := range metrics {
+		p := m.Labels["probe"]
+		want := map[string]string{"probe": p, "address": m.Labels["address"]}
+		if m.Name == "tcp_probe_failure_reason" {
+			want["reason"] = reasonRefused
+		}
+		if !reflect.DeepEqual(m.Labels, want) {
+			t.Errorf("%s labels = %v", m.Name, m.Labels)
+		}
+		if m.Name == "tcp_probe_success" {
+			success[p] = m.Value
+		}
+		if m.Name == "tcp_probe_connect_seconds" && p != "open" {
+			t.Errorf("connect duration of failed probe %s", p)
+		}
+	}
+	if !reflect.DeepEqual(success, map[string]float64{"open": 1, "closed": 0}) {
+		t.Fatalf("tcp_probe_success = %v", success)
+	}
+	if len(metrics) != 4 {
+		t.Fatalf("metrics = %+v, want 4", metrics)
+	}
+}
+
+// fakeDNSServer answers A queries with the next answer set of answers on every query, other queries with NXDOMAIN
+func fakeDNSServer(t *testing.T, answers ...[]net.IP) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		n := 0
+		for {
+			size, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:size]
+			// header, then the question: name, type, class
+			end := 12
+			for end < len(query) && query[end] != 0 {
+				end += int(query[end]) + 1
+			}
+			end += 5
+			if end > len(query) {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			resp := append([]byte(nil), query[:end]...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion desired and available
+			binary.BigEndian.PutUint16(resp[6:], 0)      // answer count
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if qtype != 1 {
+				binary.BigEndian.PutUint16(resp[2:], 0x8183) // NXDOMAIN
+			} else {
+				ips := answers[n%len(answers)]
+				n++
+				binary.BigEndian.PutUint16(resp[6:], uint16(len(ips)))
+				for _, ip := range ips {
+					// name pointer to the question, type A, class IN, ttl 60, 4 bytes of data
+					resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+					resp = append(resp, ip.To4()...)
+				}
+			}
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSProbe(t *testing.T) {
+	a, b, c := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)
+	// round-robin in a different order, then a changed record
+	server := fakeDNSServer(t, []net.IP{a, b}, []net.IP{b, a}, []net.IP{a, c})
+	probe := DNSProbe{Name: "api", Query: "api.example.test.", Record: "A"}
+	collector, err := NewDNSProbeFactory([]DNSProbe{probe}, server, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"probe": "api", "query": probe.Query, "record": "A", "resolver": server}
+	for i, wantChanged := range []float64{0, 0, 1} {
+		metrics, err := collector.Collect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]float64{"dns_probe_success": 1, "dns_probe_answers": 2, "dns_probe_answers_changed": wantChanged}
+		for _, m := range metrics {
+			// the answers are no label, the label set is the same on every lookup
+			if !reflect.DeepEqual(m.Labels, labels) {
+				t.Errorf("lookup %d: %s labels = %v, want %v", i, m.Name, m.Labels, labels)
+			}
+			if val, ok := want[m.Name]; ok {
+				if m.Value != val {
+					t.Errorf("lookup %d: %s = %v, want %v", i, m.Name, m.Value, val)
+				}
+				delete(want, m.Name)
+			}
+		}
+		if len(want) > 0 {
+			t.Errorf("lookup %d: missing metrics %v in %+v", i, want, metrics)
+		}
+	}
+}
+
+func TestDNSProbeFailure(t *testing.T) {
+	server := fakeDNSServer(t, []net.IP{net.IPv4(192, 0, 2, 1)})
+	probe := DNSProbe{Name: "mail", Query: "example.test.", Record: "MX"}
+	collector, err := NewDNSProbeFactory([]DNSProbe{probe}, server, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := collector.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 || metrics[0].Name != "dns_probe_success" || metrics[0].Value != 0 {
+		t.Fatalf("metrics = %+v, want dns_probe_success 0 and dns_probe_failure_reason", metrics)
+	}
+	if metrics[0].Labels["resolver"] != server || len(metrics[0].Labels) != 4 {
+		t.Fatalf("labels = %v", metrics[0].Labels)
+	}
+	if got := metrics[1].Labels["reason"]; metrics[1].Name != "dns_probe_failure_reason" || got != reasonNXDomain {
+		t.Fatalf("metric = %+v, want dns_probe_failure_reason with reason %s", metrics[1], reasonNXDomain)
+	}
+}
+
+func TestLoadDNSProbes(t *testing.T) {
+	path := writeTestFile(t, "# name query [record]\napi api.example.com\nmail example.com mx\n")
+	probes, err := LoadDNSProbes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DNSProbe{{Name: "api", Query: "api.example.com", Record: "A"}, {Name: "mail", Query: "example.com", Record: "MX"}}
+	if !reflect.DeepEqual(probes, want) {
+		t.Fatalf("probes = %+v, want %+v", probes, want)
+	}
+	if _, err := LoadDNSProbes(writeTestFile(t, "api example.com SRV\n")); err == nil {
+		t.Fatal("LoadDNSProbes() accepted an unsupported record type")
+	}
+	if _, err := LoadTCPProbes(writeTestFile(t, "db localhost\n")); err == nil {
+		t.Fatal("LoadTCPProbes() accepted an address without port")
+	}
+}
+
+// writeTestFile writes content into a temporary file
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "probes")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -38,6 +39,8 @@ type DiskInfo struct {
 	Free        float64 `json:"free"`        // free disk size in GB
 	Used        float64 `json:"used"`        // used disk size in GB
 	UsedPercent float64 `json:"usedPercent"` // used disk size in percent
+
+	usage *disk.UsageStat // exact sizes in bytes, the GB values are rounded
 }
 
 type MemoryInfo struct {
@@ -47,6 +50,8 @@ type MemoryInfo struct {
 	UsedPercent float64 `json:"usedPercent"` // used memory size in percent
 	Free        float64 `json:"free"`        // free memory size in GB
 	Cached      float64 `json:"cached"`      // cached memory size in GB
+
+	stat *mem.VirtualMemoryStat // exact sizes in bytes, the GB values are rounded
 }
 
 type LoadInfo struct {
@@ -61,6 +66,7 @@ type DynamicDataSummary struct {
 	MemInfo    MemoryInfo `json:"memInfo"`
 	DiskInfo   DiskInfo   `json:"diskInfo"`
 	LoadInfo   LoadInfo   `json:"loadInfo"`
+	Metrics    []Metric   `json:"metrics,omitempty"` // series of additional collectors
 }
 
 type PropertiesSummary struct {
@@ -118,6 +124,7 @@ func getDiskInfo() (*DiskInfo, error) {
 		Free:        humanizeGB(float64(diskInfoData.Free)),
 		Used:        humanizeGB(float64(diskInfoData.Used)),
 		UsedPercent: humanizePercent(diskInfoData.UsedPercent),
+		usage:       diskInfoData,
 	}
 	return &diskInfo, nil
 }
@@ -135,6 +142,7 @@ func getMemoryInfo() (*MemoryInfo, error) {
 		UsedPercent: humanizePercent(memInfoData.UsedPercent),
 		Free:        humanizeGB(float64(memInfoData.Free)),
 		Cached:      humanizeGB(float64(memInfoData.Cached)),
+		stat:        memInfoData,
 	}
 	return &memInfo, nil
 }
@@ -230,12 +238,8 @@ func humanizeDuration(duration time.Duration) string {
 	return res[:len(res)-1] // remove trailing space
 }
 
-// StartGetPerfDataTask starts a task to get performance data
-// intervals: interval time in seconds
-// count: number of data to get
-// return PerfData
-func StartGetPerfDataTask(intervals uint64, count uint64) (*PerfData, error) {
-	var dynamicData []DynamicDataSummary
+// GetProperties returns the static properties of the host
+func GetProperties() (*PropertiesSummary, error) {
 	cpuInfo, err := getCpuProperties()
 	if err != nil {
 		return nil, errors.New("get cpu properties failed")
@@ -244,34 +248,87 @@ func StartGetPerfDataTask(intervals uint64, count uint64) (*PerfData, error) {
 	if err != nil {
 		return nil, errors.New("get host properties failed")
 	}
+	return &PropertiesSummary{
+		HostInfo: *hostInfo,
+		CpuInfo:  *cpuInfo,
+	}, nil
+}
+
+// CollectSummary takes one sample of cpu, memory, disk, load and the additional collectors
+// ctx: context
+// extra: additional collectors, a failing collector is logged and skipped
+// return DynamicDataSummary
+func CollectSummary(ctx context.Context, extra []Collector) (*DynamicDataSummary, error) {
+	diskInfo, err := getDiskInfo()
+	if err != nil {
+		return nil, errors.New("get disk info failed")
+	}
+	memInfo, err := getMemoryInfo()
+	if err != nil {
+		return nil, errors.New("get memory info failed")
+	}
+	loadAvg, err := getLoadInfo()
+	if err != nil {
+		return nil, errors.New("get load info failed")
+	}
+	var metrics []Metric
+	for _, c := range extra {
+		m, err := c.Collect(ctx)
+		utils.LogOnError(err, "collect additional metrics failed")
+		metrics = append(metrics, m...)
+	}
+	return &DynamicDataSummary{
+		TimeStamp:  time.Now().Format(summaryTimeLayout),
+		CpuPercent: getCpuPercent(),
+		MemInfo:    *memInfo,
+		DiskInfo:   *diskInfo,
+		LoadInfo:   *loadAvg,
+		Metrics:    metrics,
+	}, nil
+}
+
+// StartGetPerfDataTask starts a task to get performance data
+// ctx: context, the task stops when it is cancelled
+// intervals: interval time in seconds
+// count: number of data to get
+// extra: additional collectors sampled at the same time, a failing collector is logged and skipped
+// return PerfData, with the samples taken so far when ctx is cancelled
+func StartGetPerfDataTask(ctx context.Context, intervals uint64, count uint64, extra []Collector) (*PerfData, error) {
+	return CollectPerfData(ctx, time.Second*time.Duration(intervals), count, extra, nil)
+}
+
+// CollectPerfData samples count times every interval
+// ctx: context, sampling stops when it is cancelled
+// interval: interval between samples
+// count: number of samples
+// extra: additional collectors sampled at the same time, a failing collector is logged and skipped
+// onSample: called with every sample, may be nil
+// return PerfData, with the samples taken so far when ctx is cancelled
+func CollectPerfData(ctx context.Context, interval time.Duration, count uint64, extra []Collector, onSample func(DynamicDataSummary)) (*PerfData, error) {
+	var dynamicData []DynamicDataSummary
+	properties, err := GetProperties()
+	if err != nil {
+		return nil, err
+	}
+	perfData := &PerfData{Properties: *properties}
 	for i := 0; i < int(count); i++ {
-		diskInfo, err := getDiskInfo()
+		summary, err := CollectSummary(ctx, extra)
 		if err != nil {
-			return nil, errors.New("get disk info failed")
+			return nil, err
 		}
-		memInfo, err := getMemoryInfo()
-		if err != nil {
-			return nil, errors.New("get memory info failed")
+		dynamicData = append(dynamicData, *summary)
+		perfData.Data = dynamicData
+		if onSample != nil {
+			onSample(*summary)
 		}
-		loadAvg, err := getLoadInfo()
-		if err != nil {
-			return nil, errors.New("get load info failed")
+		if i == int(count)-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return perfData, ctx.Err()
+		case <-time.After(interval):
 		}
-		dynamicData = append(dynamicData, DynamicDataSummary{
-			TimeStamp:  time.Now().Format("2006-01-02 15:04:05"),
-			CpuPercent: getCpuPercent(),
-			MemInfo:    *memInfo,
-			DiskInfo:   *diskInfo,
-			LoadInfo:   *loadAvg,
-		})
-		time.Sleep(time.Second * time.Duration(intervals))
-	}
-	perfData := PerfData{
-		PropertiesSummary{
-			HostInfo: *hostInfo,
-			CpuInfo:  *cpuInfo,
-		},
-		dynamicData[:],
 	}
-	return &perfData, nil
+	return perfData, nil
 }
@@ -0,0 +1,19 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStartGetPerfDataTaskCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	perfData, err := StartGetPerfDataTask(ctx, 60, 3, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if perfData == nil || len(perfData.Data) != 1 {
+		t.Fatalf("perf data = %+v, want the first sample", perfData)
+	}
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxScrapeBody max bytes of a scraped exposition
+const maxScrapeBody = 16 * 1024 * 1024
+
+// scrapeAccept asks for OpenMetrics and falls back to the Prometheus text format
+const scrapeAccept = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// ScrapeTarget a local Prometheus/OpenMetrics endpoint scraped on every interval
+type ScrapeTarget struct {
+	Name      string           // target name, added as target label, ex: nginx
+	URL       string           // ex: http://127.0.0.1:9113/metrics
+	Selectors []SeriesSelector // series kept, empty means all
+}
+
+// LoadScrapeTargets reads scrape targets from a file, one target per line: "<name> <url> [selector...]",
+// selectors are the rest of the line, ex: http_requests_total{code=~"5.."} {__name__=~"go_gc_.*"},
+// empty lines and lines starting with # are ignored
+// path: target file path
+// return: targets, error
+func LoadScrapeTargets(path string) ([]ScrapeTarget, error) {
+	var targets []ScrapeTarget
+	err := readConfigLines(path, 2, func(fields []string, rest string) error {
+		u, err := url.Parse(fields[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid url of scrape target %s", fields[0])
+		}
+		selectors, err := ParseSeriesSelectors(rest)
+		if err != nil {
+			return fmt.Errorf("invalid selectors of scrape target %s: %w", fields[0], err)
+		}
+		targets = append(targets, ScrapeTarget{Name: fields[0], URL: fields[1], Selectors: selectors})
+		return nil
+	})
+	return targets, err
+}
+
+// NewScrapeFactory returns a factory of collectors scraping local metrics endpoints
+// targets: scrape targets
+// timeout: timeout of one scrape
+// return: CollectorFactory
+func NewScrapeFactory(targets []ScrapeTarget, timeout time.Duration) CollectorFactory {
+	return func() (Collector, error) {
+		return &scrapeCollector{
+			targets: targets,
+			client:  &http.Client{Timeout: timeout},
+			last:    make(map[string]map[string]counterSample),
+		}, nil
+	}
+}
+
+// counterSample previous value of a counter, used to compute the rate
+type counterSample struct {
+	value float64
+	at    time.Time
+}
+
+// scrapeCollector scrapes every target once per interval, counters are reported as per second rates
+type scrapeCollector struct {
+	targets []ScrapeTarget
+	client  *http.Client
+	last    map[string]map[string]counterSample // target name -> series key -> previous value
+}
+
+func (c *scrapeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	var metrics []Metric
+	for _, t := range c.targets {
+		metrics = append(metrics, c.scrape(ctx, t)...)
+	}
+	return metrics, nil
+}
+
+func (c *scrapeCollector) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// scrape scrapes one target, a failed scrape is reported by scrape_success=0, the error is logged
+func (c *scrapeCollector) scrape(ctx context.Context, t ScrapeTarget) []Metric {
+	labels := map[string]string{"target": t.Name, "url": t.URL}
+	start := time.Now()
+	samples, err := c.fetch(ctx, t.URL)
+	if err != nil {
+		return probeFailure("scrape", labels, err)
+	}
+	duration := time.Since(start)
+
+	var metrics []Metric
+	last := c.last[t.Name]
+	current := make(map[string]counterSample)
+	for _, s := range samples {
+		if !selected(t.Selectors, s.Name, s.Labels) {
+			continue
+		}
+		seriesLabels := make(map[string]string, len(s.Labels)+1)
+		for k, v := range s.Labels {
+			if k == "target" {
+				// keep the label of the app, like Prometheus does with honor_labels: false
+				k = "exported_target"
+			}
+			seriesLabels[k] = v
+		}
+		seriesLabels["target"] = t.Name
+		if s.Type != MetricCounter {
+			metrics = append(metrics, Metric{Name: s.Name, Type: MetricGauge, Help: s.Help, Labels: seriesLabels, Value: s.Value})
+			continue
+		}
+		key := s.Name + labelsKey(s.Labels)
+		current[key] = counterSample{value: s.Value, at: start}
+		prev, ok := last[key]
+		if !ok || !start.After(prev.at) {
+			// the rate needs two scrapes
+			continue
+		}
+		delta := s.Value - prev.value
+		if delta < 0 {
+			// counter reset, ex: the app restarted
+			delta = s.Value
+		}
+		help := "Per second rate of " + s.Name
+		if s.Help != "" {
+			help += ": " + s.Help
+		}
+		metrics = append(metrics, Metric{
+			Name:   strings.TrimSuffix(s.Name, "_total") + "_per_second",
+			Type:   MetricGauge,
+			Help:   help,
+			Labels: seriesLabels,
+			Value:  delta / start.Sub(prev.at).Seconds(),
+		})
+	}
+	c.last[t.Name] = current
+
+	return append(metrics,
+		probeMetric("scrape_success", MetricGauge, "", "Whether the probe succeeded", labels, 1),
+		probeMetric("scrape_duration_seconds", MetricGauge, "seconds", "Duration of the scrape", labels, duration.Seconds()),
+		probeMetric("scrape_samples", MetricGauge, "", "Number of samples exposed by the target", labels, float64(len(samples))),
+	)
+}
+
+// fetch requests and parses the exposition of a target
+func (c *scrapeCollector) fetch(ctx context.Context, target string) ([]promSample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", scrapeAccept)
+	req.Header.Set("User-Agent", "sugar-agent")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w %s", errUnexpectedStatus, resp.Status)
+	}
+	body := io.LimitReader(resp.Body, maxScrapeBody+1)
+	counted := &countingReader{r: body}
+	samples, err := parsePromText(counted)
+	if counted.n > maxScrapeBody {
+		return nil, fmt.Errorf("exposition larger than %d bytes", maxScrapeBody)
+	}
+	return samples, err
+}
+
+// selected reports whether any selector matches, no selectors select all series
+func selected(selectors []SeriesSelector, name string, labels map[string]string) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, sel := range selectors {
+		if sel.Matches(name, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsKey formats labels in a stable order, used to identify a series
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "{%s=%q}", k, labels[k])
+	}
+	return b.String()
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ageLastScrape moves the previous scrape of every series back by d, so rates do not depend on test timing
+func ageLastScrape(c *scrapeCollector, d time.Duration) {
+	for _, series := range c.last {
+		for key, s := range series {
+			s.at = s.at.Add(-d)
+			series[key] = s
+		}
+	}
+}
+
+func TestScrapeCounterRate(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 100, 150, then the app restarts and the counter starts over at 20
+		value := []int{100, 150, 20}[requests.Add(1)-1]
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total{target=\"worker\"} %d\n# TYPE queue_size gauge\nqueue_size 7\n", value)
+	}))
+	defer srv.Close()
+
+	sels, err := ParseSeriesSelectors(`jobs_total queue_size`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &scrapeCollector{
+		targets: []ScrapeTarget{{Name: "app", URL: srv.URL, Selectors: sels}},
+		client:  srv.Client(),
+		last:    make(map[string]map[string]counterSample),
+	}
+	const interval = 10 * time.Second
+	tests := []struct {
+		name     string
+		rate     float64
+		withRate bool
+	}{
+		{"first scrape has no rate", 0, false},
+		{"rate of the increase", 50 / interval.Seconds(), true},
+		{"counter reset counts from zero", 20 / interval.Seconds(), true},
+	}
+	for _, tt := range tests {
+		metrics, err := c.Collect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ageLastScrape(c, interval)
+
+		if m, ok := findMetric(metrics, "scrape_success", ""); !ok || m.Value != 1 {
+			t.Fatalf("%s: scrape_success = %+v", tt.name, m)
+		}
+		if m, ok := findMetric(metrics, "queue_size", ""); !ok || m.Value != 7 || m.Labels["target"] != "app" {
+			t.Fatalf("%s: queue_size = %+v", tt.name, m)
+		}
+		if _, ok := findMetric(metrics, "jobs_total", ""); ok {
+			t.Fatalf("%s: raw counter reported", tt.name)
+		}
+		m, ok := findMetric(metrics, "jobs_per_second", "")
+		if ok != tt.withRate {
+			t.Fatalf("%s: jobs_per_second present = %t, want %t", tt.name, ok, tt.withRate)
+		}
+		if !ok {
+			continue
+		}
+		// the time between two Collect calls adds a little to the interval
+		if m.Value > tt.rate || m.Value < tt.rate*0.9 {
+			t.Errorf("%s: jobs_per_second = %v, want about %v", tt.name, m.Value, tt.rate)
+		}
+		if m.Labels["target"] != "app" || m.Labels["exported_target"] != "worker" {
+			t.Errorf("%s: labels = %v", tt.name, m.Labels)
+		}
+	}
+}
+
+func TestScrapeFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		reason  string
+	}{
+		{"bad status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}, reasonStatus},
+		{"invalid exposition", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "up{job=a} 1")
+		}, reasonOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			c := &scrapeCollector{
+				targets: []ScrapeTarget{{Name: "app", URL: srv.URL}},
+				client:  srv.Client(),
+				last:    make(map[string]map[string]counterSample),
+			}
+			metrics, err := c.Collect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != 2 || metrics[0].Name != "scrape_success" || metrics[0].Value != 0 {
+				t.Fatalf("metrics = %+v, want scrape_success 0 and scrape_failure_reason", metrics)
+			}
+			if want := map[string]string{"target": "app", "url": srv.URL}; !reflect.DeepEqual(metrics[0].Labels, want) {
+				t.Fatalf("labels = %v, want %v", metrics[0].Labels, want)
+			}
+			if got := metrics[1].Labels["reason"]; metrics[1].Name != "scrape_failure_reason" || got != tt.reason {
+				t.Fatalf("metric = %+v, want scrape_failure_reason with reason %s", metrics[1], tt.reason)
+			}
+		})
+	}
+}
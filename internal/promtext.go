@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// promSample one sample of the Prometheus text or OpenMetrics exposition format
+type promSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	Type   string // MetricGauge or MetricCounter, derived from the TYPE of the family
+	Help   string
+}
+
+// promFamily metadata of a metric family
+type promFamily struct {
+	Type string
+	Help string
+}
+
+// parsePromText parses the Prometheus text or OpenMetrics exposition format,
+// samples of counters, histograms and summaries except quantiles are counters, the rest are gauges
+// r: exposition
+// return: samples, error
+func parsePromText(r io.Reader) ([]promSample, error) {
+	families := make(map[string]promFamily)
+	var samples []promSample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 {
+				// comment or # EOF
+				continue
+			}
+			f := families[fields[2]]
+			switch fields[1] {
+			case "TYPE":
+				if len(fields) == 4 {
+					f.Type = strings.TrimSpace(fields[3])
+				}
+			case "HELP":
+				if len(fields) == 4 {
+					f.Help = unescapePromHelp(fields[3])
+				}
+			default:
+				continue
+			}
+			families[fields[2]] = f
+			continue
+		}
+		s, err := parsePromSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		family, suffix := lookupPromFamily(families, s.Name)
+		if suffix == "_created" {
+			// OpenMetrics creation timestamps are not samples
+			continue
+		}
+		s.Type = MetricGauge
+		switch family.Type {
+		case "counter":
+			s.Type = MetricCounter
+		case "histogram", "summary":
+			if suffix != "" {
+				s.Type = MetricCounter
+			}
+		}
+		s.Help = family.Help
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// lookupPromFamily finds the family of a sample name, samples of counters, histograms and summaries have suffixes
+// return: family, suffix of the sample name
+func lookupPromFamily(families map[string]promFamily, name string) (promFamily, string) {
+	for _, suffix := range []string{"_total", "_bucket", "_sum", "_count", "_created", "_gsum", "_gcount", "_info"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if f, ok := families[strings.TrimSuffix(name, suffix)]; ok {
+			if suffix == "_total" && f.Type == "counter" {
+				// OpenMetrics counter family named without _total
+				return f, ""
+			}
+			return f, suffix
+		}
+	}
+	return families[name], ""
+}
+
+// parsePromSample parses a sample line: name{labels} value [timestamp] [# exemplar]
+func parsePromSample(line string) (promSample, error) {
+	s := promSample{Labels: map[string]string{}}
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.Name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		matchers, n, err := parsePromLabels(rest, false)
+		if err != nil {
+			return s, err
+		}
+		for _, m := range matchers {
+			s.Labels[m.Name] = m.Value
+		}
+		rest = rest[n:]
+	}
+	if j := strings.Index(rest, " # "); j >= 0 {
+		// exemplar
+		rest = rest[:j]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value of %s", s.Name)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value of %s: %w", s.Name, err)
+	}
+	s.Value = v
+	return s, nil
+}
+
+// labelMatcher matches one label, op is =, !=, =~ or !~
+type labelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.Op {
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+	return value == m.Value
+}
+
+// parsePromLabels parses {name="value",...} at the start of s, with matchers the operators !=, =~ and !~ are allowed too
+// return: labels, number of bytes consumed, error
+func parsePromLabels(s string, matchers bool) ([]labelMatcher, int, error) {
+	var res []labelMatcher
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated labels %q", s)
+		}
+		if s[i] == '}' {
+			return res, i + 1, nil
+		}
+		start := i
+		for i < len(s) && isLabelNameChar(s[i], i > start) {
+			i++
+		}
+		m := labelMatcher{Name: s[start:i]}
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s[i:], op) && (matchers || op == "=") {
+				m.Op = op
+				break
+			}
+		}
+		if m.Name == "" || m.Op == "" {
+			return nil, 0, fmt.Errorf("invalid labels %q", s)
+		}
+		i += len(m.Op)
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		value, n, err := parseQuoted(s[i:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid value of label %s: %w", m.Name, err)
+		}
+		m.Value = value
+		i += n
+		if m.Op == "=~" || m.Op == "!~" {
+			// anchored like PromQL
+			m.re, err = regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid regex of label %s: %w", m.Name, err)
+			}
+		}
+		res = append(res, m)
+	}
+}
+
+// parseQuoted parses a double quoted string with \\, \" and \n escapes at the start of s
+// return: unquoted string, number of bytes consumed, error
+func parseQuoted(s string) (string, int, error) {
+	if s == "" || s[0] != '"' {
+		return "", 0, fmt.Errorf("expect a quoted string")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isLabelNameChar(c byte, digitAllowed bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (digitAllowed && c >= '0' && c <= '9')
+}
+
+func unescapePromHelp(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
+
+// SeriesSelector selects series by metric name and label matchers, ex: http_requests_total{code=~"5.."}
+type SeriesSelector struct {
+	name     string
+	matchers []labelMatcher
+}
+
+// ParseSeriesSelectors parses whitespace separated series selectors: name, name{matchers} or {matchers},
+// the metric name can be matched by the __name__ label too
+// s: selectors
+// return: selectors, error
+func ParseSeriesSelectors(s string) ([]SeriesSelector, error) {
+	var res []SeriesSelector
+	s = strings.TrimSpace(s)
+	for s != "" {
+		var sel SeriesSelector
+		i := 0
+		for i < len(s) && (isLabelNameChar(s[i], i > 0) || s[i] == ':') {
+			i++
+		}
+		sel.name = s[:i]
+		if i < len(s) && s[i] == '{' {
+			matchers, n, err := parsePromLabels(s[i:], true)
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = matchers
+			i += n
+		}
+		if i == 0 || (i < len(s) && s[i] != ' ' && s[i] != '\t') {
+			return nil, fmt.Errorf("invalid series selector %q", s)
+		}
+		res = append(res, sel)
+		s = strings.TrimSpace(s[i:])
+	}
+	return res, nil
+}
+
+// Matches reports whether the series is selected
+// name: metric name
+// labels: series labels
+// return: bool
+func (sel SeriesSelector) Matches(name string, labels map[string]string) bool {
+	if sel.name != "" && sel.name != name {
+		return false
+	}
+	for _, m := range sel.matchers {
+		value := labels[m.Name]
+		if m.Name == "__name__" {
+			value = name
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
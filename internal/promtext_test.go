@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePromText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []promSample
+		wantErr bool
+	}{
+		{
+			name: "prometheus counter named with _total",
+			text: `# HELP http_requests_total Requests handled.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027 1395066363000
+http_requests_total{code="500",method="get"} 3
+`,
+			want: []promSample{
+				{Name: "http_requests_total", Labels: map[string]string{"code": "200", "method": "get"}, Value: 1027, Type: MetricCounter, Help: "Requests handled."},
+				{Name: "http_requests_total", Labels: map[string]string{"code": "500", "method": "get"}, Value: 3, Type: MetricCounter, Help: "Requests handled."},
+			},
+		},
+		{
+			name: "openmetrics counter with _created and exemplar",
+			text: `# TYPE foo counter
+# HELP foo Foos seen.
+foo_total 17.0 # {trace_id="KOO5S4vxi0o"} 0.67 1520879607.789
+foo_created 1520872607.123
+# EOF
+`,
+			want: []promSample{
+				{Name: "foo_total", Labels: map[string]string{}, Value: 17, Type: MetricCounter, Help: "Foos seen."},
+			},
+		},
+		{
+			name: "escapes",
+			text: `# HELP temp Temperature\nin \\degrees.
+# TYPE temp gauge
+temp{path="C:\\dir\\\"x\"",msg="a # b",multi="line1\nline2"} -1.5e3
+`,
+			want: []promSample{
+				{Name: "temp", Labels: map[string]string{"path": `C:\dir\"x"`, "msg": "a # b", "multi": "line1\nline2"}, Value: -1500, Type: MetricGauge, Help: "Temperature\nin \\degrees."},
+			},
+		},
+		{
+			name: "histogram and summary",
+			text: `# TYPE rpc_seconds histogram
+rpc_seconds_bucket{le="0.1"} 5
+rpc_seconds_bucket{le="+Inf"} 8
+rpc_seconds_sum 1.5
+rpc_seconds_count 8
+# TYPE gc_seconds summary
+gc_seconds{quantile="0.5"} 0.002
+gc_seconds_sum 0.3
+`,
+			want: []promSample{
+				{Name: "rpc_seconds_bucket", Labels: map[string]string{"le": "0.1"}, Value: 5, Type: MetricCounter},
+				{Name: "rpc_seconds_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 8, Type: MetricCounter},
+				{Name: "rpc_seconds_sum", Labels: map[string]string{}, Value: 1.5, Type: MetricCounter},
+				{Name: "rpc_seconds_count", Labels: map[string]string{}, Value: 8, Type: MetricCounter},
+				{Name: "gc_seconds", Labels: map[string]string{"quantile": "0.5"}, Value: 0.002, Type: MetricGauge},
+				{Name: "gc_seconds_sum", Labels: map[string]string{}, Value: 0.3, Type: MetricCounter},
+			},
+		},
+		{
+			name: "untyped and spaces",
+			text: "  # a comment\n\nup   1\nnode:load1{ cpu=\"0\" , } 0.5\n",
+			want: []promSample{
+				{Name: "up", Labels: map[string]string{}, Value: 1, Type: MetricGauge},
+				{Name: "node:load1", Labels: map[string]string{"cpu": "0"}, Value: 0.5, Type: MetricGauge},
+			},
+		},
+		{name: "invalid value", text: "up one\n", wantErr: true},
+		{name: "missing value", text: "up\n", wantErr: true},
+		{name: "unterminated labels", text: "up{job=\"a\" 1\n", wantErr: true},
+		{name: "unquoted label value", text: "up{job=a} 1\n", wantErr: true},
+		{name: "unterminated label value", text: "up{job=\"a} 1\n", wantErr: true},
+		{name: "label matcher in sample", text: "up{job!=\"a\"} 1\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromText(strings.NewReader(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePromText() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parsePromText() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeriesSelectors(t *testing.T) {
+	tests := []struct {
+		selectors string
+		name      string
+		labels    map[string]string
+		want      bool
+	}{
+		{"http_requests_total", "http_requests_total", map[string]string{"code": "200"}, true},
+		{"http_requests_total", "http_errors_total", nil, false},
+		{`http_requests_total{code="200"}`, "http_requests_total", map[string]string{"code": "200"}, true},
+		{`http_requests_total{code!="200"}`, "http_requests_total", map[string]string{"code": "200"}, false},
+		{`http_requests_total{code=~"5.."}`, "http_requests_total", map[string]string{"code": "503"}, true},
+		{`http_requests_total{code=~"5.."}`, "http_requests_total", map[string]string{"code": "1503"}, false},
+		{`http_requests_total{code!~"5.."}`, "http_requests_total", map[string]string{"code": "200"}, true},
+		{`{__name__=~"go_gc_.*"}`, "go_gc_duration_seconds", nil, true},
+		{`{__name__=~"go_gc_.*"}`, "go_goroutines", nil, false},
+		{`{job="a", instance = "b"}`, "up", map[string]string{"job": "a", "instance": "b"}, true},
+		{`{missing=""}`, "up", nil, true},
+		{`up http_requests_total{code=~"5.."}`, "http_requests_total", map[string]string{"code": "500"}, true},
+		{`up http_requests_total{code=~"5.."}`, "http_requests_total", map[string]string{"code": "200"}, false},
+		{"", "anything", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selectors+" "+tt.name, func(t *testing.T) {
+			sels, err := ParseSeriesSelectors(tt.selectors)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selected(sels, tt.name, tt.labels); got != tt.want {
+				t.Fatalf("selected(%q, %s%v) = %t, want %t", tt.selectors, tt.name, tt.labels, got, tt.want)
+			}
+		})
+	}
+	for _, invalid := range []string{`up{code=~"("}`, `up{code="200"`, `up{code}`, `{code 200}`, `up}`, `5xx`} {
+		if _, err := ParseSeriesSelectors(invalid); err == nil {
+			t.Errorf("ParseSeriesSelectors(%q) expected an error", invalid)
+		}
+	}
+}
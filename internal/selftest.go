@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// CollectorCheck result of running one collector once
+type CollectorCheck struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Detail   string        `json:"detail"` // error reason, or a summary of what was collected
+	Duration time.Duration `json:"duration"`
+}
+
+// CheckCollectors runs every collector once, cpu, memory, disk, load, the host properties and the additional collectors,
+// an additional collector fails when it returns an error or reports <prefix>_success=0, ex: an unreachable probe
+// ctx: context
+// return: results of the properties, cpu, memory, disk, load and the additional collectors in this order
+func CheckCollectors(ctx context.Context) []CollectorCheck {
+	base := []struct {
+		name string
+		fn   func() (string, error)
+	}{
+		{"properties", func() (string, error) {
+			p, err := GetProperties()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s, %d cores", p.HostInfo.Platform, p.HostInfo.PlatformVersion, p.CpuInfo.LogicalCoresCount), nil
+		}},
+		{"cpu", func() (string, error) {
+			percent, err := cpu.Percent(time.Second, false)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.2f%%", percent[0]), nil
+		}},
+		{"memory", func() (string, error) {
+			m, err := getMemoryInfo()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.2f%% of %.2fGB used", m.UsedPercent, m.Total), nil
+		}},
+		{"disk", func() (string, error) {
+			d, err := getDiskInfo()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.2f%% of %.2fGB used", d.UsedPercent, d.Total), nil
+		}},
+		{"load", func() (string, error) {
+			l, err := getLoadInfo()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.2f %.2f %.2f", l.Load1, l.Load5, l.Load15), nil
+		}},
+	}
+	var checks []CollectorCheck
+	for _, b := range base {
+		start := time.Now()
+		detail, err := b.fn()
+		checks = append(checks, newCheck(b.name, detail, err, time.Since(start)))
+	}
+	for _, name := range ExtraCollectors() {
+		start := time.Now()
+		detail, err := checkExtraCollector(ctx, name)
+		checks = append(checks, newCheck(name, detail, err, time.Since(start)))
+	}
+	return checks
+}
+
+func newCheck(name string, detail string, err error, d time.Duration) CollectorCheck {
+	if err != nil {
+		return CollectorCheck{Name: name, Detail: err.Error(), Duration: d}
+	}
+	return CollectorCheck{Name: name, OK: true, Detail: detail, Duration: d}
+}
+
+// checkExtraCollector creates an additional collector and collects once
+func checkExtraCollector(ctx context.Context, name string) (string, error) {
+	cs, err := NewCollectors([]string{name})
+	if err != nil {
+		return "", err
+	}
+	defer CloseCollectors(cs)
+	metrics, err := cs[0].Collect(ctx)
+	if err != nil {
+		return "", err
+	}
+	var failures []string
+	for _, m := range metrics {
+		// every failed probe has a <prefix>_failure_reason series next to its <prefix>_success=0
+		if strings.HasSuffix(m.Name, "_failure_reason") {
+			var target []string
+			for _, k := range []string{"probe", "target"} {
+				if v, ok := m.Labels[k]; ok {
+					target = append(target, v)
+				}
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", strings.Join(target, " "), m.Labels["reason"]))
+		}
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return fmt.Sprintf("%d series", len(metrics)), nil
+}
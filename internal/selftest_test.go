@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckExtraCollectorReportsReasons(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	RegisterCollector("selftest_tcp_probes", NewTCPProbeFactory([]TCPProbe{{Name: "db", Address: closed.Addr().String()}}, time.Second))
+
+	_, err = checkExtraCollector(context.Background(), "selftest_tcp_probes")
+	if err == nil || err.Error() != "db: "+reasonRefused {
+		t.Fatalf("checkExtraCollector() error = %v, want the probe with its reason", err)
+	}
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signer signs task messages the way Verifier expects, used by tools publishing tasks
+type Signer struct {
+	mode       string
+	hmacKey    []byte
+	privateKey ed25519.PrivateKey
+}
+
+// NewSigner create a message signer
+// mode: none, hmac or ed25519
+// keyFile: HMAC shared key file or Ed25519 private key file (PKCS#8 PEM, or base64/hex seed or key)
+// return: *Signer, error
+func NewSigner(mode string, keyFile string) (*Signer, error) {
+	s := &Signer{mode: mode}
+	switch mode {
+	case ModeNone, "":
+		s.mode = ModeNone
+		return s, nil
+	case ModeHMAC, ModeEd25519:
+	default:
+		return nil, fmt.Errorf("unknown sign mode: %s", mode)
+	}
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read sign key file failed: %w", err)
+	}
+	if mode == ModeHMAC {
+		s.hmacKey = []byte(strings.TrimSpace(string(raw)))
+		if len(s.hmacKey) == 0 {
+			return nil, errors.New("hmac key is empty")
+		}
+		return s, nil
+	}
+	s.privateKey, err = parsePrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sign returns the signature headers of a message, no headers when signing is disabled
+// body: message body
+// props: routing key, ReplyTo and CorrelationId the message is published with
+// return: headers, error
+func (s *Signer) Sign(body []byte, props Properties) (map[string]interface{}, error) {
+	if s.mode == ModeNone {
+		return map[string]interface{}{}, nil
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b)
+	ts := time.Now().Unix()
+	payload := SigningPayload(body, ts, nonce, props)
+	var sig []byte
+	if s.mode == ModeHMAC {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(payload)
+		sig = mac.Sum(nil)
+	} else {
+		sig = ed25519.Sign(s.privateKey, payload)
+	}
+	return map[string]interface{}{
+		HeaderSignature: base64.StdEncoding.EncodeToString(sig),
+		HeaderTimestamp: ts,
+		HeaderNonce:     nonce,
+	}, nil
+}
+
+// parsePrivateKey parses an Ed25519 private key in PKCS#8 PEM format, or a base64/hex encoded seed or key
+func parsePrivateKey(raw []byte) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse ed25519 private key failed: %w", err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an ed25519 key")
+		}
+		return priv, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || !validPrivateKeySize(key) {
+		// a hex string is valid base64 too
+		key, err = hex.DecodeString(text)
+	}
+	if err != nil || !validPrivateKeySize(key) {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	if len(key) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(key), nil
+	}
+	return key, nil
+}
+
+// validPrivateKeySize returns whether key has the size of an Ed25519 seed or private key
+func validPrivateKeySize(key []byte) bool {
+	return len(key) == ed25519.SeedSize || len(key) == ed25519.PrivateKeySize
+}
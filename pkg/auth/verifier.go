@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sugar-agent/pkg/utils"
+)
+
+// message headers used to carry the signature
+const (
+	HeaderSignature = "x-sugar-signature" // base64 encoded signature
+	HeaderTimestamp = "x-sugar-timestamp" // unix timestamp in seconds
+	HeaderNonce     = "x-sugar-nonce"     // random string, unique per message
+)
+
+// verification modes
+const (
+	ModeNone    = "none"
+	ModeHMAC    = "hmac"
+	ModeEd25519 = "ed25519"
+)
+
+var (
+	ErrMissingSignature = errors.New("message is not signed")
+	ErrBadSignature     = errors.New("message signature mismatch")
+	ErrExpired          = errors.New("message timestamp expired")
+	ErrReplay           = errors.New("message nonce already used")
+	ErrHostNotAllowed   = errors.New("base_url host not allowed")
+)
+
+// Properties are the message properties covered by the signature besides the body,
+// they decide which devices run a task and where its results go
+type Properties struct {
+	RoutingKey    string
+	ReplyTo       string
+	CorrelationId string
+}
+
+// Verifier verifies signed task messages and rejects replays
+type Verifier struct {
+	mode         string
+	hmacKey      []byte
+	publicKey    ed25519.PublicKey
+	maxAge       time.Duration
+	allowedHosts map[string]bool
+
+	mu      sync.Mutex
+	nonces  map[string]time.Time // nonce -> expire time
+	retries map[string]int       // nonce -> retried copies allowed to pass the replay check
+
+	now func() time.Time // current time, replaced in tests
+}
+
+// NewVerifier create a message verifier
+// mode: none, hmac or ed25519
+// keyFile: HMAC shared key file or Ed25519 public key file (PEM, base64 or hex)
+// maxAge: max allowed age of a message, also the allowed clock skew
+// allowedHosts: allowlist of base_url hosts, empty means allow all
+// return: *Verifier, error
+func NewVerifier(mode string, keyFile string, maxAge time.Duration, allowedHosts []string) (*Verifier, error) {
+	v := &Verifier{
+		mode:         mode,
+		maxAge:       maxAge,
+		allowedHosts: make(map[string]bool),
+		nonces:       make(map[string]time.Time),
+		retries:      make(map[string]int),
+		now:          time.Now,
+	}
+	for _, h := range allowedHosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			v.allowedHosts[h] = true
+		}
+	}
+	switch mode {
+	case ModeNone, "":
+		v.mode = ModeNone
+		return v, nil
+	case ModeHMAC, ModeEd25519:
+	default:
+		return nil, fmt.Errorf("unknown verify mode: %s", mode)
+	}
+	if maxAge <= 0 {
+		return nil, errors.New("verify max age must be positive")
+	}
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read verify key file failed: %w", err)
+	}
+	if mode == ModeHMAC {
+		v.hmacKey = []byte(strings.TrimSpace(string(raw)))
+		if len(v.hmacKey) == 0 {
+			return nil, errors.New("hmac key is empty")
+		}
+		return v, nil
+	}
+	v.publicKey, err = parsePublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Enabled returns whether signature verification is enabled
+func (v *Verifier) Enabled() bool {
+	return v.mode != ModeNone
+}
+
+// Verify checks the signature, timestamp and nonce of a message
+// body: message body
+// headers: message headers
+// props: routing key, ReplyTo and CorrelationId of the message
+// return: error
+func (v *Verifier) Verify(body []byte, headers map[string]interface{}, props Properties) error {
+	return v.verify(body, headers, props, false)
+}
+
+// VerifyRetry checks a copy of a message the agent retried itself, like Verify, but its nonce passes
+// the replay check when Retrying was called for it, once per call; such a copy keeps the timestamp of
+// the original and may wait in the queue for longer than max age, so its age is not checked
+// body: message body
+// headers: message headers
+// props: routing key, ReplyTo and CorrelationId of the message
+// return: error
+func (v *Verifier) VerifyRetry(body []byte, headers map[string]interface{}, props Properties) error {
+	return v.verify(body, headers, props, true)
+}
+
+func (v *Verifier) verify(body []byte, headers map[string]interface{}, props Properties, retry bool) error {
+	if !v.Enabled() {
+		return nil
+	}
+	sig, ok := headers[HeaderSignature].(string)
+	if !ok || sig == "" {
+		return ErrMissingSignature
+	}
+	nonce, ok := headers[HeaderNonce].(string)
+	if !ok || nonce == "" {
+		return ErrMissingSignature
+	}
+	ts, err := utils.HeaderToInt64(headers[HeaderTimestamp])
+	if err != nil {
+		return ErrMissingSignature
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrBadSignature
+	}
+	// a line break would move a value into the next field of the payload
+	if strings.ContainsAny(props.RoutingKey+props.ReplyTo+props.CorrelationId+nonce, "\n") {
+		return ErrBadSignature
+	}
+
+	payload := SigningPayload(body, ts, nonce, props)
+	switch v.mode {
+	case ModeHMAC:
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(payload)
+		if !hmac.Equal(mac.Sum(nil), sigBytes) {
+			return ErrBadSignature
+		}
+	case ModeEd25519:
+		if !ed25519.Verify(v.publicKey, payload, sigBytes) {
+			return ErrBadSignature
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// check timestamp only after the signature is valid, so it can be trusted
+	now := v.now()
+	for n, exp := range v.nonces {
+		// a nonce with pending retries is kept until its copies arrived, however old the message is
+		if now.After(exp) && v.retries[n] == 0 {
+			delete(v.nonces, n)
+			delete(v.retries, n)
+		}
+	}
+	if _, seen := v.nonces[nonce]; seen && retry && v.retries[nonce] > 0 {
+		v.retries[nonce]--
+		return nil
+	}
+	sent := time.Unix(ts, 0)
+	if now.Sub(sent) > v.maxAge || sent.Sub(now) > v.maxAge {
+		return ErrExpired
+	}
+	if _, seen := v.nonces[nonce]; seen {
+		return ErrReplay
+	}
+	// a nonce older than maxAge is rejected as expired, no need to keep it longer
+	v.nonces[nonce] = sent.Add(v.maxAge)
+	return nil
+}
+
+// CheckBaseURL checks whether the host of baseUrl is in the allowlist
+// baseUrl: base url from the task message
+// return: error
+func (v *Verifier) CheckBaseURL(baseUrl string) error {
+	if len(v.allowedHosts) == 0 {
+		return nil
+	}
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return fmt.Errorf("parse base_url failed: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrHostNotAllowed
+	}
+	// both "host" and "host:port" entries are accepted
+	if v.allowedHosts[strings.ToLower(u.Host)] || v.allowedHosts[strings.ToLower(u.Hostname())] {
+		return nil
+	}
+	return ErrHostNotAllowed
+}
+
+// Retrying lets one more copy of a message pass the replay check of VerifyRetry, called when the agent retries
+// or defers a message it verified before; the nonce stays in the replay cache until the copy arrived, so a captured
+// message still can not be replayed, even when the nonce expired while the task was running
+// headers: message headers
+// return: none
+func (v *Verifier) Retrying(headers map[string]interface{}) {
+	nonce, ok := headers[HeaderNonce].(string)
+	if !ok || !v.Enabled() {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, seen := v.nonces[nonce]; !seen {
+		// swept while the task was running, the message was verified when it was received
+		ts, err := utils.HeaderToInt64(headers[HeaderTimestamp])
+		if err != nil {
+			return
+		}
+		v.nonces[nonce] = time.Unix(ts, 0).Add(v.maxAge)
+	}
+	v.retries[nonce]++
+}
+
+// SigningPayload returns the bytes the signature is computed over:
+// "<timestamp>\n<nonce>\n<routing key>\n<reply to>\n<correlation id>\n<body>"
+func SigningPayload(body []byte, timestamp int64, nonce string, props Properties) []byte {
+	prefix := strings.Join([]string{
+		strconv.FormatInt(timestamp, 10), nonce, props.RoutingKey, props.ReplyTo, props.CorrelationId, "",
+	}, "\n")
+	payload := make([]byte, 0, len(prefix)+len(body))
+	payload = append(payload, prefix...)
+	return append(payload, body...)
+}
+
+// parsePublicKey parses an Ed25519 public key in PEM, base64 or hex format
+func parsePublicKey(raw []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse ed25519 public key failed: %w", err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an ed25519 key")
+		}
+		return pub, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		key, err = hex.DecodeString(text)
+	}
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	return key, nil
+}
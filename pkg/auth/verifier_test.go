@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKey writes a key file into a temporary directory
+func writeKey(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newHMACPair(t *testing.T) (*Signer, *Verifier) {
+	t.Helper()
+	keyFile := writeKey(t, "hmac.key", "shared-secret\n")
+	signer, err := NewSigner(ModeHMAC, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier(ModeHMAC, keyFile, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, verifier
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	body := []byte(`{"task_type":0,"metadata":{"task_uuid":"1"}}`)
+	props := Properties{RoutingKey: "group.web", ReplyTo: "amq.rabbitmq.reply-to", CorrelationId: "1"}
+	tests := []struct {
+		name    string
+		body    []byte
+		props   Properties
+		wantErr error
+	}{
+		{"good signature", body, props, nil},
+		{"tampered body", []byte(`{"task_type":1,"metadata":{"task_uuid":"1"}}`), props, ErrBadSignature},
+		{"tampered reply to", body, Properties{RoutingKey: "group.web", ReplyTo: "attacker", CorrelationId: "1"}, ErrBadSignature},
+		{"tampered routing key", body, Properties{RoutingKey: "all", ReplyTo: props.ReplyTo, CorrelationId: "1"}, ErrBadSignature},
+		{"tampered correlation id", body, Properties{RoutingKey: "group.web", ReplyTo: props.ReplyTo, CorrelationId: "2"}, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, verifier := newHMACPair(t)
+			headers, err := signer.Sign(body, props)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifier.Verify(tt.body, headers, tt.props)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(ModeEd25519, writeKey(t, "ed25519.key", hex.EncodeToString(priv.Seed())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier(ModeEd25519, writeKey(t, "ed25519.pub", base64.StdEncoding.EncodeToString(pub)), time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"task_type":0}`)
+	props := Properties{RoutingKey: "device.6"}
+	headers, err := signer.Sign(body, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify([]byte(`{"task_type":2}`), headers, props); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Verify() tampered body error = %v, want %v", err, ErrBadSignature)
+	}
+	if err := verifier.Verify(body, headers, props); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	_, verifier := newHMACPair(t)
+	body := []byte(`{}`)
+	for _, ts := range []int64{time.Now().Add(-2 * time.Minute).Unix(), time.Now().Add(2 * time.Minute).Unix()} {
+		mac := hmac.New(sha256.New, []byte("shared-secret"))
+		mac.Write(SigningPayload(body, ts, "nonce", Properties{}))
+		headers := map[string]interface{}{
+			HeaderSignature: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+			HeaderTimestamp: ts,
+			HeaderNonce:     "nonce",
+		}
+		if err := verifier.Verify(body, headers, Properties{}); !errors.Is(err, ErrExpired) {
+			t.Fatalf("Verify() timestamp %d error = %v, want %v", ts, err, ErrExpired)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	signer, verifier := newHMACPair(t)
+	body := []byte(`{}`)
+	headers, err := signer.Sign(body, Properties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(body, headers, Properties{}); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if err := verifier.Verify(body, headers, Properties{}); !errors.Is(err, ErrReplay) {
+		t.Fatalf("Verify() replay error = %v, want %v", err, ErrReplay)
+	}
+}
+
+func TestVerifyMissingSignature(t *testing.T) {
+	_, verifier := newHMACPair(t)
+	if err := verifier.Verify([]byte(`{}`), map[string]interface{}{}, Properties{}); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrMissingSignature)
+	}
+}
+
+func TestVerifyRetry(t *testing.T) {
+	signer, verifier := newHMACPair(t)
+	body := []byte(`{}`)
+	headers, err := signer.Sign(body, Properties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(body, headers, Properties{}); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	// a copy claiming to be retried is a replay unless the agent retried it
+	if err := verifier.VerifyRetry(body, headers, Properties{}); !errors.Is(err, ErrReplay) {
+		t.Fatalf("VerifyRetry() before Retrying error = %v, want %v", err, ErrReplay)
+	}
+	verifier.Retrying(headers)
+	if err := verifier.Verify(body, headers, Properties{}); !errors.Is(err, ErrReplay) {
+		t.Fatalf("Verify() after Retrying error = %v, want %v", err, ErrReplay)
+	}
+	if err := verifier.VerifyRetry(body, headers, Properties{}); err != nil {
+		t.Fatalf("VerifyRetry() error = %v", err)
+	}
+	if err := verifier.VerifyRetry(body, headers, Properties{}); !errors.Is(err, ErrReplay) {
+		t.Fatalf("second VerifyRetry() error = %v, want %v", err, ErrReplay)
+	}
+}
+
+func TestVerifyRetryOlderThanMaxAge(t *testing.T) {
+	signer, verifier := newHMACPair(t)
+	body := []byte(`{}`)
+	headers, err := signer.Sign(body, Properties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(body, headers, Properties{}); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	// the task waits for a free slot of its type for longer than max age, deferred every second
+	now := time.Now()
+	verifier.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Hour)
+		verifier.Retrying(headers)
+		// another message sweeps the expired nonces meanwhile
+		other, err := signer.Sign(body, Properties{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other[HeaderTimestamp] = now.Unix()
+		mac := hmac.New(sha256.New, []byte("shared-secret"))
+		mac.Write(SigningPayload(body, now.Unix(), other[HeaderNonce].(string), Properties{}))
+		other[HeaderSignature] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if err := verifier.Verify(body, other, Properties{}); err != nil {
+			t.Fatalf("Verify() other message error = %v", err)
+		}
+		if err := verifier.VerifyRetry(body, headers, Properties{}); err != nil {
+			t.Fatalf("VerifyRetry() of the deferred copy after %d hours error = %v", i+1, err)
+		}
+	}
+	// the original and unannounced copies are still rejected
+	if err := verifier.Verify(body, headers, Properties{}); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Verify() replay error = %v, want %v", err, ErrExpired)
+	}
+	if err := verifier.VerifyRetry(body, headers, Properties{}); !errors.Is(err, ErrExpired) {
+		t.Fatalf("VerifyRetry() without Retrying error = %v, want %v", err, ErrExpired)
+	}
+}
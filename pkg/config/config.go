@@ -0,0 +1,275 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema maps the dotted keys of a config file to setting names, ex: "mq.host" -> "host"
+type Schema map[string]string
+
+// Decode reads a YAML (.yaml, .yml) or TOML (.toml) config file
+// path: config file path
+// return: decoded tree, error
+func Decode(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		err = dec.Decode(&tree)
+		if errors.Is(err, io.EOF) {
+			// an empty file
+			err = nil
+		}
+	case ".toml":
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		return nil, fmt.Errorf("unknown config file format %q, use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", path, err)
+	}
+	return tree, nil
+}
+
+// Resolve flattens a decoded config file into setting values, every key must be in the schema
+// a secret key may also be given as <key>_file, the setting is then read from that file
+// tree: decoded config file
+// schema: known keys
+// secrets: setting names that may be read from a file
+// return: setting name -> value, error listing every unknown or invalid key
+func Resolve(tree map[string]interface{}, schema Schema, secrets map[string]bool) (map[string]string, error) {
+	sections := make(map[string]bool)
+	for key := range schema {
+		parts := strings.Split(key, ".")
+		for i := 1; i < len(parts); i++ {
+			sections[strings.Join(parts[:i], ".")] = true
+		}
+	}
+	r := resolver{schema: schema, secrets: secrets, sections: sections, values: make(map[string]string), keys: make(map[string]string)}
+	r.walk("", tree)
+	if len(r.errs) > 0 {
+		return nil, errors.Join(r.errs...)
+	}
+	return r.values, nil
+}
+
+// resolver walks a decoded config file
+type resolver struct {
+	schema   Schema
+	secrets  map[string]bool
+	sections map[string]bool   // dotted keys of the sections, ex: mq, mq.queue
+	values   map[string]string // setting name -> value
+	keys     map[string]string // setting name -> key it was read from
+	errs     []error
+}
+
+func (r *resolver) walk(prefix string, tree map[string]interface{}) {
+	names := make([]string, 0, len(tree))
+	for k := range tree {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		key, v := k, tree[k]
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if name, ok := r.schema[key]; ok {
+			val, err := toString(v)
+			r.set(key, name, val, err)
+			continue
+		}
+		if base, ok := strings.CutSuffix(key, "_file"); ok && r.secrets[r.schema[base]] {
+			path, err := toString(v)
+			val := ""
+			if err == nil {
+				val, err = ReadSecret(path)
+			}
+			r.set(key, r.schema[base], val, err)
+			continue
+		}
+		if sub, ok := asMap(v); ok && r.sections[key] {
+			r.walk(key, sub)
+			continue
+		}
+		if r.sections[key] {
+			r.errs = append(r.errs, fmt.Errorf("%s: must be a section", key))
+			continue
+		}
+		r.errs = append(r.errs, fmt.Errorf("%s: unknown key", key))
+	}
+}
+
+func (r *resolver) set(key, name, val string, err error) {
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: %w", key, err))
+		return
+	}
+	if prev, ok := r.keys[name]; ok {
+		r.errs = append(r.errs, fmt.Errorf("%s: conflicts with %s", key, prev))
+		return
+	}
+	r.values[name], r.keys[name] = val, key
+}
+
+// FromEnv reads settings from environment variables named by EnvName, a secret setting may also be given as
+// <variable>_FILE, the setting is then read from that file; unknown variables with the prefix are an error
+// prefix: ex: SUGAR_AGENT_
+// names: setting names
+// secrets: setting names that may be read from a file
+// return: setting name -> value, error
+func FromEnv(prefix string, names []string, secrets map[string]bool) (map[string]string, error) {
+	known := make(map[string]string, len(names))
+	for _, name := range names {
+		known[EnvName(prefix, name)] = name
+	}
+	values := make(map[string]string)
+	from := make(map[string]string) // setting name -> variable
+	var errs []error
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		key, val, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name, ok := known[key]
+		if !ok {
+			base, isFile := strings.CutSuffix(key, "_FILE")
+			name, ok = known[base]
+			if !isFile || !ok || !secrets[name] {
+				errs = append(errs, fmt.Errorf("%s: unknown environment variable", key))
+				continue
+			}
+			var err error
+			val, err = ReadSecret(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+		}
+		if prev, ok := from[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: conflicts with %s", key, prev))
+			continue
+		}
+		values[name], from[name] = val, key
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return values, nil
+}
+
+// EnvName returns the environment variable of a setting, the name upper-cased with - replaced by _
+// ex: SUGAR_AGENT_, exchange-name -> SUGAR_AGENT_EXCHANGE_NAME
+func EnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// ReadSecret reads a secret from a file, trailing line breaks are removed
+// path: secret file, ex: /run/secrets/mq_password
+// return: secret, error
+func ReadSecret(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("empty secret file path")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// FindFile returns the first existing file of paths, empty when none exists
+func FindFile(paths []string) string {
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// toString converts a value of a config file to the string form of a flag,
+// lists are joined by comma and maps are joined as k=v pairs sorted by key
+func toString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(t))
+		for _, item := range t {
+			s, err := scalarString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}, map[interface{}]interface{}:
+		m, _ := asMap(t)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := make([]string, 0, len(keys))
+		for _, k := range keys {
+			s, err := scalarString(m[k])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, k+"="+s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return scalarString(v)
+}
+
+func scalarString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int:
+		return strconv.Itoa(t), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case uint64:
+		return strconv.FormatUint(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported value %v of type %T", v, v)
+}
+
+// asMap returns a section as a map with string keys, YAML decodes sections with non-string keys as map[interface{}]interface{}
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = val
+		}
+		return m, true
+	}
+	return nil, false
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testSchema = Schema{
+	"mq.host":          "host",
+	"mq.port":          "port",
+	"mq.password":      "password",
+	"mq.queue.durable": "queue-durable",
+	"device.groups":    "groups",
+	"device.labels":    "labels",
+	"sinks.interval":   "sample-interval",
+}
+
+var testSecrets = map[string]bool{"password": true}
+
+// writeFile writes a file in a temp dir and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDecodeAndResolve(t *testing.T) {
+	secret := writeFile(t, "mq_password", "s3cret\n")
+	want := map[string]string{
+		"host":            "mq.local",
+		"port":            "5671",
+		"password":        "s3cret",
+		"queue-durable":   "true",
+		"groups":          "db,cache",
+		"labels":          "env=prod,role=db",
+		"sample-interval": "30s",
+	}
+	files := map[string]string{
+		"agent.yaml": `
+mq:
+  host: mq.local
+  port: 5671
+  password_file: ` + secret + `
+  queue:
+    durable: true
+device:
+  groups: [db, cache]
+  labels: {role: db, env: prod}
+sinks:
+  interval: 30s
+`,
+		"agent.toml": `
+[mq]
+host = "mq.local"
+port = 5671
+password_file = "` + secret + `"
+[mq.queue]
+durable = true
+[device]
+groups = ["db", "cache"]
+labels = {role = "db", env = "prod"}
+[sinks]
+interval = "30s"
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			tree, err := Decode(writeFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Resolve(tree, testSchema, testSecrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Resolve() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeEmptyAndUnknownFormat(t *testing.T) {
+	tree, err := Decode(writeFile(t, "empty.yml", ""))
+	if err != nil || len(tree) != 0 {
+		t.Fatalf("Decode(empty) = %v, %v", tree, err)
+	}
+	if _, err := Decode(writeFile(t, "agent.json", "{}")); err == nil {
+		t.Fatal("Decode(.json) returned no error")
+	}
+	if _, err := Decode(writeFile(t, "agent.yaml", "mq: [")); err == nil {
+		t.Fatal("Decode(invalid yaml) returned no error")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	secret := writeFile(t, "mq_password", "s3cret")
+	tests := []struct {
+		name    string
+		tree    map[string]interface{}
+		wantErr []string
+	}{
+		{"unknown key", map[string]interface{}{"mq": map[string]interface{}{"hots": "x"}}, []string{"mq.hots: unknown key"}},
+		{"unknown section", map[string]interface{}{"queue": map[string]interface{}{"durable": true}}, []string{"queue: unknown key"}},
+		{"section given a value", map[string]interface{}{"mq": "localhost"}, []string{"mq: must be a section"}},
+		{"secret given twice", map[string]interface{}{"mq": map[string]interface{}{"password": "a", "password_file": secret}}, []string{"mq.password_file: conflicts with mq.password"}},
+		{"_file of a non secret", map[string]interface{}{"mq": map[string]interface{}{"host_file": secret}}, []string{"mq.host_file: unknown key"}},
+		{"missing secret file", map[string]interface{}{"mq": map[string]interface{}{"password_file": secret + ".missing"}}, []string{"mq.password_file:"}},
+		{"nested list", map[string]interface{}{"device": map[string]interface{}{"groups": []interface{}{[]interface{}{"a"}}}}, []string{"device.groups: unsupported value"}},
+		{"every error is listed", map[string]interface{}{"a": 1, "b": 2}, []string{"a: unknown key", "b: unknown key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Resolve(tt.tree, testSchema, testSecrets)
+			if err == nil {
+				t.Fatal("Resolve() returned no error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Resolve() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	secret := writeFile(t, "mq_password", "s3cret\r\n")
+	names := []string{"host", "password", "exchange-name"}
+
+	t.Setenv("TEST_AGENT_HOST", "mq.local")
+	t.Setenv("TEST_AGENT_EXCHANGE_NAME", "tasks")
+	t.Setenv("TEST_AGENT_PASSWORD_FILE", secret)
+	t.Setenv("OTHER_HOST", "ignored")
+	got, err := FromEnv("TEST_AGENT_", names, testSecrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"host": "mq.local", "exchange-name": "tasks", "password": "s3cret"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("FromEnv() = %v, want %v", got, want)
+	}
+
+	t.Setenv("TEST_AGENT_PASSWORD", "plain")
+	t.Setenv("TEST_AGENT_HOST_FILE", secret)
+	t.Setenv("TEST_AGENT_HOTS", "typo")
+	_, err = FromEnv("TEST_AGENT_", names, testSecrets)
+	if err == nil {
+		t.Fatal("FromEnv() returned no error")
+	}
+	for _, want := range []string{
+		"TEST_AGENT_PASSWORD_FILE: conflicts with TEST_AGENT_PASSWORD",
+		"TEST_AGENT_HOST_FILE: unknown environment variable",
+		"TEST_AGENT_HOTS: unknown environment variable",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("FromEnv() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
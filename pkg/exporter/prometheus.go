@@ -0,0 +1,343 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/sink"
+)
+
+// metric name prefix of all exported series
+const namePrefix = "sugar_"
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Exporter serves the metrics of the collectors in Prometheus text or OpenMetrics exposition format
+type Exporter struct {
+	labels     map[string]string // device_id and device labels added to every series
+	collectors []internal.Collector
+	agent      func() []internal.Metric // metrics of the agent itself, ex: poisoned messages
+
+	// collecting is serialized, collectors keep state between calls; it is not done under mu, so a slow collection
+	// does not block the samples written by the feeder
+	collectMu   sync.Mutex
+	collected   []internal.Metric // metrics of the latest collection, delta metrics already summed up
+	collectedAt time.Time         // when the latest collection finished
+
+	mu       sync.Mutex
+	totals   map[string]float64 // delta metrics summed up into counters, by series key
+	feeder   *Sink              // the sink that wrote the latest sample, nil when the exporter collects on every scrape
+	latest   []internal.Metric  // metrics of the latest sample written to the feeder, delta metrics already summed up
+	latestAt time.Time
+}
+
+// New create a Prometheus exporter
+// labels: labels added to every series, ex: device_id and device labels
+// collectors: additional collectors sampled on every scrape
+// agent: returns metrics of the agent itself, may be nil
+// return: *Exporter
+func New(labels map[string]string, collectors []internal.Collector, agent func() []internal.Metric) *Exporter {
+	return &Exporter{
+		labels:     sanitizeLabels(labels),
+		collectors: collectors,
+		agent:      agent,
+		totals:     make(map[string]float64),
+	}
+}
+
+// Update replaces the common labels and the collectors, ex: after a config reload, the old collectors are closed
+// labels: labels added to every series
+// collectors: additional collectors sampled on every scrape
+// return: none
+func (e *Exporter) Update(labels map[string]string, collectors []internal.Collector) {
+	e.mu.Lock()
+	old := e.collectors
+	e.labels, e.collectors = sanitizeLabels(labels), collectors
+	// delta sums of removed series would never be reported again
+	e.totals = make(map[string]float64)
+	e.mu.Unlock()
+	// a running collection still uses the old collectors
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
+	internal.CloseCollectors(old)
+}
+
+// Close closes the collectors
+func (e *Exporter) Close() {
+	e.mu.Lock()
+	old := e.collectors
+	e.collectors = nil
+	e.mu.Unlock()
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
+	internal.CloseCollectors(old)
+}
+
+func sanitizeLabels(labels map[string]string) map[string]string {
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		l[sanitizeName(k)] = v
+	}
+	return l
+}
+
+// Serve serves /metrics on the listener, it blocks until the server fails
+// l: listener, ex: of :9100
+// return: error
+func (e *Exporter) Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	log.Printf("Serving Prometheus metrics on %s/metrics", l.Addr())
+	return http.Serve(l, mux)
+}
+
+// ServeHTTP collects the metrics and writes them in the format asked for by the Accept header
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics, labels, err := e.collect(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	var buf bytes.Buffer
+	Write(&buf, metrics, labels, openMetrics)
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypeText)
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+// collect samples the host and the collectors, or takes the latest sample written to the feeder,
+// delta metrics are turned into counters
+// return: metrics, common labels, error
+func (e *Exporter) collect(ctx context.Context) ([]internal.Metric, map[string]string, error) {
+	e.mu.Lock()
+	fed := e.latest != nil
+	metrics := append([]internal.Metric(nil), e.latest...)
+	e.mu.Unlock()
+	if !fed {
+		var err error
+		metrics, err = e.collectSummary(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.agent != nil {
+		metrics = append(metrics, e.counters(e.agent())...)
+	}
+	return metrics, e.labels, nil
+}
+
+// collectSummary samples the host and the collectors, scrapes waiting for a running collection share its metrics
+// return: metrics, delta metrics turned into counters, error
+func (e *Exporter) collectSummary(ctx context.Context) ([]internal.Metric, error) {
+	waiting := time.Now()
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
+	if e.collectedAt.After(waiting) {
+		return append([]internal.Metric(nil), e.collected...), nil
+	}
+	e.mu.Lock()
+	collectors := e.collectors
+	e.mu.Unlock()
+	// takes a second for the cpu usage plus the collectors
+	summary, err := internal.CollectSummary(ctx, collectors)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	metrics := e.counters(internal.SummaryMetrics(*summary))
+	e.mu.Unlock()
+	e.collected, e.collectedAt = metrics, time.Now()
+	return append([]internal.Metric(nil), metrics...), nil
+}
+
+// counters turns delta metrics into counters by summing them up, metrics are changed in place
+func (e *Exporter) counters(metrics []internal.Metric) []internal.Metric {
+	for i, m := range metrics {
+		if m.Type != internal.MetricDelta {
+			continue
+		}
+		key := seriesKey(m.Name, m.Labels)
+		e.totals[key] += m.Value
+		m.Name, m.Type, m.Value = m.Name+"_total", internal.MetricCounter, e.totals[key]
+		metrics[i] = m
+	}
+	return metrics
+}
+
+// Sink feeds the exporter through the output fan-out, ex: with the samples of background sampling, so Prometheus
+// gets the same samples as the other sinks; once a sample was written to it the exporter serves the latest one
+// instead of collecting on every scrape
+type Sink struct {
+	e *Exporter
+}
+
+// NewSink returns a sink feeding the exporter
+// return: *Sink
+func (e *Exporter) NewSink() *Sink {
+	return &Sink{e: e}
+}
+
+func (s *Sink) Name() string {
+	return "prometheus"
+}
+
+// Write keeps the latest of the samples, samples older than the one served are skipped
+func (s *Sink) Write(ctx context.Context, samples []sink.Sample) error {
+	e := s.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.feeder = s
+	for _, sample := range samples {
+		if !sample.Time.After(e.latestAt) {
+			continue
+		}
+		e.latest = e.counters(append([]internal.Metric(nil), sample.Metrics...))
+		e.latestAt = sample.Time
+	}
+	return nil
+}
+
+// Close stops feeding the exporter, it collects on every scrape again until another sink writes to it
+func (s *Sink) Close() error {
+	e := s.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.feeder == s {
+		e.feeder, e.latest, e.latestAt = nil, nil, time.Time{}
+	}
+	return nil
+}
+
+// Write writes metrics in Prometheus text format, or OpenMetrics format when openMetrics is true
+// buf: output
+// metrics: metrics, series of the same name are grouped into one family
+// labels: labels added to every series, labels of the metric take precedence
+// openMetrics: write OpenMetrics format
+// return: none
+func Write(buf *bytes.Buffer, metrics []internal.Metric, labels map[string]string, openMetrics bool) {
+	families := make(map[string][]internal.Metric)
+	var names []string
+	for _, m := range metrics {
+		name := namePrefix + sanitizeName(m.Name)
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+		families[name] = append(families[name], m)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := families[name]
+		first := family[0]
+		typ := first.Type
+		if typ != internal.MetricGauge && typ != internal.MetricCounter {
+			typ = "untyped"
+			if openMetrics {
+				typ = "unknown"
+			}
+		}
+		familyName := name
+		if openMetrics && typ == internal.MetricCounter {
+			// OpenMetrics counter families are named without the _total suffix of their samples
+			familyName = strings.TrimSuffix(name, "_total")
+		}
+		if first.Help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", familyName, escapeHelp(first.Help))
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", familyName, typ)
+		if openMetrics && first.Unit != "" && strings.HasSuffix(familyName, "_"+first.Unit) {
+			fmt.Fprintf(buf, "# UNIT %s %s\n", familyName, first.Unit)
+		}
+		for _, m := range family {
+			sampleName := name
+			if openMetrics && typ == internal.MetricCounter {
+				sampleName = familyName + "_total"
+			}
+			fmt.Fprintf(buf, "%s%s %s\n", sampleName, formatLabels(labels, m.Labels), formatValue(m.Value))
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+}
+
+// formatLabels formats the merged label set as {k="v",...}
+func formatLabels(common map[string]string, own map[string]string) string {
+	merged := make(map[string]string, len(common)+len(own))
+	for k, v := range common {
+		merged[k] = v
+	}
+	for k, v := range own {
+		merged[sanitizeName(k)] = v
+	}
+	if len(merged) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(merged[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value, including the special values
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sanitizeName replaces characters not allowed in metric and label names with '_'
+func sanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		ok := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// seriesKey identifies a series by name and labels
+func seriesKey(name string, labels map[string]string) string {
+	return name + formatLabels(nil, labels)
+}
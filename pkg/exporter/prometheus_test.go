@@ -0,0 +1,110 @@
+package exporter
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sugar-agent/internal"
+	"sugar-agent/pkg/sink"
+)
+
+func TestSinkServesLatestSample(t *testing.T) {
+	e := New(map[string]string{"device_id": "dev-1"}, nil, nil)
+	s := e.NewSink()
+	now := time.Now()
+	sample := func(at time.Time, load, bytes float64) sink.Sample {
+		return sink.Sample{Time: at, Metrics: []internal.Metric{
+			{Name: "load1", Type: internal.MetricGauge, Value: load},
+			{Name: "net_sent_bytes", Type: internal.MetricDelta, Value: bytes},
+		}}
+	}
+	// the second write is older than the sample served and is skipped
+	for _, samples := range [][]sink.Sample{
+		{sample(now.Add(-2*time.Second), 1, 100), sample(now.Add(-time.Second), 2, 50)},
+		{sample(now.Add(-3*time.Second), 9, 1000)},
+	} {
+		if err := s.Write(context.Background(), samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`sugar_load1{device_id="dev-1"} 2`,
+		`sugar_net_sent_bytes_total{device_id="dev-1"} 150`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition misses %q:\n%s", want, body)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e.feeder != nil || e.latest != nil {
+		t.Fatal("exporter still serves the samples of a closed sink")
+	}
+}
+
+// blockingCollector blocks in Collect until release is closed
+type blockingCollector struct {
+	entered chan struct{}
+	release chan struct{}
+	calls   int32
+}
+
+func (c *blockingCollector) Collect(ctx context.Context) ([]internal.Metric, error) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		close(c.entered)
+	}
+	<-c.release
+	return []internal.Metric{{Name: "slow", Type: internal.MetricGauge, Value: 1}}, nil
+}
+
+func (c *blockingCollector) Close() error { return nil }
+
+func TestSlowCollectionBlocksNoWrites(t *testing.T) {
+	c := &blockingCollector{entered: make(chan struct{}), release: make(chan struct{})}
+	e := New(nil, []internal.Collector{c}, nil)
+	var wg sync.WaitGroup
+	scrape := func() {
+		defer wg.Done()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if rec.Code != 200 {
+			t.Errorf("status = %d", rec.Code)
+		}
+	}
+	wg.Add(1)
+	go scrape()
+	<-c.entered
+	// a concurrent scrape waits for the running collection and shares it
+	wg.Add(1)
+	go scrape()
+	time.Sleep(50 * time.Millisecond)
+
+	written := make(chan error, 1)
+	go func() {
+		written <- e.NewSink().Write(context.Background(), []sink.Sample{{Time: time.Now()}})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write() blocked by a running collection")
+	}
+	close(c.release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&c.calls); n != 1 {
+		t.Fatalf("collector called %d times, want 1", n)
+	}
+}
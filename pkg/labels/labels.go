@@ -0,0 +1,75 @@
+package labels
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels is a set of key/value pairs attached to a device, ex: env=prod, role=db
+type Labels map[string]string
+
+// Parse parses labels from a comma separated string
+// str: ex: "env=prod,role=db,region=cn-east"
+// return: Labels, error
+func Parse(str string) (Labels, error) {
+	l := Labels{}
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validName(key) {
+			return nil, fmt.Errorf("invalid label: %q", item)
+		}
+		val = strings.TrimSpace(val)
+		if val != "" && !validName(val) {
+			return nil, fmt.Errorf("invalid label value: %q", item)
+		}
+		l[key] = val
+	}
+	return l, nil
+}
+
+// Has returns whether the label key exists
+func (l Labels) Has(key string) bool {
+	_, ok := l[key]
+	return ok
+}
+
+// Get returns the value of the label key
+func (l Labels) Get(key string) string {
+	return l[key]
+}
+
+// String returns labels as a sorted comma separated string
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, k+"="+l[k])
+	}
+	return strings.Join(items, ",")
+}
+
+// validName checks a label key or value: alphanumerics, '-', '_', '.' and '/'
+func validName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package labels
+
+import (
+	"fmt"
+	"strings"
+)
+
+// operators supported in a selector requirement
+const (
+	OpEquals       = "="
+	OpNotEquals    = "!="
+	OpIn           = "in"
+	OpNotIn        = "notin"
+	OpExists       = "exists"
+	OpDoesNotExist = "!"
+)
+
+// Requirement is a single expression of a selector, ex: env=prod, role in (db,cache)
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// Selector is a list of requirements which are ANDed, like Kubernetes label selectors
+type Selector []Requirement
+
+// ParseSelector parses a selector string
+// supported expressions, separated by comma:
+//
+//	key=value, key==value, key!=value
+//	key in (v1,v2), key notin (v1,v2)
+//	key, !key
+//
+// str: selector string, ex: "env=prod,role in (db,cache),!canary"
+// return: Selector, error
+func ParseSelector(str string) (Selector, error) {
+	var sel Selector
+	for _, expr := range splitExpressions(str) {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		req, err := parseRequirement(expr)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, *req)
+	}
+	return sel, nil
+}
+
+// Matches returns whether labels satisfy all requirements, an empty selector matches everything
+func (s Selector) Matches(l Labels) bool {
+	for _, r := range s {
+		if !r.Matches(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns whether labels satisfy the requirement
+func (r Requirement) Matches(l Labels) bool {
+	switch r.Operator {
+	case OpEquals, OpIn:
+		return l.Has(r.Key) && contains(r.Values, l.Get(r.Key))
+	case OpNotEquals, OpNotIn:
+		// like Kubernetes, a missing key satisfies != and notin
+		return !l.Has(r.Key) || !contains(r.Values, l.Get(r.Key))
+	case OpExists:
+		return l.Has(r.Key)
+	case OpDoesNotExist:
+		return !l.Has(r.Key)
+	}
+	return false
+}
+
+// parseRequirement parses a single expression, the operator is looked for right after the key,
+// so keys containing an operator like "instance" or "domain" are parsed correctly
+func parseRequirement(expr string) (*Requirement, error) {
+	if strings.HasPrefix(expr, "!") && !strings.ContainsAny(expr, "=() ") {
+		key := strings.TrimSpace(expr[1:])
+		if !validName(key) {
+			return nil, fmt.Errorf("invalid selector expression: %q", expr)
+		}
+		return &Requirement{Key: key, Operator: OpDoesNotExist}, nil
+	}
+	key := expr
+	if i := strings.IndexAny(expr, "!= \t("); i >= 0 {
+		key = expr[:i]
+	}
+	rest := strings.TrimSpace(expr[len(key):])
+	switch {
+	case rest == "":
+		return newRequirement(expr, key, OpExists, nil)
+	case strings.HasPrefix(rest, "!="):
+		return newRequirement(expr, key, OpNotEquals, []string{rest[2:]})
+	case strings.HasPrefix(rest, "=="):
+		return newRequirement(expr, key, OpEquals, []string{rest[2:]})
+	case strings.HasPrefix(rest, "="):
+		return newRequirement(expr, key, OpEquals, []string{rest[1:]})
+	}
+	op := rest
+	if i := strings.IndexAny(rest, " \t("); i >= 0 {
+		op = rest[:i]
+	}
+	if op != OpIn && op != OpNotIn {
+		return nil, fmt.Errorf("invalid selector operator %q in %q", op, expr)
+	}
+	set := strings.TrimSpace(rest[len(op):])
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return nil, fmt.Errorf("invalid selector value set in %q", expr)
+	}
+	values := strings.Split(set[1:len(set)-1], ",")
+	return newRequirement(expr, key, op, values)
+}
+
+// newRequirement validates and builds a requirement
+func newRequirement(expr string, key string, op string, values []string) (*Requirement, error) {
+	key = strings.TrimSpace(key)
+	if !validName(key) {
+		return nil, fmt.Errorf("invalid selector key in %q", expr)
+	}
+	for i, v := range values {
+		v = strings.TrimSpace(v)
+		if !validName(v) {
+			return nil, fmt.Errorf("invalid selector value in %q", expr)
+		}
+		values[i] = v
+	}
+	if (op == OpIn || op == OpNotIn) && len(values) == 0 {
+		return nil, fmt.Errorf("empty value set in %q", expr)
+	}
+	return &Requirement{Key: key, Operator: op, Values: values}, nil
+}
+
+// splitExpressions splits by comma, ignoring commas inside parentheses
+func splitExpressions(str string) []string {
+	var exprs []string
+	depth, start := 0, 0
+	for i, c := range str {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				exprs = append(exprs, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(exprs, str[start:])
+}
+
+func contains(values []string, val string) bool {
+	for _, v := range values {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
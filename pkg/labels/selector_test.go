@@ -0,0 +1,92 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    Selector
+		wantErr bool
+	}{
+		{str: "env=prod", want: Selector{{Key: "env", Operator: OpEquals, Values: []string{"prod"}}}},
+		{str: "env==prod", want: Selector{{Key: "env", Operator: OpEquals, Values: []string{"prod"}}}},
+		{str: "env != prod", want: Selector{{Key: "env", Operator: OpNotEquals, Values: []string{"prod"}}}},
+		{str: "role in (db, cache)", want: Selector{{Key: "role", Operator: OpIn, Values: []string{"db", "cache"}}}},
+		{str: "role in(db)", want: Selector{{Key: "role", Operator: OpIn, Values: []string{"db"}}}},
+		{str: "role notin (db,cache)", want: Selector{{Key: "role", Operator: OpNotIn, Values: []string{"db", "cache"}}}},
+		{str: "canary", want: Selector{{Key: "canary", Operator: OpExists}}},
+		{str: "!canary", want: Selector{{Key: "canary", Operator: OpDoesNotExist}}},
+		// keys containing an operator
+		{str: "instance in (a,b)", want: Selector{{Key: "instance", Operator: OpIn, Values: []string{"a", "b"}}}},
+		{str: "domain in (x)", want: Selector{{Key: "domain", Operator: OpIn, Values: []string{"x"}}}},
+		{str: "pinned notin (yes)", want: Selector{{Key: "pinned", Operator: OpNotIn, Values: []string{"yes"}}}},
+		{str: "notinstalled notin (a)", want: Selector{{Key: "notinstalled", Operator: OpNotIn, Values: []string{"a"}}}},
+		{str: "win=10", want: Selector{{Key: "win", Operator: OpEquals, Values: []string{"10"}}}},
+		{str: "login!=admin", want: Selector{{Key: "login", Operator: OpNotEquals, Values: []string{"admin"}}}},
+		{str: "bin", want: Selector{{Key: "bin", Operator: OpExists}}},
+		{str: "!inside", want: Selector{{Key: "inside", Operator: OpDoesNotExist}}},
+		{str: "env=prod,role in (db,cache),!canary", want: Selector{
+			{Key: "env", Operator: OpEquals, Values: []string{"prod"}},
+			{Key: "role", Operator: OpIn, Values: []string{"db", "cache"}},
+			{Key: "canary", Operator: OpDoesNotExist},
+		}},
+		{str: "", want: nil},
+		{str: "env=", wantErr: true},
+		{str: "=prod", wantErr: true},
+		{str: "env=a=b", wantErr: true},
+		{str: "env!prod", wantErr: true},
+		{str: "role in db", wantErr: true},
+		{str: "role in ()", wantErr: true},
+		{str: "role has (db)", wantErr: true},
+		{str: "in (a)", wantErr: true},
+		{str: "!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := ParseSelector(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSelector(%q) error = %v, wantErr %t", tt.str, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseSelector(%q) = %+v, want %+v", tt.str, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	l := Labels{"env": "prod", "role": "db", "instance": "a"}
+	tests := []struct {
+		str  string
+		want bool
+	}{
+		{"env=prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"zone!=east", true},
+		{"role in (db,cache)", true},
+		{"instance in (b,c)", false},
+		{"role notin (db)", false},
+		{"zone notin (east)", true},
+		{"env", true},
+		{"zone", false},
+		{"!zone", true},
+		{"!env", false},
+		{"env=prod,role in (web)", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			sel, err := ParseSelector(tt.str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Matches(l); got != tt.want {
+				t.Fatalf("%q.Matches(%v) = %t, want %t", tt.str, l, got, tt.want)
+			}
+		})
+	}
+}
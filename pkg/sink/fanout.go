@@ -0,0 +1,347 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Result the final result of a task, written to the sinks implementing ResultSink
+type Result struct {
+	TaskUUID string      `json:"taskUuid"`
+	TaskType int         `json:"taskType"`
+	Success  bool        `json:"success"`
+	Message  string      `json:"message"`
+	Data     interface{} `json:"data"`
+	Time     time.Time   `json:"time"`
+
+	Reporter StatusReporter `json:"-"` // reports the status of the task to the server it came from
+}
+
+// StatusReporter reports the status of a task to the server it came from, ex: through the sugar-server http API
+type StatusReporter interface {
+	UpdateTaskStatus(updateData map[string]interface{}) error
+}
+
+// ResultSink a sink that stores task results too, ex: the file sink
+type ResultSink interface {
+	WriteResult(ctx context.Context, r Result) error
+}
+
+// SyncResultSink a sink the task waits for, ex: sugar-server, the task message is acked only after its result
+// was reported, so Report writes the result in the calling task instead of queueing it; it takes no samples
+type SyncResultSink interface {
+	Sink
+	ReportResult(ctx context.Context, r Result) error
+}
+
+// Spec a sink with the size of its buffer
+type Spec struct {
+	Sink   Sink
+	Buffer int // max batches waiting for the sink, when full the oldest batch is dropped
+}
+
+// Stats delivery counters of one sink, samples are counted one by one and a result counts as one
+type Stats struct {
+	Sink      string `json:"sink"`
+	Delivered uint64 `json:"delivered"` // written to the sink
+	Failed    uint64 `json:"failed"`    // the sink returned an error after its retries
+	Dropped   uint64 `json:"dropped"`   // dropped because the buffer was full
+	Queued    int    `json:"queued"`    // batches waiting in the buffer
+	LastError string `json:"lastError,omitempty"`
+}
+
+// item a batch of samples or a result waiting in the buffer of a sink
+type item struct {
+	samples []Sample
+	result  *Result
+}
+
+func (it item) size() uint64 {
+	if it.result != nil {
+		return 1
+	}
+	return uint64(len(it.samples))
+}
+
+// output a sink with its own buffer and worker, a slow or failing sink does not block the others
+type output struct {
+	sink    Sink
+	queue   chan item
+	timeout time.Duration
+	done    chan struct{} // closed when the worker has written the queue
+
+	delivered, failed, dropped uint64
+	mu                         sync.Mutex
+	lastError                  string
+}
+
+// Fanout delivers samples and results to several sinks simultaneously
+type Fanout struct {
+	mu      sync.RWMutex
+	outputs []*output
+	closed  bool
+}
+
+// NewFanout create an empty fan-out, sinks are added by Add
+func NewFanout() *Fanout {
+	return &Fanout{}
+}
+
+// Add adds a sink and starts its worker
+// spec: the sink and its buffer size
+// timeout: max time of one write, retries of the sink included
+// return: none
+func (f *Fanout) Add(spec Spec, timeout time.Duration) {
+	o := startOutput(spec, timeout)
+	f.mu.Lock()
+	f.outputs = append(f.outputs, o)
+	f.mu.Unlock()
+}
+
+// Replace swaps all sinks at once, ex: after a config reload, the batches buffered for the old sinks are
+// delivered in background for up to drain, then the old sinks are closed, except those passed again in specs;
+// counters start from zero
+// specs: new sinks and their buffer sizes
+// timeout: max time of one write
+// drain: max time of delivering the batches buffered for the old sinks
+// return: none
+func (f *Fanout) Replace(specs []Spec, timeout, drain time.Duration) {
+	next := make([]*output, 0, len(specs))
+	for _, spec := range specs {
+		next = append(next, startOutput(spec, timeout))
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		for _, o := range next {
+			close(o.queue)
+		}
+		drainOutputs(next, drain, nil)
+		return
+	}
+	old := f.outputs
+	f.outputs = next
+	for _, o := range old {
+		close(o.queue)
+	}
+	f.mu.Unlock()
+	// a sink kept by the reload gets the batches of its old and its new buffer, it stays open
+	kept := make(map[Sink]bool, len(specs))
+	for _, spec := range specs {
+		kept[spec.Sink] = true
+	}
+	go drainOutputs(old, drain, kept)
+}
+
+// startOutput starts the worker of a sink
+func startOutput(spec Spec, timeout time.Duration) *output {
+	buffer := spec.Buffer
+	if buffer < 1 {
+		buffer = 1
+	}
+	o := &output{sink: spec.Sink, queue: make(chan item, buffer), timeout: timeout, done: make(chan struct{})}
+	go func() {
+		defer close(o.done)
+		o.run()
+	}()
+	return o
+}
+
+// drainOutputs waits up to timeout for the workers of closed queues and closes the sinks not in kept
+func drainOutputs(outputs []*output, timeout time.Duration, kept map[Sink]bool) {
+	deadline := time.After(timeout)
+wait:
+	for _, o := range outputs {
+		select {
+		case <-o.done:
+		case <-deadline:
+			log.Printf("[x] Sinks not drained in %s [x] -> queued batches are lost", timeout)
+			break wait
+		}
+	}
+	for _, o := range outputs {
+		if !kept[o.sink] {
+			_ = o.sink.Close()
+		}
+	}
+}
+
+// Len returns the number of sinks
+func (f *Fanout) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.outputs)
+}
+
+// SampleSinks returns the number of sinks taking samples
+func (f *Fanout) SampleSinks() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	n := 0
+	for _, o := range f.outputs {
+		if buffered(o.sink) {
+			n++
+		}
+	}
+	return n
+}
+
+// Write queues samples for every sink taking samples, it never blocks
+// samples: samples
+// return: none
+func (f *Fanout) Write(samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	f.enqueue(item{samples: samples}, buffered)
+}
+
+// Report writes a task result to the sinks implementing SyncResultSink and waits for them,
+// it is queued for the other sinks implementing ResultSink
+// r: Result
+// return: error of the first SyncResultSink failing
+func (f *Fanout) Report(r Result) error {
+	f.enqueue(item{result: &r}, func(s Sink) bool {
+		_, ok := s.(ResultSink)
+		return ok && buffered(s)
+	})
+	return f.ReportSync(r)
+}
+
+// ReportSync writes a task result to the sinks implementing SyncResultSink only and waits for them,
+// ex: to report a result again which the other sinks already got
+// r: Result
+// return: error of the first SyncResultSink failing
+func (f *Fanout) ReportSync(r Result) error {
+	// the lock is not held while waiting, so a reload or a write of samples is not blocked by a slow server
+	f.mu.RLock()
+	if f.closed {
+		f.mu.RUnlock()
+		return errors.New("outputs are closed")
+	}
+	var sync []*output
+	for _, o := range f.outputs {
+		if _, ok := o.sink.(SyncResultSink); ok {
+			sync = append(sync, o)
+		}
+	}
+	f.mu.RUnlock()
+	var firstErr error
+	for _, o := range sync {
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+		err := o.sink.(SyncResultSink).ReportResult(ctx, r)
+		cancel()
+		o.record(err, 1)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("sink %s: %w", o.sink.Name(), err)
+		}
+	}
+	return firstErr
+}
+
+// buffered reports whether samples and results are queued for a sink, the sinks the tasks wait for only take results
+// written by Report
+func buffered(s Sink) bool {
+	_, ok := s.(SyncResultSink)
+	return !ok
+}
+
+func (f *Fanout) enqueue(it item, accept func(Sink) bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return
+	}
+	for _, o := range f.outputs {
+		if accept(o.sink) {
+			o.enqueue(it)
+		}
+	}
+}
+
+// Stats returns the delivery counters of every sink
+func (f *Fanout) Stats() []Stats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	stats := make([]Stats, 0, len(f.outputs))
+	for _, o := range f.outputs {
+		o.mu.Lock()
+		lastError := o.lastError
+		o.mu.Unlock()
+		stats = append(stats, Stats{
+			Sink:      o.sink.Name(),
+			Delivered: atomic.LoadUint64(&o.delivered),
+			Failed:    atomic.LoadUint64(&o.failed),
+			Dropped:   atomic.LoadUint64(&o.dropped),
+			Queued:    len(o.queue),
+			LastError: lastError,
+		})
+	}
+	return stats
+}
+
+// Close stops accepting writes, waits up to timeout for the buffers to drain and closes the sinks
+// timeout: max wait time
+// return: none
+func (f *Fanout) Close(timeout time.Duration) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for _, o := range f.outputs {
+		close(o.queue)
+	}
+	f.mu.Unlock()
+	drainOutputs(f.outputs, timeout, nil)
+}
+
+// enqueue queues an item, the oldest item is dropped when the buffer is full
+func (o *output) enqueue(it item) {
+	for {
+		select {
+		case o.queue <- it:
+			return
+		default:
+		}
+		select {
+		case old := <-o.queue:
+			atomic.AddUint64(&o.dropped, old.size())
+		default:
+		}
+	}
+}
+
+// run writes the queued items to the sink until the queue is closed
+func (o *output) run() {
+	for it := range o.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+		var err error
+		if it.result != nil {
+			err = o.sink.(ResultSink).WriteResult(ctx, *it.result)
+		} else {
+			err = o.sink.Write(ctx, it.samples)
+		}
+		cancel()
+		o.record(err, it.size())
+	}
+}
+
+// record counts n samples or results written to the sink, err is the outcome of the write
+func (o *output) record(err error, n uint64) {
+	if err != nil {
+		atomic.AddUint64(&o.failed, n)
+		o.mu.Lock()
+		o.lastError = err.Error()
+		o.mu.Unlock()
+		log.Printf("[x] Failed to write to sink %s [x] -> %s", o.sink.Name(), err)
+		return
+	}
+	atomic.AddUint64(&o.delivered, n)
+}
@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink records what is written to it, writes block until release is closed
+type memorySink struct {
+	name    string
+	release chan struct{}
+
+	mu      sync.Mutex
+	samples int
+	results []string
+	closed  bool
+}
+
+func newMemorySink(name string) *memorySink {
+	s := &memorySink{name: name, release: make(chan struct{})}
+	close(s.release)
+	return s
+}
+
+func (s *memorySink) Name() string { return s.name }
+
+func (s *memorySink) Write(ctx context.Context, samples []Sample) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples += len(samples)
+	return nil
+}
+
+func (s *memorySink) WriteResult(ctx context.Context, r Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, r.TaskUUID)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// reportSink a SyncResultSink failing when the task failed
+type reportSink struct {
+	memorySink
+}
+
+func (s *reportSink) ReportResult(ctx context.Context, r Result) error {
+	if !r.Success {
+		return errors.New("server down")
+	}
+	return s.WriteResult(ctx, r)
+}
+
+func statsOf(f *Fanout, name string) Stats {
+	for _, st := range f.Stats() {
+		if st.Sink == name {
+			return st
+		}
+	}
+	return Stats{}
+}
+
+func TestFanoutReport(t *testing.T) {
+	server := &reportSink{memorySink: *newMemorySink("server")}
+	file := newMemorySink("file")
+	f := NewFanout()
+	f.Add(Spec{Sink: server}, time.Second)
+	f.Add(Spec{Sink: file, Buffer: 10}, time.Second)
+
+	if n := f.SampleSinks(); n != 1 {
+		t.Fatalf("SampleSinks() = %d, want 1", n)
+	}
+	f.Write([]Sample{{Time: time.Now()}, {Time: time.Now()}})
+	if err := f.Report(Result{TaskUUID: "ok", Success: true}); err != nil {
+		t.Fatalf("Report() = %v", err)
+	}
+	// the server has the result as soon as Report returns
+	if len(server.results) != 1 || server.results[0] != "ok" {
+		t.Fatalf("server results = %v", server.results)
+	}
+	if err := f.Report(Result{TaskUUID: "failed"}); err == nil {
+		t.Fatal("Report() of a failing server sink returned no error")
+	}
+	// reported again to the server only, the file has it already
+	if err := f.ReportSync(Result{TaskUUID: "failed", Success: true}); err != nil {
+		t.Fatalf("ReportSync() = %v", err)
+	}
+	if len(server.results) != 2 || server.results[1] != "failed" {
+		t.Fatalf("server results = %v", server.results)
+	}
+	f.Close(time.Second)
+
+	if server.samples != 0 {
+		t.Errorf("server got %d samples, want none", server.samples)
+	}
+	if file.samples != 2 || len(file.results) != 2 {
+		t.Errorf("file got %d samples and results %v, want 2 and both results", file.samples, file.results)
+	}
+	if st := statsOf(f, "server"); st.Delivered != 2 || st.Failed != 1 || st.LastError != "server down" {
+		t.Errorf("server stats = %+v", st)
+	}
+	if err := f.Report(Result{TaskUUID: "late", Success: true}); err == nil {
+		t.Error("Report() after Close returned no error")
+	}
+}
+
+func TestFanoutBufferPerSink(t *testing.T) {
+	slow, fast := newMemorySink("slow"), newMemorySink("fast")
+	slow.release = make(chan struct{})
+	f := NewFanout()
+	f.Add(Spec{Sink: slow, Buffer: 2}, time.Second)
+	f.Add(Spec{Sink: fast, Buffer: 100}, time.Second)
+
+	for i := 0; i < 10; i++ {
+		f.Write([]Sample{{Time: time.Now()}})
+	}
+	// the slow sink blocks on its first batch, two more wait in its buffer and the rest is dropped
+	deadline := time.Now().Add(time.Second)
+	for statsOf(f, "fast").Delivered < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(slow.release)
+	f.Close(time.Second)
+
+	if st := statsOf(f, "fast"); st.Delivered != 10 || st.Dropped != 0 {
+		t.Errorf("fast stats = %+v, want all delivered", st)
+	}
+	st := statsOf(f, "slow")
+	if st.Delivered+st.Dropped != 10 || st.Dropped < 7 {
+		t.Errorf("slow stats = %+v, want at least 7 of 10 dropped", st)
+	}
+}
+
+func TestFanoutReplaceKeepsReusedSink(t *testing.T) {
+	kept, removed := newMemorySink("file"), newMemorySink("otlp")
+	f := NewFanout()
+	f.Add(Spec{Sink: kept, Buffer: 10}, time.Second)
+	f.Add(Spec{Sink: removed, Buffer: 10}, time.Second)
+	f.Write([]Sample{{Time: time.Now()}})
+
+	f.Replace([]Spec{{Sink: kept, Buffer: 10}}, time.Second, time.Second)
+	deadline := time.Now().Add(time.Second)
+	for !removed.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !removed.isClosed() {
+		t.Fatal("removed sink not closed after draining")
+	}
+	if kept.isClosed() {
+		t.Fatal("sink passed again to Replace was closed")
+	}
+	f.Write([]Sample{{Time: time.Now()}})
+	f.Close(time.Second)
+	if !kept.isClosed() || kept.samples != 2 {
+		t.Fatalf("kept sink closed = %t with %d samples, want closed with 2", kept.closed, kept.samples)
+	}
+}
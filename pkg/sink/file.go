@@ -0,0 +1,544 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// file formats
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// file compressions
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// fileTimeLayout time part of the file names
+const fileTimeLayout = "20060102-150405"
+
+// FileOptions options of the file sink
+type FileOptions struct {
+	Dir       string        // output directory
+	Format    string        // jsonl or csv
+	Compress  string        // none, gzip or zstd
+	MaxBytes  int64         // rotate when this many uncompressed bytes are written to a file, 0 means never
+	MaxAge    time.Duration // rotate when a file is older, 0 means never
+	Retention time.Duration // delete rotated files older than this, 0 means keep them
+	MaxFiles  int           // keep at most this many rotated files of each kind, 0 means unlimited
+	Samples   bool          // write samples
+	Results   bool          // write task results
+}
+
+// FileSink writes samples and task results to local files, samples-<time>.<format>[.gz|.zst] and
+// results-<time>.<format>[.gz|.zst], so data can be collected on air-gapped machines and imported later.
+// CSV files have flattened column headers: a column per series for samples, a column per result field for results,
+// a new file is started when a record has columns the header of the current file lacks
+type FileSink struct {
+	opts FileOptions
+	res  Resource
+
+	mu      sync.Mutex
+	samples *rotatingFile
+	results *rotatingFile
+}
+
+// NewFile create a file sink
+// opts: FileOptions
+// res: the device
+// return: *FileSink, error
+func NewFile(opts FileOptions, res Resource) (*FileSink, error) {
+	err := opts.Check()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(opts.Dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSink{opts: opts, res: res}
+	s.samples = &rotatingFile{opts: &s.opts, kind: "samples"}
+	s.results = &rotatingFile{opts: &s.opts, kind: "results"}
+	// files left by previous runs
+	s.samples.cleanup()
+	s.results.cleanup()
+	return s, nil
+}
+
+// Reusable reports whether a sink created with opts and res would write the same files as s, ex: to keep it on a
+// config reload instead of a second sink writing to the same directory
+// opts: FileOptions
+// res: the device
+// return: bool
+func (s *FileSink) Reusable(opts FileOptions, res Resource) bool {
+	if opts.Check() != nil {
+		return false
+	}
+	return opts == s.opts && res.DeviceID == s.res.DeviceID && reflect.DeepEqual(res.Labels, s.res.Labels)
+}
+
+// Check fills in the default format and compression and checks the options, without touching the file system
+// return: error
+func (o *FileOptions) Check() error {
+	if o.Dir == "" {
+		return errors.New("output directory is required")
+	}
+	if o.Format == "" {
+		o.Format = FormatJSONL
+	}
+	if o.Format != FormatJSONL && o.Format != FormatCSV {
+		return fmt.Errorf("unsupported file format %q, expect jsonl or csv", o.Format)
+	}
+	if o.Compress == "" {
+		o.Compress = CompressNone
+	}
+	if o.Compress != CompressNone && o.Compress != CompressGzip && o.Compress != CompressZstd {
+		return fmt.Errorf("unsupported compression %q, expect none, gzip or zstd", o.Compress)
+	}
+	if !o.Samples && !o.Results {
+		return errors.New("nothing to write, enable samples or results")
+	}
+	if o.MaxBytes < 0 || o.MaxAge < 0 || o.Retention < 0 || o.MaxFiles < 0 {
+		return errors.New("rotation and retention limits must not be negative")
+	}
+	return nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Write writes one record per sample
+func (s *FileSink) Write(ctx context.Context, samples []Sample) error {
+	if !s.opts.Samples {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sample := range samples {
+		var err error
+		if s.opts.Format == FormatCSV {
+			err = s.samples.writeCSV(sampleRow(s.res, sample))
+		} else {
+			err = s.samples.writeJSON(s.sampleRecord(sample))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.samples.flush()
+}
+
+// WriteResult writes one record per task result
+func (s *FileSink) WriteResult(ctx context.Context, r Result) error {
+	if !s.opts.Results {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := map[string]interface{}{
+		"time":     r.Time.Format(time.RFC3339Nano),
+		"deviceId": s.res.DeviceID,
+		"taskUuid": r.TaskUUID,
+		"taskType": r.TaskType,
+		"success":  r.Success,
+		"message":  r.Message,
+		"data":     r.Data,
+	}
+	var err error
+	if s.opts.Format == FormatCSV {
+		row := make(map[string]string)
+		err = flatten("", record, row)
+		if err == nil {
+			err = s.results.writeCSV(row)
+		}
+	} else {
+		err = s.results.writeJSON(record)
+	}
+	if err != nil {
+		return err
+	}
+	return s.results.flush()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.samples.close(), s.results.close())
+}
+
+func (s *FileSink) sampleRecord(sample Sample) map[string]interface{} {
+	return map[string]interface{}{
+		"time":     sample.Time.Format(time.RFC3339Nano),
+		"deviceId": s.res.DeviceID,
+		"labels":   s.res.Labels,
+		"metrics":  sample.Metrics,
+	}
+}
+
+// WriteCSV writes samples as CSV with a column per series, the header is the union of the series of all samples
+// w: output
+// samples: samples
+// res: the device
+// return: error
+func WriteCSV(w io.Writer, samples []Sample, res Resource) error {
+	rows := make([]map[string]string, 0, len(samples))
+	columns := make(map[string]string)
+	for _, sample := range samples {
+		row := sampleRow(res, sample)
+		for column := range row {
+			columns[column] = ""
+		}
+		rows = append(rows, row)
+	}
+	header := csvHeader(columns)
+	cw := csv.NewWriter(w)
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make([]string, len(header))
+		for i, column := range header {
+			values[i] = row[column]
+		}
+		err = cw.Write(values)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sampleRow flattens a sample into a column per series, ex: log_pattern_matches{file=/var/log/app.log,pattern=errors}
+func sampleRow(res Resource, sample Sample) map[string]string {
+	row := map[string]string{
+		"time":      sample.Time.Format(time.RFC3339Nano),
+		"device_id": res.DeviceID,
+	}
+	for _, m := range sample.Metrics {
+		column := m.Name
+		if len(m.Labels) > 0 {
+			pairs := make([]string, 0, len(m.Labels))
+			for _, k := range sortedKeys(m.Labels) {
+				pairs = append(pairs, k+"="+m.Labels[k])
+			}
+			column += "{" + strings.Join(pairs, ",") + "}"
+		}
+		row[column] = strconv.FormatFloat(m.Value, 'f', -1, 64)
+	}
+	return row
+}
+
+// flatten flattens a JSON value into dot separated columns, arrays are kept as JSON
+func flatten(prefix string, v interface{}, row map[string]string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	err = json.Unmarshal(b, &generic)
+	if err != nil {
+		return err
+	}
+	flattenValue(prefix, generic, row)
+	return nil
+}
+
+func flattenValue(prefix string, v interface{}, row map[string]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenValue(key, child, row)
+		}
+	case []interface{}:
+		b, _ := json.Marshal(val)
+		row[prefix] = string(b)
+	case nil:
+		row[prefix] = ""
+	case string:
+		row[prefix] = val
+	default:
+		b, _ := json.Marshal(val)
+		row[prefix] = string(b)
+	}
+}
+
+// openFiles paths of the files written by any file sink, they are never deleted by cleanup
+var openFiles sync.Map
+
+// rotatingFile the current file of one kind, samples or results
+type rotatingFile struct {
+	opts *FileOptions
+	kind string
+
+	f        *os.File
+	comp     io.WriteCloser // compressor, nil without compression
+	w        *bufio.Writer
+	path     string
+	openedAt time.Time
+	written  int64
+	header   []string // columns of the current CSV file
+}
+
+// writeJSON writes a JSON line
+func (r *rotatingFile) writeJSON(record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = r.prepare(nil)
+	if err != nil {
+		return err
+	}
+	return r.write(append(b, '\n'))
+}
+
+// writeCSV writes a CSV row, a new file is started when the row has columns the current header lacks
+func (r *rotatingFile) writeCSV(row map[string]string) error {
+	err := r.prepare(row)
+	if err != nil {
+		return err
+	}
+	if r.header == nil {
+		r.header = csvHeader(row)
+		err = r.write(csvLine(r.header))
+		if err != nil {
+			return err
+		}
+	}
+	values := make([]string, len(r.header))
+	for i, column := range r.header {
+		values[i] = row[column]
+	}
+	return r.write(csvLine(values))
+}
+
+// prepare rotates the current file when it is too large, too old or lacks columns of row, and opens a new one
+func (r *rotatingFile) prepare(row map[string]string) error {
+	if r.w != nil && r.needRotate(row) {
+		err := r.close()
+		if err != nil {
+			return err
+		}
+		r.cleanup()
+	}
+	if r.w == nil {
+		return r.open()
+	}
+	return nil
+}
+
+func (r *rotatingFile) needRotate(row map[string]string) bool {
+	if r.opts.MaxBytes > 0 && r.written >= r.opts.MaxBytes {
+		return true
+	}
+	if r.opts.MaxAge > 0 && time.Since(r.openedAt) >= r.opts.MaxAge {
+		return true
+	}
+	if row != nil && r.header != nil {
+		known := make(map[string]bool, len(r.header))
+		for _, column := range r.header {
+			known[column] = true
+		}
+		for column := range row {
+			if !known[column] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *rotatingFile) open() error {
+	now := time.Now()
+	base := r.kind + "-" + now.Format(fileTimeLayout)
+	ext := "." + r.opts.Format + compressExt(r.opts.Compress)
+	path := filepath.Join(r.opts.Dir, base+ext)
+	// rotations within the same second get a sequence number
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(r.opts.Dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var comp io.WriteCloser
+	switch r.opts.Compress {
+	case CompressGzip:
+		comp = gzip.NewWriter(f)
+	case CompressZstd:
+		comp, err = zstd.NewWriter(f)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if comp != nil {
+		w = comp
+	}
+	openFiles.Store(path, true)
+	r.f, r.comp, r.w, r.path = f, comp, bufio.NewWriter(w), path
+	r.openedAt, r.written, r.header = now, 0, nil
+	return nil
+}
+
+func (r *rotatingFile) write(b []byte) error {
+	n, err := r.w.Write(b)
+	r.written += int64(n)
+	return err
+}
+
+// flush pushes buffered data to the file, compressed files stay readable up to the last flush
+func (r *rotatingFile) flush() error {
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if err != nil {
+		return err
+	}
+	if f, ok := r.comp.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (r *rotatingFile) close() error {
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if r.comp != nil {
+		err = errors.Join(err, r.comp.Close())
+	}
+	err = errors.Join(err, r.f.Close())
+	openFiles.Delete(r.path)
+	r.f, r.comp, r.w = nil, nil, nil
+	return err
+}
+
+// cleanup deletes rotated files older than Retention and beyond MaxFiles, the newest are kept
+func (r *rotatingFile) cleanup() {
+	if r.opts.Retention <= 0 && r.opts.MaxFiles <= 0 {
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(r.opts.Dir, r.kind+"-*"))
+	if err != nil {
+		return
+	}
+	// newest first, by the time in the name and then the sequence number of rotations within the same second,
+	// plain name order puts <base>-1.ext before <base>.ext and <base>-10.ext before <base>-2.ext
+	sort.Slice(paths, func(i, j int) bool {
+		ti, si := r.fileOrder(paths[i])
+		tj, sj := r.fileOrder(paths[j])
+		if ti != tj {
+			return ti > tj
+		}
+		return si > sj
+	})
+	kept := 0
+	for _, path := range paths {
+		// also the file of another sink in the same directory, ex: of the old sink still draining after a reload
+		if _, open := openFiles.Load(path); open {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		expired := r.opts.Retention > 0 && time.Since(info.ModTime()) > r.opts.Retention
+		if expired || (r.opts.MaxFiles > 0 && kept >= r.opts.MaxFiles) {
+			_ = os.Remove(path)
+			continue
+		}
+		kept++
+	}
+}
+
+// fileOrder returns the time part and the sequence number of a file name written by open, 0 without a sequence
+// ex: samples-20230311-101010-2.jsonl.gz -> 20230311-101010, 2
+func (r *rotatingFile) fileOrder(path string) (string, int) {
+	name := strings.TrimPrefix(filepath.Base(path), r.kind+"-")
+	if len(name) < len(fileTimeLayout) {
+		return name, 0
+	}
+	stamp, rest := name[:len(fileTimeLayout)], name[len(fileTimeLayout):]
+	if !strings.HasPrefix(rest, "-") {
+		return stamp, 0
+	}
+	rest = rest[1:]
+	if i := strings.IndexByte(rest, '.'); i >= 0 {
+		rest = rest[:i]
+	}
+	seq, err := strconv.Atoi(rest)
+	if err != nil {
+		return stamp, 0
+	}
+	return stamp, seq
+}
+
+// csvHeader returns the columns of a row: time and device_id first, the rest sorted
+func csvHeader(row map[string]string) []string {
+	header := []string{}
+	for _, first := range []string{"time", "device_id", "deviceId"} {
+		if _, ok := row[first]; ok {
+			header = append(header, first)
+		}
+	}
+	var rest []string
+	for column := range row {
+		if column != "time" && column != "device_id" && column != "deviceId" {
+			rest = append(rest, column)
+		}
+	}
+	sort.Strings(rest)
+	return append(header, rest...)
+}
+
+func csvLine(values []string) []byte {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	_ = w.Write(values)
+	w.Flush()
+	return []byte(b.String())
+}
+
+func compressExt(compress string) string {
+	switch compress {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFileCleanupKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	// an older second, then eleven rotations within the same second
+	names := []string{"samples-20230311-101009.jsonl", "samples-20230311-101010.jsonl"}
+	for i := 1; i <= 10; i++ {
+		names = append(names, fmt.Sprintf("samples-20230311-101010-%d.jsonl", i))
+	}
+	for _, name := range append(names, "results-20230311-101011.jsonl") {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &rotatingFile{opts: &FileOptions{Dir: dir, Format: FormatJSONL, MaxFiles: 3}, kind: "samples"}
+	r.cleanup()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	sort.Strings(left)
+	want := []string{
+		"results-20230311-101011.jsonl",
+		"samples-20230311-101010-10.jsonl",
+		"samples-20230311-101010-8.jsonl",
+		"samples-20230311-101010-9.jsonl",
+	}
+	if !reflect.DeepEqual(left, want) {
+		t.Fatalf("left %v, want %v", left, want)
+	}
+}
+
+func TestFileOrder(t *testing.T) {
+	r := &rotatingFile{kind: "results"}
+	for name, want := range map[string]struct {
+		stamp string
+		seq   int
+	}{
+		"results-20230311-101010.csv":        {"20230311-101010", 0},
+		"results-20230311-101010-2.csv.gz":   {"20230311-101010", 2},
+		"results-20230311-101010-12.csv.zst": {"20230311-101010", 12},
+	} {
+		stamp, seq := r.fileOrder(filepath.Join("/data", name))
+		if stamp != want.stamp || seq != want.seq {
+			t.Errorf("fileOrder(%s) = %s, %d, want %s, %d", name, stamp, seq, want.stamp, want.seq)
+		}
+	}
+}
+
+func TestFileCleanupSkipsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	res := Resource{DeviceID: "1", Labels: map[string]string{"env": "prod"}}
+	opts := FileOptions{Dir: dir, Samples: true, MaxFiles: 1}
+	old, err := NewFile(opts, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if err := old.Write(context.Background(), []Sample{{Time: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if !old.Reusable(opts, res) {
+		t.Fatal("Reusable() = false with the same options")
+	}
+	changed := opts
+	changed.MaxFiles = 0
+	if old.Reusable(changed, res) || old.Reusable(opts, Resource{DeviceID: "1", Labels: map[string]string{"env": "dev"}}) {
+		t.Fatal("Reusable() = true with other options or labels")
+	}
+
+	// a second sink in the same directory, ex: created by a reload while the old one drains
+	next, err := NewFile(changed, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	next.samples.opts.Retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	next.samples.cleanup()
+	if _, err := os.Stat(old.samples.path); err != nil {
+		t.Fatalf("file of the old sink deleted by the cleanup of the new one: %v", err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	next.samples.cleanup()
+	if _, err := os.Stat(old.samples.path); !os.IsNotExist(err) {
+		t.Fatalf("closed file older than the retention kept: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphiteOptions options of the Graphite sink
+type GraphiteOptions struct {
+	Address    string // carbon plaintext listener, ex: localhost:2003
+	Prefix     string // path prefix, ex: sugar
+	Tagged     bool   // write tagged series name;tag=value instead of hierarchical paths
+	MaxBatch   int    // max lines per write
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+// GraphiteSink writes samples in Graphite plaintext protocol over TCP, timestamps are in seconds,
+// hierarchical paths are <prefix>.<device_id>.<metric>[.<label value>...] with label values sorted by label name,
+// tagged series are <prefix>.<metric>;device_id=<id>;<label>=<value>...
+type GraphiteSink struct {
+	opts GraphiteOptions
+	res  Resource
+
+	mu   sync.Mutex
+	conn net.Conn // reused between writes, reconnected after an error
+}
+
+// NewGraphite create a Graphite sink
+// opts: GraphiteOptions
+// res: the device
+// return: *GraphiteSink, error
+func NewGraphite(opts GraphiteOptions, res Resource) (*GraphiteSink, error) {
+	if opts.Address == "" {
+		return nil, errors.New("graphite address is required")
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, fmt.Errorf("invalid graphite address: %w", err)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 5000
+	}
+	return &GraphiteSink{opts: opts, res: res}, nil
+}
+
+func (s *GraphiteSink) Name() string {
+	return "graphite"
+}
+
+// Write writes samples in batches of at most MaxBatch lines, Graphite does not acknowledge lines,
+// so a batch is delivered once it is written to the connection
+func (s *GraphiteSink) Write(ctx context.Context, samples []Sample) error {
+	lines := s.lines(samples)
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > s.opts.MaxBatch {
+			n = s.opts.MaxBatch
+		}
+		var buf bytes.Buffer
+		for _, line := range lines[:n] {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+		err := Retry(ctx, s.opts.MaxRetries, func() error {
+			return s.send(ctx, buf.Bytes())
+		})
+		if err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+func (s *GraphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// send writes data to the connection, the connection is dropped on error
+func (s *GraphiteSink) send(ctx context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		d := net.Dialer{Timeout: s.opts.Timeout}
+		conn, err := d.DialContext(ctx, "tcp", s.opts.Address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.opts.Timeout))
+	_, err := s.conn.Write(data)
+	if err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// lines formats samples as "<path> <value> <timestamp>", NaN and infinities are left out
+func (s *GraphiteSink) lines(samples []Sample) []string {
+	var lines []string
+	for _, sample := range samples {
+		ts := sample.Time.Unix()
+		for _, m := range sample.Metrics {
+			if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+				continue
+			}
+			var path string
+			if s.opts.Tagged {
+				path = s.taggedPath(m.Name, m.Labels)
+			} else {
+				path = s.hierarchicalPath(m.Name, m.Labels)
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %d", path, strconv.FormatFloat(m.Value, 'f', -1, 64), ts))
+		}
+	}
+	return lines
+}
+
+func (s *GraphiteSink) hierarchicalPath(name string, labels map[string]string) string {
+	nodes := []string{graphiteNode(s.res.DeviceID), graphiteNode(name)}
+	if s.opts.Prefix != "" {
+		nodes = append([]string{strings.Trim(s.opts.Prefix, ".")}, nodes...)
+	}
+	for _, k := range sortedKeys(labels) {
+		nodes = append(nodes, graphiteNode(labels[k]))
+	}
+	return strings.Join(nodes, ".")
+}
+
+func (s *GraphiteSink) taggedPath(name string, labels map[string]string) string {
+	path := graphiteNode(name)
+	if s.opts.Prefix != "" {
+		path = strings.Trim(s.opts.Prefix, ".") + "." + path
+	}
+	tags := seriesTags(s.res, labels)
+	for _, k := range sortedKeys(tags) {
+		if k == "" || tags[k] == "" || k == "name" {
+			// empty tags are invalid, name is the series name in graphite
+			continue
+		}
+		path += ";" + graphiteTag(k) + "=" + graphiteTag(tags[k])
+	}
+	return path
+}
+
+// graphiteNode replaces characters not allowed in a path node with '_'
+func graphiteNode(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// graphiteTag replaces characters not allowed in tag names and values with '_'
+func graphiteTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(";!^=~ \t\n", r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,210 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxDB write API versions
+const (
+	InfluxV1 = "1"
+	InfluxV2 = "2"
+)
+
+// InfluxOptions options of the InfluxDB sink
+type InfluxOptions struct {
+	URL             string // ex: http://localhost:8086
+	Version         string // write API version: 1 or 2
+	Database        string // v1 database
+	RetentionPolicy string // v1 retention policy, empty means the default one
+	Username        string // v1 user
+	Password        string // v1 password
+	Token           string // v2 API token
+	Org             string // v2 organization
+	Bucket          string // v2 bucket
+	Precision       string // timestamp precision: ns, us, ms or s
+	MaxBatch        int    // max lines per request
+	Timeout         time.Duration
+	MaxRetries      int
+}
+
+// InfluxSink writes samples in InfluxDB line protocol over the HTTP write API,
+// each metric is a measurement with a single field value, tagged with device_id, the device labels and its labels
+type InfluxSink struct {
+	opts     InfluxOptions
+	client   *http.Client
+	res      Resource
+	writeURL string
+}
+
+// NewInflux create an InfluxDB sink
+// opts: InfluxOptions
+// res: the device
+// return: *InfluxSink, error
+func NewInflux(opts InfluxOptions, res Resource) (*InfluxSink, error) {
+	if opts.URL == "" {
+		return nil, errors.New("influxdb url is required")
+	}
+	if opts.Precision == "" {
+		opts.Precision = "s"
+	}
+	if _, err := precisionUnit(opts.Precision); err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 5000
+	}
+	q := url.Values{}
+	var path string
+	switch opts.Version {
+	case InfluxV1:
+		if opts.Database == "" {
+			return nil, errors.New("influxdb database is required with write API v1")
+		}
+		path = "/write"
+		q.Set("db", opts.Database)
+		if opts.RetentionPolicy != "" {
+			q.Set("rp", opts.RetentionPolicy)
+		}
+		// v1 names nanoseconds and microseconds n and u
+		q.Set("precision", map[string]string{"ns": "n", "us": "u", "ms": "ms", "s": "s"}[opts.Precision])
+	case InfluxV2:
+		if opts.Org == "" || opts.Bucket == "" {
+			return nil, errors.New("influxdb org and bucket are required with write API v2")
+		}
+		path = "/api/v2/write"
+		q.Set("org", opts.Org)
+		q.Set("bucket", opts.Bucket)
+		q.Set("precision", opts.Precision)
+	default:
+		return nil, fmt.Errorf("unsupported influxdb version %q, expect 1 or 2", opts.Version)
+	}
+	return &InfluxSink{
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		res:      res,
+		writeURL: strings.TrimRight(opts.URL, "/") + path + "?" + q.Encode(),
+	}, nil
+}
+
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+// Write writes samples in batches of at most MaxBatch lines
+func (s *InfluxSink) Write(ctx context.Context, samples []Sample) error {
+	lines := s.lines(samples)
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > s.opts.MaxBatch {
+			n = s.opts.MaxBatch
+		}
+		err := s.write(ctx, lines[:n])
+		if err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+func (s *InfluxSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// write sends one batch
+func (s *InfluxSink) write(ctx context.Context, lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	return Retry(ctx, s.opts.MaxRetries, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if s.opts.Version == InfluxV2 {
+			req.Header.Set("Authorization", "Token "+s.opts.Token)
+		} else if s.opts.Username != "" {
+			req.SetBasicAuth(s.opts.Username, s.opts.Password)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return checkResponse(resp)
+	})
+}
+
+// lines formats samples in line protocol: measurement,tag=value value=1.5 timestamp,
+// NaN and infinities are not supported by InfluxDB and are left out
+func (s *InfluxSink) lines(samples []Sample) []string {
+	unit, _ := precisionUnit(s.opts.Precision)
+	var lines []string
+	for _, sample := range samples {
+		ts := sample.Time.UnixNano() / int64(unit)
+		for _, m := range sample.Metrics {
+			if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+				continue
+			}
+			var b strings.Builder
+			b.WriteString(influxEscape(m.Name, ", "))
+			tags := seriesTags(s.res, m.Labels)
+			for _, k := range sortedKeys(tags) {
+				if k == "" || tags[k] == "" {
+					// empty tag values are invalid
+					continue
+				}
+				fmt.Fprintf(&b, ",%s=%s", influxEscape(k, ",= "), influxEscape(tags[k], ",= "))
+			}
+			fmt.Fprintf(&b, " value=%s %d", strconv.FormatFloat(m.Value, 'g', -1, 64), ts)
+			lines = append(lines, b.String())
+		}
+	}
+	return lines
+}
+
+// precisionUnit returns the duration of a timestamp unit
+func precisionUnit(precision string) (time.Duration, error) {
+	switch precision {
+	case "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("unsupported precision %q, expect ns, us, ms or s", precision)
+}
+
+// influxEscape escapes the special characters of a line protocol element with a backslash
+func influxEscape(s string, special string) string {
+	if !strings.ContainsAny(s, special+"\n") {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\n' {
+			// newlines can not be escaped
+			c = ' '
+		}
+		if strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,419 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sugar-agent/internal"
+)
+
+// OTLP encodings
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// OTLP aggregation temporality
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+// OTLPOptions options of the OTLP/HTTP metrics sink
+type OTLPOptions struct {
+	Endpoint   string            // ex: http://localhost:4318/v1/metrics
+	Encoding   string            // protobuf or json
+	Headers    map[string]string // ex: authentication headers
+	Timeout    time.Duration     // timeout of one request
+	MaxBatch   int               // max data points per request
+	MaxRetries int               // max retries of a failed request
+}
+
+// OTLPSink exports samples as OTLP metrics over HTTP
+type OTLPSink struct {
+	opts      OTLPOptions
+	client    *http.Client
+	resource  []otlpKeyValue
+	version   string
+	startedAt time.Time // start time of cumulative counters
+
+	mu        sync.Mutex
+	lastDelta map[string]time.Time // series -> time of its previous delta point, the start of the next interval
+}
+
+// NewOTLP create an OTLP/HTTP metrics sink
+// opts: OTLPOptions
+// res: the device, resource attributes are built from it
+// return: *OTLPSink, error
+func NewOTLP(opts OTLPOptions, res Resource) (*OTLPSink, error) {
+	if opts.Endpoint == "" {
+		return nil, errors.New("otlp endpoint is required")
+	}
+	if opts.Encoding == "" {
+		opts.Encoding = EncodingProtobuf
+	}
+	if opts.Encoding != EncodingProtobuf && opts.Encoding != EncodingJSON {
+		return nil, fmt.Errorf("unsupported otlp encoding %q, expect protobuf or json", opts.Encoding)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 1000
+	}
+	return &OTLPSink{
+		opts:      opts,
+		client:    &http.Client{Timeout: opts.Timeout},
+		resource:  otlpResourceAttributes(res),
+		version:   res.Version,
+		startedAt: time.Now(),
+		lastDelta: make(map[string]time.Time),
+	}, nil
+}
+
+func (s *OTLPSink) Name() string {
+	return "otlp"
+}
+
+// Write exports samples in batches of at most MaxBatch data points, a sample is never split
+func (s *OTLPSink) Write(ctx context.Context, samples []Sample) error {
+	var batch []Sample
+	points := 0
+	for _, sample := range samples {
+		if len(batch) > 0 && points+len(sample.Metrics) > s.opts.MaxBatch {
+			err := s.export(ctx, batch)
+			if err != nil {
+				return err
+			}
+			batch, points = nil, 0
+		}
+		batch = append(batch, sample)
+		points += len(sample.Metrics)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return s.export(ctx, batch)
+}
+
+func (s *OTLPSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// export sends one request, retrying as the OTLP/HTTP specification recommends
+func (s *OTLPSink) export(ctx context.Context, samples []Sample) error {
+	req := s.buildRequest(samples)
+	var body []byte
+	contentType := "application/x-protobuf"
+	if s.opts.Encoding == EncodingJSON {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = req.marshalProto()
+	}
+	return Retry(ctx, s.opts.MaxRetries, func() error {
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("User-Agent", "sugar-agent/"+s.version)
+		for k, v := range s.opts.Headers {
+			r.Header.Set(k, v)
+		}
+		resp, err := s.client.Do(r)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return checkResponse(resp)
+	})
+}
+
+// buildRequest groups the data points of the samples into metrics, by name in order of appearance
+func (s *OTLPSink) buildRequest(samples []Sample) *otlpRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var metrics []*otlpMetric
+	byName := make(map[string]*otlpMetric)
+	for _, sample := range samples {
+		ts := uint64(sample.Time.UnixNano())
+		for _, m := range sample.Metrics {
+			om, ok := byName[m.Name]
+			if !ok {
+				om = &otlpMetric{Name: m.Name, Description: m.Help, Unit: otlpUnit(m.Unit)}
+				switch m.Type {
+				case internal.MetricCounter:
+					om.Sum = &otlpSum{AggregationTemporality: temporalityCumulative, IsMonotonic: true}
+				case internal.MetricDelta:
+					om.Sum = &otlpSum{AggregationTemporality: temporalityDelta, IsMonotonic: true}
+				default:
+					om.Gauge = &otlpGauge{}
+				}
+				byName[m.Name] = om
+				metrics = append(metrics, om)
+			}
+			dp := otlpDataPoint{Attributes: otlpAttributes(m.Labels), TimeUnixNano: ts, AsDouble: otlpDouble(m.Value)}
+			if om.Sum != nil {
+				if om.Sum.AggregationTemporality == temporalityCumulative {
+					dp.StartTimeUnixNano = uint64(s.startedAt.UnixNano())
+				} else {
+					// a delta covers the interval since the previous point of the series, the first one since the start
+					key := otlpSeriesKey(m)
+					start, ok := s.lastDelta[key]
+					if !ok || start.After(sample.Time) {
+						start = s.startedAt
+					}
+					dp.StartTimeUnixNano = uint64(start.UnixNano())
+					s.lastDelta[key] = sample.Time
+				}
+				om.Sum.DataPoints = append(om.Sum.DataPoints, dp)
+			} else {
+				om.Gauge.DataPoints = append(om.Gauge.DataPoints, dp)
+			}
+		}
+	}
+	sm := otlpScopeMetrics{Scope: otlpScope{Name: "sugar-agent", Version: s.version}}
+	for _, m := range metrics {
+		sm.Metrics = append(sm.Metrics, *m)
+	}
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: s.resource},
+		ScopeMetrics: []otlpScopeMetrics{sm},
+	}}}
+}
+
+// otlpSeriesKey identifies a series by its name and labels
+func otlpSeriesKey(m internal.Metric) string {
+	var b strings.Builder
+	b.WriteString(m.Name)
+	for _, a := range otlpAttributes(m.Labels) {
+		b.WriteString("\x00" + a.Key + "=" + a.Value.StringValue)
+	}
+	return b.String()
+}
+
+// otlpResourceAttributes builds the resource attributes following the OpenTelemetry semantic conventions
+func otlpResourceAttributes(res Resource) []otlpKeyValue {
+	attrs := []otlpKeyValue{
+		otlpString("service.name", "sugar-agent"),
+		otlpString("service.version", res.Version),
+		otlpString("device.id", res.DeviceID),
+		otlpString("host.name", res.Host.Hostname),
+		otlpString("host.id", res.Host.HostID),
+		otlpString("host.arch", otlpArch(res.Host.KernelArch)),
+		otlpString("os.type", res.Host.OS),
+		otlpString("os.version", res.Host.PlatformVersion),
+	}
+	attrs = append(attrs, otlpAttributes(res.Labels)...)
+	// empty values, ex: unknown host id, are left out
+	n := 0
+	for _, a := range attrs {
+		if a.Value.StringValue != "" {
+			attrs[n] = a
+			n++
+		}
+	}
+	return attrs[:n]
+}
+
+// otlpArch maps `uname -m` to the host.arch values of the semantic conventions
+func otlpArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i686":
+		return "x86"
+	case "ppc64le", "ppc64":
+		return "ppc64"
+	}
+	return arch
+}
+
+// otlpUnit maps units to UCUM
+func otlpUnit(unit string) string {
+	switch unit {
+	case "bytes":
+		return "By"
+	case "seconds":
+		return "s"
+	case "percent":
+		return "%"
+	}
+	return unit
+}
+
+// otlpAttributes converts labels to attributes sorted by key
+func otlpAttributes(labels map[string]string) []otlpKeyValue {
+	if len(labels) == 0 {
+		return nil
+	}
+	attrs := make([]otlpKeyValue, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, otlpString(k, v))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// OTLP ExportMetricsServiceRequest, only the fields used by the agent,
+// json tags follow the OTLP/JSON encoding, proto field numbers follow opentelemetry/proto/metrics/v1
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,omitempty,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          otlpDouble     `json:"asDouble"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpDouble a double, NaN and infinities are encoded as strings in OTLP/JSON
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	v := float64(d)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(v)
+}
+
+func (r *otlpRequest) marshalProto() []byte {
+	var b protoBuf
+	for _, rm := range r.ResourceMetrics {
+		b.message(1, func(b *protoBuf) {
+			b.message(1, func(b *protoBuf) {
+				for _, kv := range rm.Resource.Attributes {
+					b.message(1, kv.marshalProto)
+				}
+			})
+			for _, sm := range rm.ScopeMetrics {
+				b.message(2, func(b *protoBuf) {
+					b.message(1, func(b *protoBuf) {
+						b.string(1, sm.Scope.Name)
+						b.string(2, sm.Scope.Version)
+					})
+					for _, m := range sm.Metrics {
+						b.message(2, m.marshalProto)
+					}
+				})
+			}
+		})
+	}
+	return b
+}
+
+func (m otlpMetric) marshalProto(b *protoBuf) {
+	b.string(1, m.Name)
+	b.string(2, m.Description)
+	b.string(3, m.Unit)
+	if m.Gauge != nil {
+		b.message(5, func(b *protoBuf) {
+			for _, dp := range m.Gauge.DataPoints {
+				b.message(1, dp.marshalProto)
+			}
+		})
+	}
+	if m.Sum != nil {
+		b.message(7, func(b *protoBuf) {
+			for _, dp := range m.Sum.DataPoints {
+				b.message(1, dp.marshalProto)
+			}
+			b.uint(2, uint64(m.Sum.AggregationTemporality))
+			b.bool(3, m.Sum.IsMonotonic)
+		})
+	}
+}
+
+func (dp otlpDataPoint) marshalProto(b *protoBuf) {
+	b.fixed64(2, dp.StartTimeUnixNano)
+	b.fixed64(3, dp.TimeUnixNano)
+	b.double(4, float64(dp.AsDouble))
+	for _, kv := range dp.Attributes {
+		b.message(7, kv.marshalProto)
+	}
+}
+
+func (kv otlpKeyValue) marshalProto(b *protoBuf) {
+	b.string(1, kv.Key)
+	b.message(2, func(b *protoBuf) {
+		// string_value is part of a oneof, an empty string is written too
+		b.tag(1, wireBytes)
+		b.varint(uint64(len(kv.Value.StringValue)))
+		*b = append(*b, kv.Value.StringValue...)
+	})
+}
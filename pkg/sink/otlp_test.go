@@ -0,0 +1,394 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"sugar-agent/internal"
+)
+
+// protoFields a decoded protobuf message: field number -> values, []byte for length delimited fields, uint64 otherwise
+type protoFields map[int][]interface{}
+
+// decodeProto decodes one level of a protobuf message
+func decodeProto(t *testing.T, b []byte) protoFields {
+	t.Helper()
+	fields := protoFields{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag at %x", b)
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint of field %d", field)
+			}
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("short fixed64 of field %d", field)
+			}
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length of field %d", field)
+			}
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", key&7, field)
+		}
+	}
+	return fields
+}
+
+func (f protoFields) message(t *testing.T, field int) protoFields {
+	t.Helper()
+	if len(f[field]) != 1 {
+		t.Fatalf("field %d has %d values, want 1", field, len(f[field]))
+	}
+	return decodeProto(t, f[field][0].([]byte))
+}
+
+func (f protoFields) messages(t *testing.T, field int) []protoFields {
+	t.Helper()
+	var ms []protoFields
+	for _, v := range f[field] {
+		ms = append(ms, decodeProto(t, v.([]byte)))
+	}
+	return ms
+}
+
+func (f protoFields) string(field int) string {
+	if len(f[field]) == 0 {
+		return ""
+	}
+	return string(f[field][0].([]byte))
+}
+
+func (f protoFields) uint(field int) uint64 {
+	if len(f[field]) == 0 {
+		return 0
+	}
+	return f[field][0].(uint64)
+}
+
+// protoAttributes decodes repeated KeyValue fields with string values
+func protoAttributes(t *testing.T, f protoFields, field int) map[string]string {
+	t.Helper()
+	attrs := make(map[string]string)
+	for _, kv := range f.messages(t, field) {
+		attrs[kv.string(1)] = kv.message(t, 2).string(1)
+	}
+	return attrs
+}
+
+// fakeCollector an OTLP/HTTP collector recording the requests, responding with the queued status codes first
+type fakeCollector struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	statuses     []int
+	bodies       [][]byte
+	contentTypes []string
+}
+
+func newFakeCollector(t *testing.T, statuses ...int) *fakeCollector {
+	c := &fakeCollector{statuses: statuses}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.bodies = append(c.bodies, body)
+		c.contentTypes = append(c.contentTypes, r.Header.Get("Content-Type"))
+		if len(c.statuses) > 0 {
+			status := c.statuses[0]
+			c.statuses = c.statuses[1:]
+			if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *fakeCollector) requests() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.bodies...)
+}
+
+var testResource = Resource{
+	DeviceID: "6",
+	Labels:   map[string]string{"env": "prod"},
+	Host:     internal.HostInfo{Hostname: "web-1", KernelArch: "x86_64", OS: "linux"},
+	Version:  "1.2.3",
+}
+
+func testSample(at time.Time) Sample {
+	return Sample{Time: at, Metrics: []internal.Metric{
+		{Name: "cpu_percent", Type: internal.MetricGauge, Unit: "percent", Value: 12.5, Labels: map[string]string{"cpu": "0"}},
+		{Name: "net_bytes_sent", Type: internal.MetricCounter, Unit: "bytes", Value: 1024},
+		{Name: "log_pattern_matches", Type: internal.MetricDelta, Value: 3, Labels: map[string]string{"pattern": "errors"}},
+	}}
+}
+
+func newTestOTLP(t *testing.T, endpoint string, opts OTLPOptions) *OTLPSink {
+	t.Helper()
+	opts.Endpoint = endpoint
+	s, err := NewOTLP(opts, testResource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	c := newFakeCollector(t)
+	s := newTestOTLP(t, c.URL, OTLPOptions{})
+	at := time.Unix(1700000000, 5)
+	if err := s.Write(context.Background(), []Sample{testSample(at)}); err != nil {
+		t.Fatal(err)
+	}
+	reqs := c.requests()
+	if len(reqs) != 1 || c.contentTypes[0] != "application/x-protobuf" {
+		t.Fatalf("requests = %d, content type %v", len(reqs), c.contentTypes)
+	}
+
+	// ExportMetricsServiceRequest.resource_metrics = 1
+	rm := decodeProto(t, reqs[0]).message(t, 1)
+	// ResourceMetrics.resource = 1, Resource.attributes = 1
+	res := protoAttributes(t, rm.message(t, 1), 1)
+	want := map[string]string{
+		"service.name": "sugar-agent", "service.version": "1.2.3", "device.id": "6",
+		"host.name": "web-1", "host.arch": "amd64", "os.type": "linux", "env": "prod",
+	}
+	if len(res) != len(want) {
+		t.Errorf("resource attributes = %v, want %v", res, want)
+	}
+	for k, v := range want {
+		if res[k] != v {
+			t.Errorf("resource attribute %s = %q, want %q", k, res[k], v)
+		}
+	}
+	// ResourceMetrics.scope_metrics = 2, ScopeMetrics.scope = 1
+	sm := rm.message(t, 2)
+	if scope := sm.message(t, 1); scope.string(1) != "sugar-agent" || scope.string(2) != "1.2.3" {
+		t.Errorf("scope = %q %q", scope.string(1), scope.string(2))
+	}
+	// ScopeMetrics.metrics = 2
+	metrics := sm.messages(t, 2)
+	if len(metrics) != 3 {
+		t.Fatalf("metrics = %d, want 3", len(metrics))
+	}
+
+	// Metric.gauge = 5, Gauge.data_points = 1
+	gauge := metrics[0]
+	if gauge.string(1) != "cpu_percent" || gauge.string(3) != "%" || len(gauge[7]) != 0 {
+		t.Errorf("gauge metric name %q unit %q", gauge.string(1), gauge.string(3))
+	}
+	dp := gauge.message(t, 5).message(t, 1)
+	// NumberDataPoint: start_time_unix_nano = 2, time_unix_nano = 3, as_double = 4, attributes = 7
+	if dp.uint(3) != uint64(at.UnixNano()) || len(dp[2]) != 0 {
+		t.Errorf("gauge time = %d, start = %v", dp.uint(3), dp[2])
+	}
+	if v := math.Float64frombits(dp.uint(4)); v != 12.5 {
+		t.Errorf("gauge value = %v, want 12.5", v)
+	}
+	if attrs := protoAttributes(t, dp, 7); len(attrs) != 1 || attrs["cpu"] != "0" {
+		t.Errorf("gauge attributes = %v", attrs)
+	}
+
+	// Metric.sum = 7: Sum.data_points = 1, aggregation_temporality = 2, is_monotonic = 3
+	for i, tc := range []struct {
+		name        string
+		temporality uint64
+	}{
+		{"net_bytes_sent", temporalityCumulative},
+		{"log_pattern_matches", temporalityDelta},
+	} {
+		m := metrics[i+1]
+		if m.string(1) != tc.name || len(m[5]) != 0 {
+			t.Errorf("metric %d name = %q, want sum %q", i+1, m.string(1), tc.name)
+		}
+		sum := m.message(t, 7)
+		if sum.uint(2) != tc.temporality || sum.uint(3) != 1 {
+			t.Errorf("%s temporality = %d monotonic = %d, want %d and 1", tc.name, sum.uint(2), sum.uint(3), tc.temporality)
+		}
+		dp := sum.message(t, 1)
+		if start := dp.uint(2); start != uint64(s.startedAt.UnixNano()) {
+			t.Errorf("%s start time = %d, want the start of the sink %d", tc.name, start, s.startedAt.UnixNano())
+		}
+	}
+}
+
+func TestOTLPJSON(t *testing.T) {
+	c := newFakeCollector(t)
+	s := newTestOTLP(t, c.URL, OTLPOptions{Encoding: EncodingJSON})
+	at := time.Unix(1700000000, 0)
+	if err := s.Write(context.Background(), []Sample{testSample(at)}); err != nil {
+		t.Fatal(err)
+	}
+	reqs := c.requests()
+	if len(reqs) != 1 || c.contentTypes[0] != "application/json" {
+		t.Fatalf("requests = %d, content type %v", len(reqs), c.contentTypes)
+	}
+	var req struct {
+		ResourceMetrics []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name  string `json:"name"`
+					Gauge *struct {
+						DataPoints []map[string]interface{} `json:"dataPoints"`
+					} `json:"gauge"`
+					Sum *struct {
+						DataPoints             []map[string]interface{} `json:"dataPoints"`
+						AggregationTemporality int                      `json:"aggregationTemporality"`
+						IsMonotonic            bool                     `json:"isMonotonic"`
+					} `json:"sum"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	if err := json.Unmarshal(reqs[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	rm := req.ResourceMetrics[0]
+	attrs := make(map[string]string)
+	for _, a := range rm.Resource.Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	if attrs["device.id"] != "6" || attrs["service.name"] != "sugar-agent" || attrs["env"] != "prod" {
+		t.Errorf("resource attributes = %v", attrs)
+	}
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 3 || metrics[0].Gauge == nil || metrics[1].Sum == nil || metrics[2].Sum == nil {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+	// 64 bit integers are strings in OTLP/JSON
+	if ts := metrics[0].Gauge.DataPoints[0]["timeUnixNano"]; ts != "1700000000000000000" {
+		t.Errorf("timeUnixNano = %#v", ts)
+	}
+	if v := metrics[0].Gauge.DataPoints[0]["asDouble"]; v != 12.5 {
+		t.Errorf("asDouble = %#v", v)
+	}
+	if sum := metrics[1].Sum; sum.AggregationTemporality != temporalityCumulative || !sum.IsMonotonic {
+		t.Errorf("counter temporality = %d monotonic = %t", sum.AggregationTemporality, sum.IsMonotonic)
+	}
+	if sum := metrics[2].Sum; sum.AggregationTemporality != temporalityDelta {
+		t.Errorf("delta temporality = %d", sum.AggregationTemporality)
+	}
+	if _, ok := metrics[2].Sum.DataPoints[0]["startTimeUnixNano"].(string); !ok {
+		t.Errorf("delta data point has no startTimeUnixNano: %v", metrics[2].Sum.DataPoints[0])
+	}
+}
+
+func TestOTLPDeltaStartTime(t *testing.T) {
+	c := newFakeCollector(t)
+	s := newTestOTLP(t, c.URL, OTLPOptions{})
+	first := time.Now().Add(time.Second)
+	second := first.Add(10 * time.Second)
+	if err := s.Write(context.Background(), []Sample{testSample(first), testSample(second)}); err != nil {
+		t.Fatal(err)
+	}
+	reqs := c.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("requests = %d, want 1", len(reqs))
+	}
+	metrics := decodeProto(t, reqs[0]).message(t, 1).message(t, 2).messages(t, 2)
+	points := metrics[2].message(t, 7).messages(t, 1)
+	if len(points) != 2 {
+		t.Fatalf("delta points = %d, want 2", len(points))
+	}
+	// the second interval starts at the time of the first point
+	if points[0].uint(2) != uint64(s.startedAt.UnixNano()) || points[1].uint(2) != uint64(first.UnixNano()) {
+		t.Errorf("delta start times = %d, %d, want %d, %d", points[0].uint(2), points[1].uint(2),
+			s.startedAt.UnixNano(), first.UnixNano())
+	}
+	if points[1].uint(3) != uint64(second.UnixNano()) {
+		t.Errorf("delta time = %d, want %d", points[1].uint(3), second.UnixNano())
+	}
+}
+
+func TestOTLPBatching(t *testing.T) {
+	c := newFakeCollector(t)
+	// 3 points per sample, a sample is never split
+	s := newTestOTLP(t, c.URL, OTLPOptions{MaxBatch: 7})
+	now := time.Now()
+	samples := []Sample{testSample(now), testSample(now.Add(time.Second)), testSample(now.Add(2 * time.Second))}
+	if err := s.Write(context.Background(), samples); err != nil {
+		t.Fatal(err)
+	}
+	reqs := c.requests()
+	if len(reqs) != 2 {
+		t.Fatalf("requests = %d, want 2", len(reqs))
+	}
+	for i, want := range []int{2, 1} {
+		metrics := decodeProto(t, reqs[i]).message(t, 1).message(t, 2).messages(t, 2)
+		if got := len(metrics[0].message(t, 5).messages(t, 1)); got != want {
+			t.Errorf("request %d has %d samples, want %d", i, got, want)
+		}
+	}
+}
+
+func TestOTLPRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"retry on 503 and 429", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, 3, false},
+		{"no retry on 400", []int{http.StatusBadRequest}, 3, 1, true},
+		{"retries used up", []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, 1, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeCollector(t, tt.statuses...)
+			s := newTestOTLP(t, c.URL, OTLPOptions{MaxRetries: tt.maxRetries})
+			err := s.Write(context.Background(), []Sample{testSample(time.Now())})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			reqs := c.requests()
+			if len(reqs) != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", len(reqs), tt.wantRequests)
+			}
+			// a retry sends the same request again
+			for _, r := range reqs[1:] {
+				if string(r) != string(reqs[0]) {
+					t.Error("retried request differs from the first one")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuf a minimal protobuf encoder, enough for the OTLP messages, fields with default values are skipped
+type protoBuf []byte
+
+func (b *protoBuf) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuf) tag(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuf) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuf) bool(field int, v bool) {
+	if v {
+		b.uint(field, 1)
+	}
+}
+
+func (b *protoBuf) fixed64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+// double is always written, it is a member of a oneof
+func (b *protoBuf) double(field int, v float64) {
+	b.tag(field, wireFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+}
+
+func (b *protoBuf) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+// message writes an embedded message encoded by fn
+func (b *protoBuf) message(field int, fn func(m *protoBuf)) {
+	var m protoBuf
+	fn(&m)
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(m)))
+	*b = append(*b, m...)
+}
@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// statusError an unexpected http status of a sink endpoint
+type statusError struct {
+	code       int
+	status     string
+	body       string
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	if e.body == "" {
+		return "unexpected status " + e.status
+	}
+	return fmt.Sprintf("unexpected status %s: %s", e.status, e.body)
+}
+
+// checkResponse returns a *statusError for a non 2xx response
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	e := &statusError{code: resp.StatusCode, status: resp.Status, body: string(body)}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.retryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// retryable reports whether a failed request may succeed later: network errors, 429 and 502/503/504
+func retryable(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	switch se.code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Retry calls fn until it succeeds, fails with a non retryable error or maxRetries retries are used up,
+// retries back off exponentially from 1s to 30s, a Retry-After of the server takes precedence
+// ctx: context, waiting stops when it is cancelled
+// maxRetries: max number of retries
+// fn: the request
+// return: error of the last call
+func Retry(ctx context.Context, maxRetries int, fn func() error) error {
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxRetries || !retryable(err) {
+			return err
+		}
+		wait := backoff
+		var se *statusError
+		if errors.As(err, &se) && se.retryAfter > 0 {
+			wait = se.retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %s)", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package sink
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"sugar-agent/internal"
+)
+
+// Sample metrics of the device taken at the same time
+type Sample struct {
+	Time    time.Time
+	Metrics []internal.Metric
+}
+
+// Resource identifies the device the samples come from
+type Resource struct {
+	DeviceID string
+	Labels   map[string]string // device labels
+	Host     internal.HostInfo
+	Version  string // agent version
+}
+
+// Sink delivers samples to an external system, ex: an OpenTelemetry collector
+type Sink interface {
+	// Name returns the sink name used in logs, ex: otlp
+	Name() string
+	// Write delivers samples, it returns when they are delivered or delivery failed for good
+	Write(ctx context.Context, samples []Sample) error
+	// Close releases resources held by the sink
+	Close() error
+}
+
+// FromSummary converts a sample of StartGetPerfDataTask
+// s: DynamicDataSummary
+// return: Sample
+func FromSummary(s internal.DynamicDataSummary) Sample {
+	return Sample{Time: s.Time(), Metrics: internal.SummaryMetrics(s)}
+}
+
+// FromPerfData converts the result of a perf task
+// p: PerfData
+// return: samples
+func FromPerfData(p *internal.PerfData) []Sample {
+	samples := make([]Sample, 0, len(p.Data))
+	for _, s := range p.Data {
+		samples = append(samples, FromSummary(s))
+	}
+	return samples
+}
+
+// seriesTags returns the tags of a series: device_id, the device labels and the labels of the metric,
+// labels of the metric take precedence
+func seriesTags(res Resource, labels map[string]string) map[string]string {
+	tags := make(map[string]string, len(res.Labels)+len(labels)+1)
+	tags["device_id"] = res.DeviceID
+	for k, v := range res.Labels {
+		tags[k] = v
+	}
+	for k, v := range labels {
+		tags[k] = v
+	}
+	return tags
+}
+
+// sortedKeys returns the keys of m sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
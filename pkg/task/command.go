@@ -0,0 +1,405 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaskTypeCommand runs an allowlisted command or script on the device
+const TaskTypeCommand = 2
+
+// commandPath PATH of commands, the agent's own environment is never passed to commands
+const commandPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// commandWaitDelay how long Wait waits for stdout and stderr to be closed after the command exited or was killed,
+// a process the command started in the background may keep them open
+const commandWaitDelay = 5 * time.Second
+
+// interpreters allowed to run an allowlisted script
+var interpreters = map[string]bool{
+	"/bin/sh":          true,
+	"/bin/bash":        true,
+	"/usr/bin/python3": true,
+}
+
+// CommandOptions agent side limits of the command task
+type CommandOptions struct {
+	Allowlist  []string      // command names, absolute paths or sha256:<hex> of binaries and scripts
+	User       string        // run commands as this user, empty means the agent's user
+	AllowRoot  bool          // allow running commands as root, refused by default
+	WorkDir    string        // base directory, each task runs in its own temporary directory below it
+	MaxOutput  int           // max bytes kept of stdout and of stderr
+	MaxTimeout time.Duration // max timeout a task may ask for, also the default
+	CheckOnly  bool          // only check the options, the work dir is not created, ex: for validate-config
+}
+
+// CommandResult result of a command task
+type CommandResult struct {
+	Command         string   `json:"command"`
+	Args            []string `json:"args"`
+	ExitCode        int      `json:"exitCode"` // -1 if the process was killed
+	Stdout          string   `json:"stdout"`
+	Stderr          string   `json:"stderr"`
+	StdoutTruncated bool     `json:"stdoutTruncated"`
+	StderrTruncated bool     `json:"stderrTruncated"`
+	TimedOut        bool     `json:"timedOut"`
+	Duration        float64  `json:"duration"` // seconds
+}
+
+// commandHandler runs commands under the limits of CommandOptions
+type commandHandler struct {
+	opts      CommandOptions
+	names     map[string]bool
+	hashes    map[string]bool
+	uid, gid  uint32
+	switchUid bool
+}
+
+// NewCommandHandler create the command task handler, it is registered by the agent only when an allowlist is configured
+// opts: CommandOptions
+// return: TaskHandler, error
+func NewCommandHandler(opts CommandOptions) (TaskHandler, error) {
+	h, err := newCommandHandler(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.CheckOnly {
+		err = os.MkdirAll(opts.WorkDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	// a missing work dir is created when the agent runs
+	info, err := os.Stat(opts.WorkDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("command work dir %s is not a directory", opts.WorkDir)
+	}
+	return h, nil
+}
+
+func newCommandHandler(opts CommandOptions) (*commandHandler, error) {
+	h := &commandHandler{
+		opts:   opts,
+		names:  make(map[string]bool),
+		hashes: make(map[string]bool),
+	}
+	for _, item := range opts.Allowlist {
+		if hash, ok := strings.CutPrefix(item, "sha256:"); ok {
+			h.hashes[strings.ToLower(hash)] = true
+		} else {
+			h.names[item] = true
+		}
+	}
+	if len(h.names) == 0 && len(h.hashes) == 0 {
+		return nil, errors.New("command allowlist is empty")
+	}
+	if opts.MaxOutput <= 0 || opts.MaxTimeout <= 0 {
+		return nil, errors.New("command max output and max timeout must be positive")
+	}
+	if !filepath.IsAbs(opts.WorkDir) {
+		return nil, errors.New("command work dir must be an absolute path")
+	}
+	// the uid commands run as, the agent's own when no user is set
+	uid := int64(os.Getuid())
+	if opts.User != "" {
+		u, err := user.Lookup(opts.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = strconv.ParseInt(u.Uid, 10, 64)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		if uid != int64(os.Getuid()) {
+			if os.Getuid() != 0 {
+				return nil, fmt.Errorf("agent must run as root to run commands as %s", opts.User)
+			}
+			h.uid, h.gid, h.switchUid = uint32(uid), uint32(gid), true
+		}
+	}
+	if uid == 0 && !opts.AllowRoot {
+		return nil, errors.New("commands would run as root, set an unprivileged command user or allow root explicitly")
+	}
+	return h, nil
+}
+
+// LoadAllowlist reads a command allowlist file, one entry per line, empty lines and lines starting with # are ignored
+// path: allowlist file path
+// return: entries, error
+func LoadAllowlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (h *commandHandler) Name() string {
+	return "command"
+}
+
+func (h *commandHandler) Version() string {
+	return "1.0"
+}
+
+func (h *commandHandler) Validate(config map[string]interface{}) error {
+	_, _, _, err := h.parseConfig(config)
+	return err
+}
+
+func (h *commandHandler) Run(ctx context.Context, config map[string]interface{}) (interface{}, error) {
+	command, args, timeout, err := h.parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(h.opts.WorkDir, "task-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	script, _ := configString(config, "script", "")
+	path, runArgs := command, args
+	if script != "" {
+		// the script is written to the work dir and passed to the interpreter
+		scriptFile := filepath.Join(dir, "script")
+		err = os.WriteFile(scriptFile, []byte(script), 0500)
+		if err != nil {
+			return nil, err
+		}
+		runArgs = []string{scriptFile}
+	} else {
+		path, err = h.resolve(command)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.switchUid {
+		err = chownAll(dir, int(h.uid), int(h.gid))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stdout := &cappedBuffer{max: h.opts.MaxOutput}
+	stderr := &cappedBuffer{max: h.opts.MaxOutput}
+	cmd := exec.Command(path, runArgs...)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=" + commandPath, "LANG=C", "HOME=" + dir, "TMPDIR=" + dir}
+	cmd.Stdin = nil
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = commandWaitDelay
+	setProcAttr(cmd, h.switchUid, h.uid, h.gid)
+
+	bT := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// kill the whole process group, so children started by the command do not outlive it
+		timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		killProcessGroup(cmd)
+		err = <-done
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// the command exited, a process it started in the background kept stdout or stderr open
+		killProcessGroup(cmd)
+		err = nil
+	}
+	result := &CommandResult{
+		Command:         command,
+		Args:            args,
+		ExitCode:        0,
+		Stdout:          stdout.String(),
+		Stderr:          stderr.String(),
+		StdoutTruncated: stdout.truncated,
+		StderrTruncated: stderr.truncated,
+		TimedOut:        timedOut,
+		Duration:        time.Since(bT).Seconds(),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseConfig validates the task config
+// config keys: command (name or absolute path), args (list of strings), script (script content, command is then the interpreter),
+// timeout (seconds, capped to MaxTimeout)
+// return: command, args, timeout, error
+func (h *commandHandler) parseConfig(config map[string]interface{}) (string, []string, time.Duration, error) {
+	command, err := configString(config, "command", "")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	args, err := configStrings(config, "args")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	script, err := configString(config, "script", "")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	timeout, err := configDuration(config, "timeout", h.opts.MaxTimeout)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if timeout <= 0 || timeout > h.opts.MaxTimeout {
+		timeout = h.opts.MaxTimeout
+	}
+	if script != "" {
+		if command == "" {
+			command = "/bin/sh"
+		}
+		if !interpreters[command] {
+			return "", nil, 0, fmt.Errorf("interpreter %s not allowed", command)
+		}
+		if len(args) > 0 {
+			return "", nil, 0, errors.New("args are not allowed with script")
+		}
+		if !h.hashes[sha256Hex([]byte(script))] {
+			return "", nil, 0, errors.New("script not in allowlist")
+		}
+		return command, nil, timeout, nil
+	}
+	if command == "" {
+		return "", nil, 0, errors.New("command is required")
+	}
+	if _, err = h.resolve(command); err != nil {
+		return "", nil, 0, err
+	}
+	return command, args, timeout, nil
+}
+
+// resolve finds the command binary and checks it against the allowlist by name, path or sha256 hash
+// command: command name or absolute path
+// return: absolute path, error
+func (h *commandHandler) resolve(command string) (string, error) {
+	var path string
+	if filepath.IsAbs(command) {
+		path = filepath.Clean(command)
+	} else {
+		if strings.ContainsRune(command, filepath.Separator) {
+			return "", errors.New("command must be a name or an absolute path")
+		}
+		for _, dir := range filepath.SplitList(commandPath) {
+			p := filepath.Join(dir, command)
+			if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return "", fmt.Errorf("command %s not found", command)
+		}
+		if h.names[command] {
+			return path, nil
+		}
+	}
+	if h.names[path] {
+		return path, nil
+	}
+	if len(h.hashes) > 0 {
+		hash, err := fileSha256(path)
+		if err != nil {
+			return "", err
+		}
+		if h.hashes[hash] {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("command %s not in allowlist", command)
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest
+// the buffer is not embedded, so io.Copy can not bypass Write through bytes.Buffer.ReadFrom
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		// report the full length, a short write would make the command fail with EPIPE
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
+
+// sha256Hex returns the hex encoded sha256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileSha256 returns the hex encoded sha256 of a file
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// chownAll changes the owner of dir and the files in it
+func chownAll(dir string, uid int, gid int) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
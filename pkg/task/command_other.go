@@ -0,0 +1,18 @@
+//go:build !unix
+
+package task
+
+import (
+	"os/exec"
+)
+
+// setProcAttr process groups and user switching are only supported on unix
+func setProcAttr(cmd *exec.Cmd, switchUid bool, uid uint32, gid uint32) {
+}
+
+// killProcessGroup kills the command process only
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
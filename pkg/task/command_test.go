@@ -0,0 +1,173 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCommandHandler creates a command handler allowing entries, root is allowed when the tests run as root
+func newTestCommandHandler(t *testing.T, maxOutput int, entries ...string) *commandHandler {
+	t.Helper()
+	h, err := NewCommandHandler(CommandOptions{
+		Allowlist:  entries,
+		AllowRoot:  os.Getuid() == 0,
+		WorkDir:    t.TempDir(),
+		MaxOutput:  maxOutput,
+		MaxTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*commandHandler)
+}
+
+func TestCommandCheckOnly(t *testing.T) {
+	dir := t.TempDir()
+	opts := CommandOptions{
+		Allowlist:  []string{"echo"},
+		AllowRoot:  os.Getuid() == 0,
+		WorkDir:    filepath.Join(dir, "work"),
+		MaxOutput:  100,
+		MaxTimeout: time.Second,
+		CheckOnly:  true,
+	}
+	if _, err := NewCommandHandler(opts); err != nil {
+		t.Fatalf("NewCommandHandler() of a missing work dir = %v", err)
+	}
+	if _, err := os.Stat(opts.WorkDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("checking the options created the work dir: %v", err)
+	}
+	if err := os.WriteFile(opts.WorkDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCommandHandler(opts); err == nil {
+		t.Fatal("NewCommandHandler() accepted a file as work dir")
+	}
+}
+
+func TestCommandRefusesRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the agent does not run as root")
+	}
+	_, err := NewCommandHandler(CommandOptions{
+		Allowlist:  []string{"echo"},
+		WorkDir:    t.TempDir(),
+		MaxOutput:  1024,
+		MaxTimeout: time.Second,
+	})
+	if err == nil {
+		t.Fatal("NewCommandHandler() allowed running commands as root")
+	}
+}
+
+func TestCommandAllowlist(t *testing.T) {
+	echo, err := (&commandHandler{names: map[string]bool{"echo": true}}).resolve("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoHash, err := fileSha256(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// a link to an allowlisted binary, and a copy of an allowlisted path elsewhere
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(echo, link); err != nil {
+		t.Fatal(err)
+	}
+	allowedDir := filepath.Join(dir, "allowed")
+	if err := os.Mkdir(allowedDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(allowedDir, "tool")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := "echo hello\n"
+
+	tests := []struct {
+		name    string
+		entries []string
+		config  map[string]interface{}
+		wantErr bool
+	}{
+		{"allowed name", []string{"echo"}, map[string]interface{}{"command": "echo"}, false},
+		{"allowed absolute path", []string{echo}, map[string]interface{}{"command": echo}, false},
+		{"allowed hash", []string{"sha256:" + echoHash}, map[string]interface{}{"command": echo}, false},
+		{"allowed hash by name", []string{"sha256:" + echoHash}, map[string]interface{}{"command": "echo"}, false},
+		{"disallowed binary", []string{"echo"}, map[string]interface{}{"command": "cat"}, true},
+		{"disallowed absolute path of allowed name", []string{"echo"}, map[string]interface{}{"command": link}, true},
+		{"relative path", []string{"echo"}, map[string]interface{}{"command": "./echo"}, true},
+		{"name with path traversal", []string{"echo"}, map[string]interface{}{"command": "../bin/echo"}, true},
+		{"absolute path traversal", []string{tool}, map[string]interface{}{"command": allowedDir + "/../allowed/../link"}, true},
+		{"symlink to allowed path", []string{echo}, map[string]interface{}{"command": link}, true},
+		{"missing command", []string{"echo"}, map[string]interface{}{}, true},
+		{"allowed script", []string{"sha256:" + sha256Hex([]byte(script))}, map[string]interface{}{"script": script}, false},
+		{"tampered script", []string{"sha256:" + sha256Hex([]byte(script))}, map[string]interface{}{"script": script + "rm -rf /\n"}, true},
+		{"script with disallowed interpreter", []string{"sha256:" + sha256Hex([]byte(script))}, map[string]interface{}{"script": script, "command": "/usr/bin/perl"}, true},
+		{"script with args", []string{"sha256:" + sha256Hex([]byte(script))}, map[string]interface{}{"script": script, "args": []interface{}{"x"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestCommandHandler(t, 1024, tt.entries...)
+			err := h.Validate(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// Run checks the config again
+				if _, err := h.Run(context.Background(), tt.config); err == nil {
+					t.Fatal("Run() ran a command refused by Validate()")
+				}
+			}
+		})
+	}
+}
+
+// runScript runs an allowlisted shell script and returns its result
+func runScript(t *testing.T, h *commandHandler, script string, timeout float64) *CommandResult {
+	t.Helper()
+	h.hashes[sha256Hex([]byte(script))] = true
+	data, err := h.Run(context.Background(), map[string]interface{}{"script": script, "timeout": timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.(*CommandResult)
+}
+
+func TestCommandRun(t *testing.T) {
+	h := newTestCommandHandler(t, 1024, "echo")
+	result := runScript(t, h, "echo out; echo err >&2; exit 3\n", 5)
+	if result.Stdout != "out\n" || result.Stderr != "err\n" || result.ExitCode != 3 || result.TimedOut {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestCommandEnvScrubbed(t *testing.T) {
+	t.Setenv("SUGAR_AGENT_PASSWORD", "secret")
+	h := newTestCommandHandler(t, 4096, "echo")
+	result := runScript(t, h, "env\n", 5)
+	if strings.Contains(result.Stdout, "SUGAR_AGENT_PASSWORD") {
+		t.Fatalf("the agent's environment is passed to commands: %s", result.Stdout)
+	}
+	if !strings.Contains(result.Stdout, "PATH="+commandPath) {
+		t.Fatalf("PATH is not set: %s", result.Stdout)
+	}
+}
+
+func TestCommandOutputTruncated(t *testing.T) {
+	h := newTestCommandHandler(t, 100, "echo")
+	// far more than the pipe buffer, the command must not block or fail on the dropped output
+	result := runScript(t, h, "i=0; while [ $i -lt 20000 ]; do echo 0123456789; i=$((i+1)); done; echo done >&2\n", 10)
+	if len(result.Stdout) != 100 || !result.StdoutTruncated {
+		t.Fatalf("stdout length = %d, truncated = %t, want 100 and true", len(result.Stdout), result.StdoutTruncated)
+	}
+	if result.Stderr != "done\n" || result.StderrTruncated || result.ExitCode != 0 {
+		t.Fatalf("stderr = %q, truncated = %t, exit code = %d", result.Stderr, result.StderrTruncated, result.ExitCode)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package task
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcAttr starts the command in its own process group, optionally as another user
+func setProcAttr(cmd *exec.Cmd, switchUid bool, uid uint32, gid uint32) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if switchUid {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+	}
+}
+
+// killProcessGroup kills the process group of the command
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	// a negative pid signals the whole group
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
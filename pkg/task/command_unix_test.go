@@ -0,0 +1,49 @@
+//go:build unix
+
+package task
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processAlive returns whether a process exists and is not a zombie
+func processAlive(pid int) bool {
+	if stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+		// the state follows the command name in parentheses
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		return len(fields) > 0 && fields[0] != "Z"
+	}
+	return !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+func TestCommandTimeoutKillsProcessGroup(t *testing.T) {
+	h := newTestCommandHandler(t, 1024, "echo")
+	// the child forks a grandchild and both outlive the timeout
+	script := "sh -c 'sleep 60 & echo $!; wait' &\nwait\n"
+	bT := time.Now()
+	result := runScript(t, h, script, 1)
+	if !result.TimedOut || result.ExitCode != -1 {
+		t.Fatalf("timed out = %t, exit code = %d, want true and -1", result.TimedOut, result.ExitCode)
+	}
+	if d := time.Since(bT); d > commandWaitDelay {
+		t.Fatalf("Run() took %s after the timeout", d)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(result.Stdout))
+	if err != nil {
+		t.Fatalf("grandchild pid %q: %v", result.Stdout, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild %d survived the timeout", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"fmt"
+	"time"
+)
+
+// configUint reads a non-negative integer from the task config
+// config: task config
+// key: config key
+// def: default value when the key is missing, a negative value means the key is required
+// return: value, error
+func configUint(config map[string]interface{}, key string, def int64) (uint64, error) {
+	val, ok := config[key]
+	if !ok || val == nil {
+		if def < 0 {
+			return 0, fmt.Errorf("%s is required", key)
+		}
+		return uint64(def), nil
+	}
+	f, ok := val.(float64)
+	if !ok || f < 0 || f != float64(uint64(f)) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return uint64(f), nil
+}
+
+// configBool reads a bool from the task config
+// config: task config
+// key: config key
+// def: default value when the key is missing
+// return: value, error
+func configBool(config map[string]interface{}, key string, def bool) (bool, error) {
+	val, ok := config[key]
+	if !ok || val == nil {
+		return def, nil
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s must be a bool", key)
+	}
+	return b, nil
+}
+
+// configString reads a string from the task config
+// config: task config
+// key: config key
+// def: default value when the key is missing
+// return: value, error
+func configString(config map[string]interface{}, key string, def string) (string, error) {
+	val, ok := config[key]
+	if !ok || val == nil {
+		return def, nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+// configStrings reads a list of strings from the task config
+// config: task config
+// key: config key
+// return: value, error
+func configStrings(config map[string]interface{}, key string) ([]string, error) {
+	val, ok := config[key]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	items, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	res := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of strings", key)
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// configDuration reads a duration in seconds from the task config
+// config: task config
+// key: config key
+// def: default value when the key is missing
+// return: value, error
+func configDuration(config map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	if _, ok := config[key]; !ok {
+		return def, nil
+	}
+	n, err := configUint(config, key, 0)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
@@ -0,0 +1,35 @@
+package task
+
+import (
+	"context"
+
+	"sugar-agent/internal"
+)
+
+// TaskTypeInventory collects a static inventory snapshot of the device
+const TaskTypeInventory = 1
+
+func init() {
+	Register(TaskTypeInventory, &inventoryHandler{})
+}
+
+// inventoryHandler returns hardware, network, filesystem and package inventory
+type inventoryHandler struct{}
+
+func (h *inventoryHandler) Name() string {
+	return "inventory"
+}
+
+func (h *inventoryHandler) Version() string {
+	return "1.0"
+}
+
+func (h *inventoryHandler) Validate(config map[string]interface{}) error {
+	_, err := configBool(config, "packages", true)
+	return err
+}
+
+func (h *inventoryHandler) Run(ctx context.Context, config map[string]interface{}) (interface{}, error) {
+	withPackages, _ := configBool(config, "packages", true)
+	return internal.GetInventory(ctx, withPackages)
+}
@@ -0,0 +1,201 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// task states recorded in the journal
+const (
+	StateStarted   = "started"
+	StateReporting = "reporting" // the task ran, its result is not confirmed yet
+	StateDone      = "done"
+)
+
+// journalRetention how long a finished task is remembered
+const journalRetention = 7 * 24 * time.Hour
+
+// journalCompactSlack the journal file is rewritten with the current entries once it has this many lines more than
+// twice the number of entries, so it holds at most 2 * entries + journalCompactSlack lines
+const journalCompactSlack = 1000
+
+type journalEntry struct {
+	State     string    `json:"state"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// journalRecord one line of the journal file
+type journalRecord struct {
+	Task string `json:"task"`
+	journalEntry
+}
+
+// Journal records the state of tasks by task uuid, so a redelivered message is not executed twice,
+// the file is a JSON line per state change, appended by Mark
+type Journal struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]journalEntry
+	file    *os.File
+	lines   int // lines in the file
+}
+
+// OpenJournal open or create a task journal, the file is compacted on open; lines which can not be decoded,
+// ex: the last line written when the agent crashed, are skipped
+// path: journal file path, empty means keep the journal in memory only
+// return: *Journal, error
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		entries: make(map[string]journalEntry),
+	}
+	if path == "" {
+		return j, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// journals written by older versions are a single JSON object
+	if json.Unmarshal(b, &j.entries) != nil {
+		j.entries = make(map[string]journalEntry)
+		skipped := 0
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var r journalRecord
+			if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Task == "" {
+				skipped++
+				continue
+			}
+			j.entries[r.Task] = r.journalEntry
+		}
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+		if skipped > 0 {
+			log.Printf("[warn] Skipped %d invalid lines of task journal %s", skipped, path)
+		}
+	}
+	j.expire(time.Now())
+	err = j.compact()
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// State returns the recorded state of a task, empty if unknown
+func (j *Journal) State(taskUUID string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.entries[taskUUID].State
+}
+
+// IsDone returns whether the task has already been finished and reported
+func (j *Journal) IsDone(taskUUID string) bool {
+	return j.State(taskUUID) == StateDone
+}
+
+// Mark records the state of a task and appends it to the journal file
+// taskUUID: task uuid
+// state: StateStarted, StateReporting or StateDone
+// return: error
+func (j *Journal) Mark(taskUUID string, state string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.expire(now)
+	e := journalEntry{State: state, UpdatedAt: now}
+	j.entries[taskUUID] = e
+	if j.path == "" {
+		return nil
+	}
+	if j.file == nil {
+		return errors.New("task journal is closed")
+	}
+	if j.lines >= 2*len(j.entries)+journalCompactSlack {
+		err := j.compact()
+		if err == nil {
+			return nil
+		}
+		// the file is still open, keep appending
+		log.Printf("[warn] Failed to compact task journal %s -> %s", j.path, err)
+	}
+	b, err := json.Marshal(journalRecord{Task: taskUUID, journalEntry: e})
+	if err != nil {
+		return err
+	}
+	// one write per line, a crash leaves at most the last line incomplete
+	_, err = j.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	j.lines++
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// expire forgets the tasks not updated within journalRetention
+func (j *Journal) expire(now time.Time) {
+	for id, e := range j.entries {
+		if now.Sub(e.UpdatedAt) > journalRetention {
+			delete(j.entries, id)
+		}
+	}
+}
+
+// compact rewrites the journal file with one line per entry and appends to the new file, on error the current file
+// stays open
+func (j *Journal) compact() error {
+	var buf bytes.Buffer
+	for id, e := range j.entries {
+		b, err := json.Marshal(journalRecord{Task: id, journalEntry: e})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	// write to a temp file then rename, so a crash never leaves a truncated journal; the temp file stays open for
+	// appending, so there is nothing to reopen after the rename
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open task journal failed: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write task journal failed: %w", err)
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+	}
+	j.file, j.lines = f, len(j.entries)
+	return nil
+}
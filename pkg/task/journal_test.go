@@ -0,0 +1,170 @@
+package task
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestJournal(t *testing.T, path string) *Journal {
+	t.Helper()
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = j.Close() })
+	return j
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := openTestJournal(t, path)
+	if j.State("1") != "" || j.IsDone("1") {
+		t.Fatal("unknown task has a state")
+	}
+	for _, step := range []struct{ task, state string }{{"1", StateStarted}, {"2", StateStarted}, {"1", StateDone}} {
+		if err := j.Mark(step.task, step.state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !j.IsDone("1") || j.State("2") != StateStarted {
+		t.Fatalf("states = %q, %q", j.State("1"), j.State("2"))
+	}
+	// one line appended per Mark
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 3 {
+		t.Fatalf("journal has %d lines, want 3:\n%s", n, b)
+	}
+
+	// the agent crashed while writing a line, nothing was closed
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"task":"2","state":"do`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	j = openTestJournal(t, path)
+	if !j.IsDone("1") || j.State("2") != StateStarted {
+		t.Fatalf("states after reopen = %q, %q", j.State("1"), j.State("2"))
+	}
+	// compacted on open, one line per task
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 2 {
+		t.Fatalf("compacted journal has %d lines, want 2:\n%s", n, b)
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	content := strings.Join([]string{
+		`{"task":"1","state":"done","updatedAt":"` + time.Now().Format(time.RFC3339) + `"}`,
+		`not json`,
+		`{"state":"done"}`,
+		"\x00\x00\x00",
+		`{"task":"2","state":"started","updatedAt":"` + time.Now().Format(time.RFC3339) + `"}`,
+		`{"task":"3","state":"done","updatedAt":"` + time.Now().Add(-2*journalRetention).Format(time.RFC3339) + `"}`,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := openTestJournal(t, path)
+	if !j.IsDone("1") || j.State("2") != StateStarted {
+		t.Fatalf("states = %q, %q", j.State("1"), j.State("2"))
+	}
+	if j.State("3") != "" {
+		t.Fatal("expired task is remembered")
+	}
+}
+
+func TestJournalLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	legacy := `{"1":{"state":"done","updatedAt":"` + time.Now().Format(time.RFC3339) + `"}}`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := openTestJournal(t, path)
+	if !j.IsDone("1") {
+		t.Fatal("task of the legacy journal is not done")
+	}
+	if err := j.Mark("2", StateDone); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	j = openTestJournal(t, path)
+	if !j.IsDone("1") || !j.IsDone("2") {
+		t.Fatalf("states after reopen = %q, %q", j.State("1"), j.State("2"))
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := openTestJournal(t, path)
+	// the same two tasks marked over and over
+	for i := 0; i < 3*journalCompactSlack; i++ {
+		if err := j.Mark("1", StateStarted); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Mark("2", StateDone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n > 2*2+journalCompactSlack {
+		t.Fatalf("journal has %d lines, want at most %d", n, 2*2+journalCompactSlack)
+	}
+	j.Close()
+	j = openTestJournal(t, path)
+	if j.State("1") != StateStarted || !j.IsDone("2") {
+		t.Fatalf("states after compaction = %q, %q", j.State("1"), j.State("2"))
+	}
+}
+
+func TestJournalInMemory(t *testing.T) {
+	j := openTestJournal(t, "")
+	if err := j.Mark("1", StateDone); err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone("1") {
+		t.Fatal("task is not done")
+	}
+}
+
+func TestJournalCompactionFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := openTestJournal(t, path)
+	// the temp file can not be created, the journal keeps appending to the current file
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	j.lines = 2*len(j.entries) + journalCompactSlack
+	if err := j.Mark("1", StateDone); err != nil {
+		t.Fatalf("Mark() with a failing compaction = %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Mark("2", StateDone); err == nil {
+		t.Fatal("Mark() of a closed journal returned no error")
+	}
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	j = openTestJournal(t, path)
+	if !j.IsDone("1") {
+		t.Fatal("task marked while the compaction failed is lost")
+	}
+}
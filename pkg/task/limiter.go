@@ -0,0 +1,87 @@
+package task
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Limiter limits the number of concurrently running tasks per task type
+type Limiter struct {
+	mu      sync.Mutex
+	limits  map[int]int
+	running map[int]int
+}
+
+// NewLimiter create a task type limiter
+// limits: max concurrent tasks by task type, task types not in limits are unlimited
+// return: *Limiter
+func NewLimiter(limits map[int]int) *Limiter {
+	l := &Limiter{running: make(map[int]int)}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits replaces the limits, ex: on config reload; running tasks keep their slots, a lowered limit takes
+// effect as they finish
+// limits: max concurrent tasks by task type, task types not in limits are unlimited
+// return: none
+func (l *Limiter) SetLimits(limits map[int]int) {
+	copied := make(map[int]int, len(limits))
+	for taskType, n := range limits {
+		copied[taskType] = n
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = copied
+}
+
+// TryAcquire takes a slot of the task type without blocking, tasks of unlimited types are counted too,
+// so a limit set later accounts for them
+// return: whether a slot was free, Release must be called when it was
+func (l *Limiter) TryAcquire(taskType int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n, ok := l.limits[taskType]; ok && l.running[taskType] >= n {
+		return false
+	}
+	l.running[taskType]++
+	return true
+}
+
+// Release frees a slot of the task type
+func (l *Limiter) Release(taskType int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[taskType] > 0 {
+		l.running[taskType]--
+	}
+}
+
+// ParseLimits parses task type limits from a comma separated string
+// str: ex: "0=1,1=4" means at most one task of type 0 and four tasks of type 1
+// return: limits by task type, error
+func ParseLimits(str string) (map[int]int, error) {
+	limits := make(map[int]int)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid task type limit: %q", item)
+		}
+		taskType, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid task type in %q", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit in %q", item)
+		}
+		limits[taskType] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,82 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(map[int]int{0: 1, 1: 2})
+	if !l.TryAcquire(0) || l.TryAcquire(0) {
+		t.Fatal("task type 0 is limited to 1")
+	}
+	if !l.TryAcquire(1) || !l.TryAcquire(1) || l.TryAcquire(1) {
+		t.Fatal("task type 1 is limited to 2")
+	}
+	// unlimited task type
+	for i := 0; i < 10; i++ {
+		if !l.TryAcquire(2) {
+			t.Fatal("task type 2 is unlimited")
+		}
+	}
+	l.Release(0)
+	if !l.TryAcquire(0) {
+		t.Fatal("released slot of task type 0 is not free")
+	}
+	// a release without acquire does not free a slot
+	l.Release(3)
+	l.Release(3)
+	l.SetLimits(map[int]int{3: 1})
+	if !l.TryAcquire(3) || l.TryAcquire(3) {
+		t.Fatal("task type 3 is limited to 1")
+	}
+}
+
+func TestLimiterSetLimits(t *testing.T) {
+	l := NewLimiter(map[int]int{0: 2})
+	l.TryAcquire(0)
+	l.TryAcquire(0)
+	l.TryAcquire(1)
+
+	// lowered: the running tasks keep their slots, new ones wait until they finished
+	l.SetLimits(map[int]int{0: 1, 1: 1})
+	if l.TryAcquire(0) {
+		t.Fatal("acquired a slot above the lowered limit")
+	}
+	l.Release(0)
+	if l.TryAcquire(0) {
+		t.Fatal("acquired a slot while the running tasks still use the lowered limit")
+	}
+	l.Release(0)
+	if !l.TryAcquire(0) {
+		t.Fatal("no slot after the running tasks finished")
+	}
+	// a limit of a task type running before it was limited counts the running task
+	if l.TryAcquire(1) {
+		t.Fatal("the running task of type 1 is not counted")
+	}
+
+	// raised and removed
+	l.SetLimits(map[int]int{0: 3})
+	if !l.TryAcquire(0) || !l.TryAcquire(0) || l.TryAcquire(0) {
+		t.Fatal("task type 0 is limited to 3")
+	}
+	if !l.TryAcquire(1) {
+		t.Fatal("task type 1 is unlimited")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(" 0=1, 1=4,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]int{0: 1, 1: 4}; !reflect.DeepEqual(limits, want) {
+		t.Fatalf("ParseLimits() = %v, want %v", limits, want)
+	}
+	for _, str := range []string{"0", "a=1", "0=0", "0=x"} {
+		if _, err := ParseLimits(str); err == nil {
+			t.Errorf("ParseLimits(%q) accepted", str)
+		}
+	}
+}
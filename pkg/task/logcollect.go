@@ -0,0 +1,488 @@
+package task
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"sugar-agent/internal"
+)
+
+// TaskTypeLogCollect fetches log content from the device
+const TaskTypeLogCollect = 3
+
+// defaultTailLines lines returned when the task asks for neither a byte range nor a time range
+const defaultTailLines = 1000
+
+// maxLogLine bytes kept of a log line, the rest of a longer line is dropped
+const maxLogLine = 64 * 1024
+
+// LogCollectOptions agent side limits of the log collection task
+type LogCollectOptions struct {
+	Allowlist []string // glob patterns of files which may be collected, rotated versions of a matched file are allowed too
+	MaxBytes  int      // max bytes collected per file
+}
+
+// LogCollectResult result of a log collection task
+type LogCollectResult struct {
+	Files      []LogFileResult `json:"files"`
+	Attachment LogAttachment   `json:"attachment"`
+}
+
+// LogFileResult what was collected from one log file
+type LogFileResult struct {
+	Path      string   `json:"path"`
+	Sources   []string `json:"sources"` // files read, including rotated versions, oldest first
+	Lines     int      `json:"lines"`
+	Bytes     int      `json:"bytes"`
+	Truncated bool     `json:"truncated"` // more content matched than MaxBytes
+	Error     string   `json:"error,omitempty"`
+}
+
+// LogAttachment the tar.gz archive holding the collected content
+type LogAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Sha256      string `json:"sha256"`
+	Uploaded    bool   `json:"uploaded"`          // uploaded through the sugar-server API
+	Content     string `json:"content,omitempty"` // base64 encoded archive when it could not be uploaded
+}
+
+// logQuery parsed task config
+type logQuery struct {
+	files   []string
+	lines   int
+	offset  int64
+	length  int64
+	since   time.Time
+	until   time.Time
+	grep    *regexp.Regexp
+	rotated bool
+}
+
+// logCollectHandler collects the tail, a byte range or a time range of allowlisted log files
+type logCollectHandler struct {
+	opts LogCollectOptions
+}
+
+// NewLogCollectHandler create the log collection task handler, it is registered by the agent only when an allowlist is configured
+// opts: LogCollectOptions
+// return: TaskHandler, error
+func NewLogCollectHandler(opts LogCollectOptions) (TaskHandler, error) {
+	if len(opts.Allowlist) == 0 {
+		return nil, errors.New("log allowlist is empty")
+	}
+	for _, pattern := range opts.Allowlist {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid log allowlist pattern %q: %w", pattern, err)
+		}
+	}
+	if opts.MaxBytes <= 0 {
+		return nil, errors.New("log max bytes must be positive")
+	}
+	return &logCollectHandler{opts: opts}, nil
+}
+
+func (h *logCollectHandler) Name() string {
+	return "log_collect"
+}
+
+func (h *logCollectHandler) Version() string {
+	return "1.0"
+}
+
+func (h *logCollectHandler) Validate(config map[string]interface{}) error {
+	_, err := h.parseConfig(config)
+	return err
+}
+
+func (h *logCollectHandler) Run(ctx context.Context, config map[string]interface{}) (interface{}, error) {
+	q, err := h.parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	result := &LogCollectResult{}
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for _, path := range q.files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		content, fileResult := h.collect(path, q)
+		result.Files = append(result.Files, fileResult)
+		if fileResult.Error != "" {
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    strings.TrimPrefix(path, "/"),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	data := archive.Bytes()
+	result.Attachment = LogAttachment{
+		Name:        fmt.Sprintf("logs-%s.tar.gz", time.Now().Format("20060102150405")),
+		ContentType: "application/gzip",
+		Size:        len(data),
+		Sha256:      sha256Hex(data),
+	}
+	if u := uploaderFrom(ctx); u != nil {
+		err = u.Upload(result.Attachment.Name, result.Attachment.ContentType, data)
+		if err != nil {
+			return nil, fmt.Errorf("upload log archive failed: %w", err)
+		}
+		result.Attachment.Uploaded = true
+	} else {
+		result.Attachment.Content = base64.StdEncoding.EncodeToString(data)
+	}
+	return result, nil
+}
+
+// parseConfig validates the task config
+// config keys: files (paths or globs), lines, offset/length (bytes), since/until (unix seconds), grep (regex),
+// rotated (include rotated files, default true)
+func (h *logCollectHandler) parseConfig(config map[string]interface{}) (*logQuery, error) {
+	patterns, err := configStrings(config, "files")
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("files is required")
+	}
+	q := &logQuery{}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("%s is not an absolute path", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Clean(pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file matches %s", pattern)
+		}
+		for _, m := range matches {
+			if !h.allowed(m) {
+				return nil, fmt.Errorf("%s not in log allowlist", m)
+			}
+			q.files = append(q.files, m)
+		}
+	}
+	lines, err := configUint(config, "lines", defaultTailLines)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := configUint(config, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	length, err := configUint(config, "length", 0)
+	if err != nil {
+		return nil, err
+	}
+	since, err := configUint(config, "since", 0)
+	if err != nil {
+		return nil, err
+	}
+	until, err := configUint(config, "until", 0)
+	if err != nil {
+		return nil, err
+	}
+	grep, err := configString(config, "grep", "")
+	if err != nil {
+		return nil, err
+	}
+	q.rotated, err = configBool(config, "rotated", true)
+	if err != nil {
+		return nil, err
+	}
+	// every line takes at least its line break, more lines never fit into MaxBytes
+	if lines > uint64(h.opts.MaxBytes) {
+		return nil, fmt.Errorf("lines %d exceeds the limit of %d", lines, h.opts.MaxBytes)
+	}
+	q.lines, q.offset, q.length = int(lines), int64(offset), int64(length)
+	if since > 0 {
+		q.since = time.Unix(int64(since), 0)
+	}
+	if until > 0 {
+		q.until = time.Unix(int64(until), 0)
+	}
+	if grep != "" {
+		q.grep, err = regexp.Compile(grep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grep: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// allowed checks a file against the allowlist, symlinks are resolved first;
+// a rotated version of an allowed file is allowed too, ex: app.log.1, app.log.2.gz or app.log-20230311 of app.log
+func (h *logCollectHandler) allowed(path string) bool {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	base := len(path) - len(filepath.Base(path))
+	for _, pattern := range h.opts.Allowlist {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		// the rotation suffix starts with . or - within the file name, ex: app.log.1, not app.log.key
+		for i := len(path) - 1; i > base; i-- {
+			if (path[i] != '.' && path[i] != '-') || !internal.IsRotationSuffix(path[i:]) {
+				continue
+			}
+			if ok, _ := filepath.Match(pattern, path[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// collect reads the requested content of one log file
+// return: content, LogFileResult
+func (h *logCollectHandler) collect(path string, q *logQuery) ([]byte, LogFileResult) {
+	res := LogFileResult{Path: path}
+	var content []byte
+	var err error
+	switch {
+	case q.length > 0:
+		res.Sources = []string{path}
+		content, res.Truncated, err = h.readRange(path, q.offset, q.length)
+	case !q.since.IsZero() || !q.until.IsZero():
+		content, res.Sources, res.Truncated, err = h.readTimeRange(path, q)
+	default:
+		content, res.Sources, res.Truncated, err = h.readTail(path, q)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return nil, res
+	}
+	res.Bytes = len(content)
+	res.Lines = bytes.Count(content, []byte("\n"))
+	return content, res
+}
+
+// readRange reads length bytes starting at offset of the current file
+func (h *logCollectHandler) readRange(path string, offset int64, length int64) ([]byte, bool, error) {
+	if strings.HasSuffix(path, ".gz") {
+		return nil, false, errors.New("byte range is not supported on compressed files")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	truncated := false
+	if length > int64(h.opts.MaxBytes) {
+		length, truncated = int64(h.opts.MaxBytes), true
+	}
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return buf[:n], truncated, nil
+}
+
+// readTimeRange reads the lines whose timestamp is within [since, until],
+// lines without a timestamp belong to the previous line, ex: stack traces
+func (h *logCollectHandler) readTimeRange(path string, q *logQuery) ([]byte, []string, bool, error) {
+	until := q.until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	var out bytes.Buffer
+	var sources []string
+	truncated := false
+	for _, src := range h.sources(path, q) {
+		if info, err := os.Stat(src); err == nil && info.ModTime().Before(q.since) {
+			// nothing was written to the file after since
+			continue
+		}
+		sources = append(sources, src)
+		var ts time.Time
+		err := scanLog(src, 0, func(line []byte) bool {
+			if t, ok := internal.ParseLogTime(string(line), until); ok {
+				ts = t
+			}
+			if ts.IsZero() || ts.Before(q.since) || ts.After(until) || !q.match(line) {
+				return true
+			}
+			if out.Len()+len(line)+1 > h.opts.MaxBytes {
+				truncated = true
+				return false
+			}
+			out.Write(line)
+			out.WriteByte('\n')
+			return true
+		})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if truncated {
+			break
+		}
+	}
+	return out.Bytes(), sources, truncated, nil
+}
+
+// readTail reads the last lines of the file, continuing into rotated files when the current file is too short
+func (h *logCollectHandler) readTail(path string, q *logQuery) ([]byte, []string, bool, error) {
+	srcs := h.sources(path, q)
+	var chunks [][]string
+	var sources []string
+	need, size := q.lines, 0
+	truncated := false
+	// newest first
+	for i := len(srcs) - 1; i >= 0 && need > 0 && !truncated; i-- {
+		src := srcs[i]
+		var start int64
+		if q.grep == nil && !strings.HasSuffix(src, ".gz") {
+			// without grep the output is at most MaxBytes of the file's end, skip the rest
+			if info, err := os.Stat(src); err == nil && info.Size() > int64(h.opts.MaxBytes) {
+				start = info.Size() - int64(h.opts.MaxBytes)
+			}
+		}
+		// the newest lines within the lines and the bytes left, the ring grows with what is read, not with lines
+		var ring []string
+		ringBytes := 0
+		// the first line is cut when reading does not start at the beginning of the file
+		skipFirst := start > 0
+		err := scanLog(src, start, func(line []byte) bool {
+			if skipFirst {
+				skipFirst = false
+				return true
+			}
+			if !q.match(line) {
+				return true
+			}
+			if len(ring) == need {
+				ringBytes -= len(ring[0]) + 1
+				ring = ring[1:]
+			}
+			ring = append(ring, string(line))
+			ringBytes += len(line) + 1
+			for len(ring) > 0 && size+ringBytes > h.opts.MaxBytes {
+				ringBytes -= len(ring[0]) + 1
+				ring, truncated = ring[1:], true
+			}
+			return true
+		})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		size += ringBytes
+		chunks = append(chunks, ring)
+		sources = append([]string{src}, sources...)
+		need -= len(ring)
+	}
+	var out bytes.Buffer
+	for i := len(chunks) - 1; i >= 0; i-- {
+		for _, line := range chunks[i] {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes(), sources, truncated, nil
+}
+
+// sources returns the files to read for path, oldest first, rotated versions not in the allowlist are skipped
+func (h *logCollectHandler) sources(path string, q *logQuery) []string {
+	if !q.rotated {
+		return []string{path}
+	}
+	var srcs []string
+	for _, src := range internal.RotatedFiles(path) {
+		if h.allowed(src) {
+			srcs = append(srcs, src)
+		}
+	}
+	return append(srcs, path)
+}
+
+// match checks a line against the grep regex
+func (q *logQuery) match(line []byte) bool {
+	return q.grep == nil || q.grep.Match(line)
+}
+
+// scanLog calls fn for every line of a log file starting at offset, until fn returns false,
+// lines longer than maxLogLine are truncated
+func scanLog(path string, offset int64, fn func(line []byte) bool) error {
+	r, err := internal.OpenLog(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if offset > 0 {
+		if f, ok := r.(*os.File); ok {
+			_, err = f.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return scanLines(r, maxLogLine, fn)
+}
+
+// scanLines calls fn for every line of r without the line break, until fn returns false,
+// the bytes of a line beyond max are dropped, so one long line does not fail the whole file
+func scanLines(r io.Reader, max int, fn func(line []byte) bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if room := max - len(line); room > 0 {
+			if len(chunk) > room {
+				line = append(line, chunk[:room]...)
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if len(chunk) > 0 || len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if !fn(line) {
+				return nil
+			}
+		}
+		line = line[:0]
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
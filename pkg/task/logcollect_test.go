@@ -0,0 +1,138 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogCollectRotatedSources(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "shadow")
+	files := map[string]string{
+		"app.log":   "current\n",
+		"app.log.1": "rotated\n",
+		"other.txt": "not allowed\n",
+		// shares the prefix of app.log but is no rotated version
+		"app.log.key": "secret\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(secret, []byte("root:x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// rotated versions may not point outside the allowlist, nor at another file inside it
+	for name, target := range map[string]string{"app.log.2": secret, "app.log.3": filepath.Join(dir, "other.txt")} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// app.log.1 is older than app.log
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "app.log.1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewLogCollectHandler(LogCollectOptions{Allowlist: []string{filepath.Join(dir, "*.log")}, MaxBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler.(*logCollectHandler)
+	for path, want := range map[string]bool{
+		filepath.Join(dir, "app.log"):             true,
+		filepath.Join(dir, "app.log.1"):           true,
+		filepath.Join(dir, "app.log-20230311"):    true,
+		filepath.Join(dir, "app.log.2.gz"):        true,
+		filepath.Join(dir, "app.log-20230311.gz"): true,
+		filepath.Join(dir, "app.log.key"):         false,
+		filepath.Join(dir, "app.log-secrets"):     false,
+		filepath.Join(dir, "app.log.1.bak"):       false,
+		filepath.Join(dir, "app.log-2023.gz"):     false,
+		filepath.Join(dir, "app.log.2"):           false,
+		filepath.Join(dir, "other.txt"):           false,
+		secret:                                    false,
+	} {
+		if got := h.allowed(path); got != want {
+			t.Errorf("allowed(%s) = %t, want %t", path, got, want)
+		}
+	}
+
+	data, err := h.Run(context.Background(), map[string]interface{}{"files": []interface{}{filepath.Join(dir, "app.log")}, "lines": 100.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := data.(*LogCollectResult)
+	want := []string{filepath.Join(dir, "app.log.1"), filepath.Join(dir, "app.log")}
+	if len(result.Files) != 1 || !reflect.DeepEqual(result.Files[0].Sources, want) {
+		t.Fatalf("sources = %+v, want %v", result.Files, want)
+	}
+	if result.Files[0].Lines != 2 {
+		t.Fatalf("lines = %d, want 2", result.Files[0].Lines)
+	}
+}
+
+func TestScanLinesTruncatesLongLines(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+	input := fmt.Sprintf("first\r\n%s\nlast", long)
+	var lines []string
+	err := scanLines(strings.NewReader(input), 1024, func(line []byte) bool {
+		lines = append(lines, string(bytes.Clone(line)))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first", long[:1024], "last"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %d lines, want %d: first=%q last=%q", len(lines), len(want), lines[0], lines[len(lines)-1])
+	}
+
+	// fn returning false stops the scan
+	var n int
+	if err := scanLines(strings.NewReader("a\nb\nc\n"), 1024, func([]byte) bool { n++; return n < 2 }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("scanned %d lines after stop, want 2", n)
+	}
+}
+
+func TestLogCollectLinesLimit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	var content strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&content, "line %02d\n", i)
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewLogCollectHandler(LogCollectOptions{Allowlist: []string{filepath.Join(dir, "*.log")}, MaxBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more lines than bytes never fit, the ring would be allocated for nothing
+	_, err = handler.Run(context.Background(), map[string]interface{}{"files": []interface{}{path}, "lines": 1e9})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("Run() with too many lines error = %v", err)
+	}
+
+	data, err := handler.Run(context.Background(), map[string]interface{}{"files": []interface{}{path}, "lines": 64.0, "grep": "^line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := data.(*LogCollectResult).Files[0]
+	// 8 lines of 8 bytes fit into 64 bytes
+	if !file.Truncated || file.Lines != 8 {
+		t.Fatalf("got %+v, want 8 lines truncated", file)
+	}
+}
@@ -0,0 +1,86 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"sugar-agent/internal"
+)
+
+// TaskTypePerfData collects performance data of the device
+const TaskTypePerfData = 0
+
+func init() {
+	Register(TaskTypePerfData, &perfDataHandler{})
+}
+
+// perfDataHandler samples cpu, memory, disk and load every intervals seconds, count times
+type perfDataHandler struct{}
+
+func (h *perfDataHandler) Name() string {
+	return "perf_data"
+}
+
+func (h *perfDataHandler) Version() string {
+	return "1.0"
+}
+
+func (h *perfDataHandler) Validate(config map[string]interface{}) error {
+	_, err := configUint(config, "intervals", -1)
+	if err != nil {
+		return err
+	}
+	count, err := configUint(config, "count", -1)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("count must be at least 1")
+	}
+	_, err = extraCollectors(config)
+	return err
+}
+
+func (h *perfDataHandler) Run(ctx context.Context, config map[string]interface{}) (interface{}, error) {
+	intervals, _ := configUint(config, "intervals", -1)
+	count, _ := configUint(config, "count", -1)
+	names, _ := extraCollectors(config)
+	extra, err := internal.NewCollectors(names)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseCollectors(extra)
+	perfData, err := internal.StartGetPerfDataTask(ctx, intervals, count, extra)
+	if err != nil && perfData != nil {
+		// cancelled or timed out, the samples taken so far are still reported
+		return perfData, fmt.Errorf("get perf data task stopped after %d of %d samples: %w", len(perfData.Data), count, err)
+	}
+	if err != nil {
+		return nil, errors.New("get perf data task failed")
+	}
+	return perfData, nil
+}
+
+// extraCollectors returns the additional collectors asked for by the "collectors" config key,
+// all registered additional collectors when the key is missing
+func extraCollectors(config map[string]interface{}) ([]string, error) {
+	if _, ok := config["collectors"]; !ok {
+		return internal.ExtraCollectors(), nil
+	}
+	names, err := configStrings(config, "collectors")
+	if err != nil {
+		return nil, err
+	}
+	available := internal.ExtraCollectors()
+	for _, name := range names {
+		found := false
+		for _, a := range available {
+			found = found || a == name
+		}
+		if !found {
+			return nil, fmt.Errorf("collector %s not available", name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,65 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TaskHandler executes one kind of task, handlers register themselves in the registry by task type
+type TaskHandler interface {
+	// Name returns a short name of the task type, ex: perf_data
+	Name() string
+	// Version returns the version of the handler, the server may use it to decide which config to send
+	Version() string
+	// Validate checks the task config before the task is started
+	Validate(config map[string]interface{}) error
+	// Run executes the task and returns a result payload which is marshalled to JSON
+	Run(ctx context.Context, config map[string]interface{}) (interface{}, error)
+}
+
+// TaskTypeInfo describes a supported task type
+type TaskTypeInfo struct {
+	Type    int    `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[int]TaskHandler)
+)
+
+// Register registers the handler of a task type, it panics if the task type is registered twice
+// taskType: task type from the task message
+// handler: TaskHandler
+// return: none
+func Register(taskType int, handler TaskHandler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[taskType]; ok {
+		panic(fmt.Sprintf("task type %d registered twice", taskType))
+	}
+	registry[taskType] = handler
+}
+
+// Lookup returns the handler of a task type
+func Lookup(taskType int) (TaskHandler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	h, ok := registry[taskType]
+	return h, ok
+}
+
+// Supported returns the supported task types sorted by type
+func Supported() []TaskTypeInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	infos := make([]TaskTypeInfo, 0, len(registry))
+	for t, h := range registry {
+		infos = append(infos, TaskTypeInfo{Type: t, Name: h.Name(), Version: h.Version()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Type < infos[j].Type })
+	return infos
+}
@@ -1,34 +1,47 @@
 package task
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-
-	"sugar-agent/internal"
-	"sugar-agent/pkg/utils"
+	"fmt"
 )
 
-func StartTask(msg []byte) (*internal.PerfData, error) {
-	mqMessage := make(map[string]interface{})
-	err := json.Unmarshal(msg, &mqMessage)
-	utils.FailOnError(err, "Failed to unmarshal message")
-	taskType := mqMessage["task_type"].(float64)
-	taskConfig := mqMessage["metadata"].(map[string]interface{})["task_config"].(map[string]interface{})
-
-	if taskType == 0 {
-		intervals := taskConfig["intervals"].(float64)
-		count := taskConfig["count"].(float64)
-		perfData, err := internal.StartGetPerfDataTask(uint64(intervals), uint64(count))
-		if err != nil {
-			return nil, errors.New("get perf data task failed")
+// StartTask starts the task described by a task message
+// ctx: context, the task is cancelled when it is done
+// msg: task message
+// return: task result, error
+func StartTask(ctx context.Context, msg []byte) (result interface{}, err error) {
+	// a malformed task config must fail the task instead of crashing the agent
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("task panicked: %v", r)
 		}
-		//b, err := json.MarshalIndent(perfData, "", "  ")
-		//utils.FailOnError(err, "json marshal failed")
-		//err = os.WriteFile("perfData.json", b, 0644)
-		//utils.FailOnError(err, "write file failed")
-		return perfData, nil
-	} else {
-		//fmt.Println("TaskType != 0", mqMessage.TaskType)
+	}()
+	var mqMessage struct {
+		TaskType *int `json:"task_type"`
+		Metadata struct {
+			TaskConfig map[string]interface{} `json:"task_config"`
+		} `json:"metadata"`
+	}
+	err = json.Unmarshal(msg, &mqMessage)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal task message failed: %w", err)
+	}
+	if mqMessage.TaskType == nil {
+		return nil, errors.New("task type is missing")
+	}
+	handler, ok := Lookup(*mqMessage.TaskType)
+	if !ok {
+		return nil, errors.New("task type not supported")
+	}
+	taskConfig := mqMessage.Metadata.TaskConfig
+	if taskConfig == nil {
+		taskConfig = map[string]interface{}{}
+	}
+	err = handler.Validate(taskConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task config: %w", err)
 	}
-	return nil, errors.New("task type not supported")
+	return handler.Run(ctx, taskConfig)
 }
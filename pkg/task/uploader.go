@@ -0,0 +1,27 @@
+package task
+
+import (
+	"context"
+)
+
+// Uploader uploads files produced by a task, ex: to the sugar-server API
+type Uploader interface {
+	// Upload uploads data as an attachment of the current task
+	Upload(name string, contentType string, data []byte) error
+}
+
+type uploaderKey struct{}
+
+// WithUploader returns a context carrying the uploader of the current task
+// ctx: parent context
+// u: Uploader
+// return: context.Context
+func WithUploader(ctx context.Context, u Uploader) context.Context {
+	return context.WithValue(ctx, uploaderKey{}, u)
+}
+
+// uploaderFrom returns the uploader of the current task, nil if the result transport can not upload
+func uploaderFrom(ctx context.Context) Uploader {
+	u, _ := ctx.Value(uploaderKey{}).(Uploader)
+	return u
+}
@@ -3,8 +3,37 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 )
 
+// successCode code of a successful sugar-server API response
+const successCode = 20000
+
+// apiResponse decodes a sugar-server API response, a body which is not a JSON object, e.g. the error page of a
+// proxy, or a response without a numeric code is an error
+// resp: response body
+// return: response data, code, error
+func apiResponse(resp []byte) (map[string]interface{}, float64, error) {
+	data := make(map[string]interface{})
+	err := json.Unmarshal(resp, &data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unmarshal response body failed: %w: %s", err, truncate(resp, 200))
+	}
+	code, ok := data["code"].(float64)
+	if !ok {
+		return nil, 0, fmt.Errorf("response has no code: %s", truncate(resp, 200))
+	}
+	return data, code, nil
+}
+
+// truncate returns at most n bytes of b as a string
+func truncate(b []byte, n int) string {
+	if len(b) > n {
+		return string(b[:n]) + "..."
+	}
+	return string(b)
+}
+
 func UserLogin(baseUrl string, reqData map[string]interface{}) (string, error) {
 	client := &HTTPClient{
 		BaseURL: baseUrl,
@@ -12,15 +41,23 @@ func UserLogin(baseUrl string, reqData map[string]interface{}) (string, error) {
 	resp, err := client.Post("/api/v1/system/users/login/", map[string]string{
 		"Content-Type": "application/json",
 	}, reqData)
-	FailOnError(err, "Failed to send request")
-	data := make(map[string]interface{})
-	err = json.Unmarshal(resp, &data)
-	FailOnError(err, "Failed to unmarshal response body")
-	if data["code"].(float64) == 20000 && data["message"] == "登录成功" {
+	if err != nil {
+		return "", err
+	}
+	data, code, err := apiResponse(resp)
+	if err != nil {
+		return "", err
+	}
+	if code == successCode && data["message"] == "登录成功" {
 		// convert token to string
-		return data["data"].(map[string]interface{})["access"].(string), nil
+		if d, ok := data["data"].(map[string]interface{}); ok {
+			if token, ok := d["access"].(string); ok {
+				return token, nil
+			}
+		}
+		return "", errors.New("login response has no access token")
 	}
-	return "", errors.New("failed to login")
+	return "", fmt.Errorf("failed to login: code %v, message %v", code, data["message"])
 }
 
 func UpdateTaskStatus(baseUrl string, reqData map[string]interface{}, taskUUID string, token string) error {
@@ -31,12 +68,35 @@ func UpdateTaskStatus(baseUrl string, reqData map[string]interface{}, taskUUID s
 		"Content-Type":  "application/json",
 		"Authorization": `Bearer ` + token,
 	}, reqData)
-	FailOnError(err, "Failed to send request")
-	data := make(map[string]interface{})
-	err = json.Unmarshal(resp, &data)
-	FailOnError(err, "Failed to unmarshal response body")
-	if data["code"].(float64) == 20000 && data["message"] == "success" {
+	if err != nil {
+		return err
+	}
+	data, code, err := apiResponse(resp)
+	if err != nil {
+		return err
+	}
+	if code == successCode && data["message"] == "success" {
+		return nil
+	}
+	return fmt.Errorf("failed to update task status: code %v, message %v", code, data["message"])
+}
+
+func UploadTaskAttachment(baseUrl string, taskUUID string, token string, filename string, data []byte) error {
+	client := &HTTPClient{
+		BaseURL: baseUrl,
+	}
+	resp, err := client.PostFile("/api/v1/task-results/"+taskUUID+"/attachments/", map[string]string{
+		"Authorization": `Bearer ` + token,
+	}, "file", filename, data)
+	if err != nil {
+		return err
+	}
+	respData, code, err := apiResponse(resp)
+	if err != nil {
+		return err
+	}
+	if code == successCode {
 		return nil
 	}
-	return errors.New("failed to update task status")
+	return fmt.Errorf("failed to upload task attachment: code %v, message %v", code, respData["message"])
 }
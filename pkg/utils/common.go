@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // FailOnError check error
@@ -29,8 +31,51 @@ func LogOnError(err error, msg string) {
 // ShowTips show tips
 func ShowTips() {
 	log.Printf("[error] Parse parmas error, Please check your input params!")
-	fmt.Printf("Welcome to use, you can type ./sugar-agent -h to show help message." +
-		"\nUsages: ./sugar-agent -user guest -password guest -host localhost -port 5672 -exchange-name device_exchange " +
+	fmt.Printf("Welcome to use, you can type ./sugar-agent help to show the commands and ./sugar-agent run -h to show help message." +
+		"\nUsages: ./sugar-agent run -user guest -password guest -host localhost -port 5672 -exchange-name device_exchange " +
 		"-device-id 6\n")
 	os.Exit(4)
 }
+
+// HeaderToInt64 converts an AMQP header value to int64
+// val: header value
+// return: int64, error
+func HeaderToInt64(val interface{}) (int64, error) {
+	switch t := val.(type) {
+	case int:
+		return int64(t), nil
+	case int8:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint8:
+		return int64(t), nil
+	case uint16:
+		return int64(t), nil
+	case uint32:
+		return int64(t), nil
+	case float64:
+		return int64(t), nil
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	}
+	return 0, fmt.Errorf("unsupported header type %T", val)
+}
+
+// SplitList splits a comma separated string, items are trimmed and empty items are dropped
+// str: ex: "a, b,,c"
+// return: ex: ["a", "b", "c"]
+func SplitList(str string) []string {
+	var items []string
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// log levels, the level of a line is taken from its tag: [debug], [warn] or [error],
+// lines of LogOnError and FailOnError are errors and all other lines are info
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+var levels = map[string]int32{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+// levelWriter is the output of the standard logger, it drops lines below the level
+type levelWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	file   *os.File // log file, nil means stderr
+	level  atomic.Int32
+	header atomic.Int32 // length of the date and time the standard logger writes before the message
+}
+
+var logOutput = &levelWriter{out: os.Stderr}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if lineLevel(p, int(w.header.Load())) < w.level.Load() {
+		return len(p), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.Write(p)
+}
+
+// lineLevel returns the level of a log line from the tag the message starts with, a tag within the message,
+// ex: of a logged task body, is no tag
+// p: log line
+// header: length of the date and time before the message
+// return: level
+func lineLevel(p []byte, header int) int32 {
+	if header <= len(p) {
+		p = p[header:]
+	}
+	switch {
+	case bytes.HasPrefix(p, []byte("[error]")), bytes.HasPrefix(p, []byte("Error happened")):
+		return levels[LevelError]
+	case bytes.HasPrefix(p, []byte("[warn]")):
+		return levels[LevelWarn]
+	case bytes.HasPrefix(p, []byte("[debug]")):
+		return levels[LevelDebug]
+	}
+	return levels[LevelInfo]
+}
+
+// headerLen returns the length of the date and time the standard logger writes with flags, ex: 2006/01/02 15:04:05
+func headerLen(flags int) int {
+	n := 0
+	if flags&log.Ldate != 0 {
+		n += len("2006/01/02 ")
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		n += len("15:04:05 ")
+		if flags&log.Lmicroseconds != 0 {
+			n += len(".000000")
+		}
+	}
+	return n
+}
+
+// SetupLogging sets the level and output of the standard logger, it may be called again to change them
+// level: debug, info, warn or error
+// file: file logs are appended to, empty means stderr
+// return: error
+func SetupLogging(level, file string) error {
+	lv, ok := levels[level]
+	if !ok {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	var out io.Writer = os.Stderr
+	var f *os.File
+	if file != "" {
+		var err error
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("open log file failed: %w", err)
+		}
+		out = f
+	}
+	logOutput.mu.Lock()
+	old := logOutput.file
+	logOutput.out, logOutput.file = out, f
+	logOutput.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	logOutput.level.Store(lv)
+	logOutput.header.Store(int32(headerLen(log.Flags())))
+	log.SetOutput(logOutput)
+	return nil
+}
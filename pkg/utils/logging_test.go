@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"log"
+	"testing"
+)
+
+func TestLineLevel(t *testing.T) {
+	header := headerLen(log.LstdFlags)
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"error tag", "2023/03/11 10:10:10 [error] Invalid config\n", LevelError},
+		{"error of LogOnError", "2023/03/11 10:10:10 Error happened, Failed to ack message: closed\n", LevelError},
+		{"warn tag", "2023/03/11 10:10:10 [warn] Probe failed -> tcp_probe\n", LevelWarn},
+		{"debug tag", "2023/03/11 10:10:10 [debug] Skip series\n", LevelDebug},
+		{"untagged", "2023/03/11 10:10:10 [x] Start task 1 [x]\n", LevelInfo},
+		{"tag in a task body", `2023/03/11 10:10:10 [x] Received a message [x] -> {"grep":"[error]"}` + "\n", LevelInfo},
+		{"error text in a message", "2023/03/11 10:10:10 [x] Task failed [x] -> Error happened [debug]\n", LevelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineLevel([]byte(tt.line), header); got != levels[tt.want] {
+				t.Fatalf("lineLevel(%q) = %d, want %s", tt.line, got, tt.want)
+			}
+		})
+	}
+}
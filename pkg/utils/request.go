@@ -3,10 +3,18 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"time"
 )
 
+// requestTimeout 单个请求的超时时间，服务端无响应时不会一直阻塞任务
+const requestTimeout = 30 * time.Second
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
 // HTTPClient 是自定义的HTTP客户端结构体
 type HTTPClient struct {
 	BaseURL string
@@ -14,108 +22,79 @@ type HTTPClient struct {
 
 // Get 发送GET请求
 func (c *HTTPClient) Get(path string, headers map[string]string) ([]byte, error) {
-	url := c.BaseURL + path
-	req, err := http.NewRequest("GET", url, nil)
-	FailOnError(err, "Failed to create request")
-
-	// 添加请求头
-	for key, value := range headers {
-		req.Header.Set(key, value)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	FailOnError(err, "Failed to send request")
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		FailOnError(err, "Failed to close response body")
-	}(resp.Body)
-
-	body, err := io.ReadAll(resp.Body)
-	FailOnError(err, "Failed to read response body")
-	return body, nil
+	return c.do("GET", path, headers, nil, "")
 }
 
 // Post 发送POST请求
 func (c *HTTPClient) Post(path string, headers map[string]string, body interface{}) ([]byte, error) {
-	url := c.BaseURL + path
-
-	jsonData, err := json.Marshal(body)
-	FailOnError(err, "Failed to marshal body")
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	FailOnError(err, "Failed to create request")
-
-	// 添加请求头
-	for key, value := range headers {
-		req.Header.Set(key, value)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	FailOnError(err, "Failed to send request")
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		FailOnError(err, "Failed to close response body")
-	}(resp.Body)
-
-	respBody, err := io.ReadAll(resp.Body)
-	FailOnError(err, "Failed to read response body")
-	return respBody, nil
+	return c.doJSON("POST", path, headers, body)
 }
 
 // Put 发送PUT请求
 func (c *HTTPClient) Put(path string, headers map[string]string, body interface{}) ([]byte, error) {
-	url := c.BaseURL + path
-
-	jsonData, err := json.Marshal(body)
-	FailOnError(err, "Failed to marshal body")
-
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
-	FailOnError(err, "Failed to create request")
-
-	// 添加请求头
-	for key, value := range headers {
-		req.Header.Set(key, value)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	FailOnError(err, "Failed to send request")
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		FailOnError(err, "Failed to close response body")
-	}(resp.Body)
-
-	respBody, err := io.ReadAll(resp.Body)
-	FailOnError(err, "Failed to read response body")
-
-	return respBody, nil
+	return c.doJSON("PUT", path, headers, body)
 }
 
 // Patch 发送PATCH请求
 func (c *HTTPClient) Patch(path string, headers map[string]string, body interface{}) ([]byte, error) {
-	url := c.BaseURL + path
+	return c.doJSON("PATCH", path, headers, body)
+}
+
+// PostFile 发送multipart/form-data格式的POST请求上传文件
+func (c *HTTPClient) PostFile(path string, headers map[string]string, field string, filename string, data []byte) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(field, filename)
+	if err != nil {
+		return nil, fmt.Errorf("create form file failed: %w", err)
+	}
+	_, err = part.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("write form file failed: %w", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close multipart writer failed: %w", err)
+	}
+	return c.do("POST", path, headers, body, writer.FormDataContentType())
+}
 
+// doJSON 发送JSON格式请求体的请求
+func (c *HTTPClient) doJSON(method string, path string, headers map[string]string, body interface{}) ([]byte, error) {
 	jsonData, err := json.Marshal(body)
-	FailOnError(err, "Failed to marshal body")
+	if err != nil {
+		return nil, fmt.Errorf("marshal body failed: %w", err)
+	}
+	return c.do(method, path, headers, bytes.NewReader(jsonData), "application/json")
+}
 
-	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonData))
-	FailOnError(err, "Failed to create request")
+// do 发送请求并读取响应体，网络错误和读取错误作为error返回
+func (c *HTTPClient) do(method string, path string, headers map[string]string, body io.Reader, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
 
 	// 添加请求头
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
-	FailOnError(err, "Failed to send request")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request failed: %w", err)
+	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
-		FailOnError(err, "Failed to close response body")
+		LogOnError(err, "Failed to close response body")
 	}(resp.Body)
 
 	respBody, err := io.ReadAll(resp.Body)
-	FailOnError(err, "Failed to read response body")
+	if err != nil {
+		return nil, fmt.Errorf("read response body failed: %w", err)
+	}
 	return respBody, nil
 }